@@ -0,0 +1,208 @@
+package httpproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"github.com/xuiv/goproxy/httpproxy/helpers"
+)
+
+type AccessLogConfig struct {
+	Enabled    bool
+	Format     string // "combined" or "json"
+	Filename   string
+	MaxSize    int // megabytes
+	MaxBackups int
+}
+
+// AccessRecord is one entry of the access log, a request or a tunnel.
+type AccessRecord struct {
+	Time      time.Time
+	RequestID string
+	Profile   string
+	Client    string
+	User      string // authenticated by a filter, e.g. auth, never the claimed one
+	Method    string
+	URL       string
+	Proto     string
+	Referer   string
+	Agent     string
+	Filter    string
+	Status    int
+	BytesIn   int64
+	BytesOut  int64
+	Duration  time.Duration
+	Error     string
+	Fields    map[string]interface{}
+}
+
+type AccessLogger struct {
+	Config AccessLogConfig
+	w      io.Writer
+}
+
+var (
+	accessLogMu    sync.Mutex
+	accessLogFiles = make(map[string]*helpers.RotatingFile)
+)
+
+// NewAccessLogger creates an AccessLogger, profiles logging to the same
+// Filename share one file and the rotation settings of the first one.
+func NewAccessLogger(config AccessLogConfig) (*AccessLogger, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	if config.Format == "" {
+		config.Format = "combined"
+	}
+
+	accessLogMu.Lock()
+	defer accessLogMu.Unlock()
+
+	f, ok := accessLogFiles[config.Filename]
+	if !ok {
+		f = &helpers.RotatingFile{
+			Filename:   config.Filename,
+			MaxSize:    int64(config.MaxSize) << 20,
+			MaxBackups: config.MaxBackups,
+		}
+		accessLogFiles[config.Filename] = f
+	}
+
+	return &AccessLogger{
+		Config: config,
+		w:      f,
+	}, nil
+}
+
+func (c *AccessLogConfig) validate() error {
+	switch c.Format {
+	case "", "combined", "json":
+	default:
+		return fmt.Errorf("unknown access log format %#v", c.Format)
+	}
+
+	if c.Filename == "" {
+		return fmt.Errorf("access log filename is empty")
+	}
+
+	return nil
+}
+
+func (l *AccessLogger) Log(r *AccessRecord) {
+	if l == nil {
+		return
+	}
+
+	var line []byte
+	switch l.Config.Format {
+	case "json":
+		line = r.jsonLine()
+	default:
+		line = r.combinedLine()
+	}
+
+	if _, err := l.w.Write(line); err != nil {
+		glog.Warningf("AccessLog write %#v error: %v", l.Config.Filename, err)
+	}
+}
+
+// combinedLine formats r as the Combined Log Format followed by the filter,
+// duration and the other fields as key="value" pairs.
+func (r *AccessRecord) combinedLine() []byte {
+	var b bytes.Buffer
+
+	host := r.Client
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	fmt.Fprintf(&b, "%s - %s [%s] %s %d %d %s %s",
+		dash(host),
+		dash(r.User),
+		r.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(r.Method+" "+r.URL+" "+r.Proto),
+		r.Status,
+		r.BytesOut,
+		strconv.Quote(dash(r.Referer)),
+		strconv.Quote(dash(r.Agent)))
+
+	fmt.Fprintf(&b, " filter=%s duration=%.3f bytes_in=%d request_id=%s", dash(r.Filter), r.Duration.Seconds(), r.BytesIn, dash(r.RequestID))
+	if r.Error != "" {
+		fmt.Fprintf(&b, " error=%s", strconv.Quote(r.Error))
+	}
+
+	keys := make([]string, 0, len(r.Fields))
+	for key := range r.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, " %s=%s", key, strconv.Quote(fmt.Sprint(r.Fields[key])))
+	}
+
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+func (r *AccessRecord) jsonLine() []byte {
+	data, err := json.Marshal(struct {
+		Time      string                 `json:"time"`
+		RequestID string                 `json:"request_id"`
+		Profile   string                 `json:"profile"`
+		Client    string                 `json:"client"`
+		User      string                 `json:"user,omitempty"`
+		Method    string                 `json:"method"`
+		URL       string                 `json:"url"`
+		Proto     string                 `json:"proto"`
+		Referer   string                 `json:"referer,omitempty"`
+		Agent     string                 `json:"user_agent,omitempty"`
+		Filter    string                 `json:"filter"`
+		Status    int                    `json:"status"`
+		BytesIn   int64                  `json:"bytes_in"`
+		BytesOut  int64                  `json:"bytes_out"`
+		Duration  float64                `json:"duration"`
+		Error     string                 `json:"error,omitempty"`
+		Fields    map[string]interface{} `json:"fields,omitempty"`
+	}{
+		Time:      r.Time.Format(time.RFC3339Nano),
+		RequestID: r.RequestID,
+		Profile:   r.Profile,
+		Client:    r.Client,
+		User:      r.User,
+		Method:    r.Method,
+		URL:       r.URL,
+		Proto:     r.Proto,
+		Referer:   r.Referer,
+		Agent:     r.Agent,
+		Filter:    r.Filter,
+		Status:    r.Status,
+		BytesIn:   r.BytesIn,
+		BytesOut:  r.BytesOut,
+		Duration:  r.Duration.Seconds(),
+		Error:     r.Error,
+		Fields:    r.Fields,
+	})
+	if err != nil {
+		data = []byte(strconv.Quote(err.Error()))
+	}
+
+	return append(data, '\n')
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
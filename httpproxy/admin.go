@@ -0,0 +1,449 @@
+package httpproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+	"github.com/phuslu/glog"
+
+	"github.com/xuiv/goproxy/httpproxy/filters"
+	"github.com/xuiv/goproxy/httpproxy/filters/autoproxy"
+	"github.com/xuiv/goproxy/httpproxy/filters/gae"
+	"github.com/xuiv/goproxy/httpproxy/helpers"
+	"github.com/xuiv/goproxy/httpproxy/metrics"
+)
+
+type AdminConfig struct {
+	Enabled     bool
+	Address     string
+	Username    string
+	Password    string
+	MetricsPath string
+}
+
+// Admin serves the JSON control endpoints of a running goproxy on its own
+// listener, all of them require basic authentication.
+//
+//	GET  /profiles                               running profiles and filter chains
+//	GET  /conns?profile=                         requests in flight and tunnels
+//	POST /conns/close?id=                        close a request or tunnel
+//	GET  /trace?id=                              timeline of a request by X-Request-Id
+//	GET  /traffic?profile=&day=|month=           traffic by user or client ip and filter, of today by default
+//	GET  /dialer?filter=gae                      MultiDialer caches of a gae filter
+//	POST /dialer/flush?filter=gae&cache=         flush one or all MultiDialer caches
+//	GET  /gae/servers?filter=gae                 good and bad fetch servers
+//	POST /gae/toggle?filter=gae&host=            mark a good fetch server as bad
+//	POST /autoproxy/flush?filter=autoproxy&cache= flush RegionFilterCache and/or ProxyPacCache
+//	GET  MetricsPath                             metrics in prometheus text format
+type Admin struct {
+	*http.Server
+	Config   AdminConfig
+	Profiles *Profiles
+	Listener net.Listener
+	mux      *http.ServeMux
+}
+
+func NewAdmin(config AdminConfig, profiles *Profiles) (*Admin, error) {
+	if config.Username == "" || config.Password == "" {
+		return nil, fmt.Errorf("admin: Username and Password are required")
+	}
+
+	ln, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Admin{
+		Config:   config,
+		Profiles: profiles,
+		Listener: ln,
+		mux:      http.NewServeMux(),
+	}
+
+	a.HandleFunc("/profiles", http.MethodGet, a.profiles)
+	a.HandleFunc("/conns", http.MethodGet, a.conns)
+	a.HandleFunc("/conns/close", http.MethodPost, a.closeConn)
+	a.HandleFunc("/trace", http.MethodGet, a.trace)
+	a.HandleFunc("/traffic", http.MethodGet, a.traffic)
+	a.HandleFunc("/dialer", http.MethodGet, a.dialer)
+	a.HandleFunc("/dialer/flush", http.MethodPost, a.flushDialer)
+	a.HandleFunc("/gae/servers", http.MethodGet, a.gaeServers)
+	a.HandleFunc("/gae/toggle", http.MethodPost, a.toggleGAEServer)
+	a.HandleFunc("/autoproxy/flush", http.MethodPost, a.flushAutoproxy)
+
+	if config.MetricsPath != "" {
+		a.Handle(config.MetricsPath, metrics.Handler())
+	}
+
+	a.Server = &http.Server{
+		Handler:        a,
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	return a, nil
+}
+
+func (a *Admin) Serve() error {
+	return a.Server.Serve(a.Listener)
+}
+
+// Handle registers handler for pattern on the admin listener.
+func (a *Admin) Handle(pattern string, handler http.Handler) {
+	a.mux.Handle(pattern, handler)
+}
+
+// HandleFunc registers handler for pattern which only accepts method.
+func (a *Admin) HandleFunc(pattern, method string, handler func(http.ResponseWriter, *http.Request) (interface{}, error)) {
+	a.mux.HandleFunc(pattern, func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != method {
+			rw.Header().Set("Allow", method)
+			writeAdminJSON(rw, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		v, err := handler(rw, req)
+		if err != nil {
+			status := http.StatusBadRequest
+			if e, ok := err.(adminError); ok {
+				status = e.status
+			}
+			glog.Warningf("%s \"ADMIN %s %s %s\" error: %v", req.RemoteAddr, req.Method, req.RequestURI, req.Proto, err)
+			writeAdminJSON(rw, status, map[string]string{"error": err.Error()})
+			return
+		}
+
+		glog.V(2).Infof("%s \"ADMIN %s %s %s\" %d -", req.RemoteAddr, req.Method, req.RequestURI, req.Proto, http.StatusOK)
+		writeAdminJSON(rw, http.StatusOK, v)
+	})
+}
+
+func (a *Admin) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	username, password, ok := req.BasicAuth()
+	if !ok ||
+		subtle.ConstantTimeCompare([]byte(username), []byte(a.Config.Username)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(a.Config.Password)) != 1 {
+		glog.Warningf("%s \"ADMIN %s %s %s\" unauthorized", req.RemoteAddr, req.Method, req.RequestURI, req.Proto)
+		rw.Header().Set("WWW-Authenticate", `Basic realm="goproxy admin"`)
+		writeAdminJSON(rw, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	a.mux.ServeHTTP(rw, req)
+}
+
+type adminError struct {
+	status int
+	err    error
+}
+
+func (e adminError) Error() string {
+	return e.err.Error()
+}
+
+func notFound(format string, a ...interface{}) error {
+	return adminError{http.StatusNotFound, fmt.Errorf(format, a...)}
+}
+
+func writeAdminJSON(rw http.ResponseWriter, status int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		status = http.StatusInternalServerError
+		data, _ = json.Marshal(map[string]string{"error": err.Error()})
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	rw.Write(data)
+	rw.Write([]byte("\n"))
+}
+
+// lookupFilter returns the created filter named by the "filter" query
+// parameter, or by defaultName if it is absent.
+func lookupFilter(req *http.Request, defaultName string) (string, filters.Filter, error) {
+	name := req.URL.Query().Get("filter")
+	if name == "" {
+		name = defaultName
+	}
+
+	f, ok := filters.LookupFilter(name)
+	if !ok {
+		return name, nil, notFound("filter %#v is not running", name)
+	}
+
+	return name, f, nil
+}
+
+func (a *Admin) profiles(rw http.ResponseWriter, req *http.Request) (interface{}, error) {
+	return a.Profiles.Configs(), nil
+}
+
+// servers returns the running servers, or the one of the profile parameter.
+func (a *Admin) servers(req *http.Request) (map[string]*Server, error) {
+	servers := a.Profiles.Servers()
+
+	if profile := req.URL.Query().Get("profile"); profile != "" {
+		s, ok := servers[profile]
+		if !ok {
+			return nil, notFound("profile %#v is not running", profile)
+		}
+		servers = map[string]*Server{profile: s}
+	}
+
+	return servers, nil
+}
+
+func (a *Admin) conns(rw http.ResponseWriter, req *http.Request) (interface{}, error) {
+	servers, err := a.servers(req)
+	if err != nil {
+		return nil, err
+	}
+
+	conns := make([]ConnInfo, 0)
+	for _, s := range servers {
+		conns = append(conns, s.Handler.Conns.List()...)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+
+	return conns, nil
+}
+
+func (a *Admin) closeConn(rw http.ResponseWriter, req *http.Request) (interface{}, error) {
+	id, err := strconv.ParseUint(req.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id %#v", req.URL.Query().Get("id"))
+	}
+
+	for profile, s := range a.Profiles.Servers() {
+		if info, ok := s.Handler.Conns.Close(id); ok {
+			glog.Infof("ADMIN close conn %d of profile %#v: %s %s %s", id, profile, info.Client, info.Method, info.Target)
+			return info, nil
+		}
+	}
+
+	return nil, notFound("conn %d is not found", id)
+}
+
+func (a *Admin) trace(rw http.ResponseWriter, req *http.Request) (interface{}, error) {
+	id := req.URL.Query().Get("id")
+	if id == "" {
+		return nil, fmt.Errorf("id is required")
+	}
+
+	for _, s := range a.Profiles.Servers() {
+		if t, ok := s.Handler.Trace(id); ok {
+			return t, nil
+		}
+	}
+
+	return nil, notFound("request %#v is not found", id)
+}
+
+func (a *Admin) traffic(rw http.ResponseWriter, req *http.Request) (interface{}, error) {
+	servers, err := a.servers(req)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := time.Now().Format(trafficDayFormat)
+	if day := req.URL.Query().Get("day"); day != "" {
+		if _, err := time.Parse(trafficDayFormat, day); err != nil {
+			return nil, fmt.Errorf("invalid day %#v", day)
+		}
+		prefix = day
+	} else if month := req.URL.Query().Get("month"); month != "" {
+		if _, err := time.Parse(trafficMonthFormat, month); err != nil {
+			return nil, fmt.Errorf("invalid month %#v", month)
+		}
+		prefix = month
+	}
+
+	meters := trafficMetersOf(servers)
+	if len(meters) == 0 {
+		return nil, notFound("traffic is not enabled")
+	}
+
+	counts := make(map[string]map[string]TrafficCount)
+	for _, m := range meters {
+		m.sumCounts(counts, prefix)
+	}
+
+	return counts, nil
+}
+
+func (a *Admin) multiDialer(req *http.Request) (*helpers.MultiDialer, error) {
+	name, f, err := lookupFilter(req, "gae")
+	if err != nil {
+		return nil, err
+	}
+
+	f1, ok := f.(*gae.Filter)
+	if !ok {
+		return nil, fmt.Errorf("filter %#v is a %T, not a gae filter", name, f)
+	}
+
+	if f1.GAETransport.MultiDialer == nil {
+		return nil, notFound("filter %#v does not use a MultiDialer", name)
+	}
+
+	return f1.GAETransport.MultiDialer, nil
+}
+
+func multiDialerCaches(md *helpers.MultiDialer) map[string]lrucache.Cache {
+	return map[string]lrucache.Cache{
+		"IPBlackList":     md.IPBlackList,
+		"TLSConnDuration": md.TLSConnDuration,
+		"TLSConnError":    md.TLSConnError,
+	}
+}
+
+func (a *Admin) dialer(rw http.ResponseWriter, req *http.Request) (interface{}, error) {
+	md, err := a.multiDialer(req)
+	if err != nil {
+		return nil, err
+	}
+
+	type cacheDump struct {
+		Len     int
+		Entries map[string]string `json:",omitempty"`
+	}
+
+	dump := make(map[string]cacheDump)
+	for name, c := range multiDialerCaches(md) {
+		d := cacheDump{Len: c.Len()}
+		if kc, ok := c.(*helpers.KeyedCache); ok {
+			d.Entries = make(map[string]string)
+			for _, e := range kc.Entries() {
+				switch v := e.Value.(type) {
+				case struct{}:
+					d.Entries[e.Key] = ""
+				default:
+					d.Entries[e.Key] = fmt.Sprint(v)
+				}
+			}
+		}
+		dump[name] = d
+	}
+
+	return dump, nil
+}
+
+func (a *Admin) flushDialer(rw http.ResponseWriter, req *http.Request) (interface{}, error) {
+	md, err := a.multiDialer(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return flushCaches(multiDialerCaches(md), req.URL.Query().Get("cache"))
+}
+
+// flushCaches clears the cache named name, or all of caches if name is empty,
+// and returns the numbers of entries cleared.
+func flushCaches(caches map[string]lrucache.Cache, name string) (map[string]int, error) {
+	if name != "" {
+		c, ok := caches[name]
+		if !ok {
+			return nil, notFound("unknown cache %#v", name)
+		}
+		caches = map[string]lrucache.Cache{name: c}
+	}
+
+	cleared := make(map[string]int)
+	for name, c := range caches {
+		if c != nil {
+			cleared[name] = c.Clear()
+		}
+	}
+
+	return cleared, nil
+}
+
+func (a *Admin) gaeServers(rw http.ResponseWriter, req *http.Request) (interface{}, error) {
+	name, f, err := lookupFilter(req, "gae")
+	if err != nil {
+		return nil, err
+	}
+
+	f1, ok := f.(*gae.Filter)
+	if !ok {
+		return nil, fmt.Errorf("filter %#v is a %T, not a gae filter", name, f)
+	}
+
+	good, bad := f1.GAETransport.Servers.URLs()
+
+	hosts := func(urls []url.URL) []string {
+		ss := make([]string, 0, len(urls))
+		for _, u := range urls {
+			ss = append(ss, u.Host)
+		}
+		return ss
+	}
+
+	return map[string][]string{
+		"Good": hosts(good),
+		"Bad":  hosts(bad),
+	}, nil
+}
+
+func (a *Admin) toggleGAEServer(rw http.ResponseWriter, req *http.Request) (interface{}, error) {
+	name, f, err := lookupFilter(req, "gae")
+	if err != nil {
+		return nil, err
+	}
+
+	f1, ok := f.(*gae.Filter)
+	if !ok {
+		return nil, fmt.Errorf("filter %#v is a %T, not a gae filter", name, f)
+	}
+
+	host := req.URL.Query().Get("host")
+	servers := f1.GAETransport.Servers
+
+	u, ok := servers.LookupServer(host)
+	if !ok {
+		return nil, notFound("filter %#v has no fetch server %#v", name, host)
+	}
+
+	if _, bad := servers.URLs(); containsHost(bad, host) {
+		return nil, adminError{http.StatusConflict, fmt.Errorf("fetch server %#v is already bad", host)}
+	}
+
+	glog.Infof("ADMIN ToggleBadServer(%#v) for filter %#v", host, name)
+	servers.ToggleBadServer(u)
+
+	return a.gaeServers(rw, req)
+}
+
+func containsHost(urls []url.URL, host string) bool {
+	for _, u := range urls {
+		if u.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Admin) flushAutoproxy(rw http.ResponseWriter, req *http.Request) (interface{}, error) {
+	name, f, err := lookupFilter(req, "autoproxy")
+	if err != nil {
+		return nil, err
+	}
+
+	f1, ok := f.(*autoproxy.Filter)
+	if !ok {
+		return nil, fmt.Errorf("filter %#v is a %T, not an autoproxy filter", name, f)
+	}
+
+	return flushCaches(map[string]lrucache.Cache{
+		"RegionFilterCache": f1.RegionFilterCache,
+		"ProxyPacCache":     f1.ProxyPacCache,
+	}, req.URL.Query().Get("cache"))
+}
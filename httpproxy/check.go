@@ -0,0 +1,179 @@
+package httpproxy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/xuiv/goproxy/httpproxy/filters"
+	"github.com/xuiv/goproxy/httpproxy/helpers"
+	"github.com/xuiv/goproxy/httpproxy/storage"
+)
+
+// Validate checks the listener, forwarding, access log and traffic settings
+// of the profile config, the errors are *storage.ConfigError naming the keys
+// of the problems. The filters are checked by CheckConfig.
+func (c Config) Validate() []error {
+	errs := make([]error, 0)
+	add := func(key string, format string, a ...interface{}) {
+		errs = append(errs, &storage.ConfigError{Key: key, Err: fmt.Errorf(format, a...)})
+	}
+
+	if c.Address == "" {
+		add("Address", "address is empty")
+	}
+
+	if c.ProxyProtocol && len(c.TrustedProxies) == 0 {
+		add("TrustedProxies", "ProxyProtocol is enabled without TrustedProxies")
+	}
+	if _, err := helpers.ParseIPNets(c.TrustedProxies); err != nil {
+		add("TrustedProxies", "%v", err)
+	}
+
+	if c.Transparent != "" {
+		switch {
+		case c.Transparent != helpers.TransparentRedirect && c.Transparent != helpers.TransparentTProxy:
+			add("Transparent", "unknown Transparent mode %#v", c.Transparent)
+		case c.Socks || c.ProxyProtocol || c.TLS.Enabled:
+			add("Transparent", "Transparent could not be enabled along with Socks, ProxyProtocol or TLS")
+		}
+	}
+
+	if c.ShutdownTimeout < 0 {
+		add("ShutdownTimeout", "invalid ShutdownTimeout %d", c.ShutdownTimeout)
+	}
+
+	if c.TLS.Enabled && c.Socks {
+		add("Socks", "Socks could not be enabled along with TLS")
+	}
+
+	if err := c.ForwardPolicy.Validate(); err != nil {
+		add("ForwardPolicy", "%v", err)
+	}
+
+	if strings.ContainsAny(c.RequestIDHeader, " \t\r\n:") {
+		add("RequestIDHeader", "invalid RequestIDHeader %#v", c.RequestIDHeader)
+	}
+
+	if c.AccessLog.Enabled {
+		if err := c.AccessLog.validate(); err != nil {
+			add("AccessLog", "%v", err)
+		}
+	}
+
+	if c.Traffic.Enabled {
+		errs = append(errs, c.Traffic.validate()...)
+	}
+
+	return errs
+}
+
+// CheckConfig reads the profiles of filename and the configs of the filters
+// used by the enabled ones without creating any of them, and returns all the
+// problems found, e.g. the unknown keys, a filter listed as a kind it is not
+// and the errors of the filter configs.
+func CheckConfig(store storage.Store, filename string) []error {
+	config := make(map[string]Config)
+	if err := store.UnmarshallJson(filename, &config); err != nil {
+		return []error{&storage.ConfigError{Filename: filename, Err: err}}
+	}
+
+	errs := make([]error, 0)
+
+	keys, err := storage.UnknownJsonKeys(store, filename, config)
+	if err != nil {
+		errs = append(errs, &storage.ConfigError{Filename: filename, Err: err})
+	}
+	for _, key := range keys {
+		errs = append(errs, &storage.ConfigError{Filename: filename, Key: key, Err: errors.New("unknown key")})
+	}
+
+	profiles := make([]string, 0, len(config))
+	for profile := range config {
+		profiles = append(profiles, profile)
+	}
+	sort.Strings(profiles)
+
+	names := make([]string, 0)
+	meters := make(map[string]string)
+	for _, profile := range profiles {
+		c := config[profile]
+		if !c.Enabled {
+			continue
+		}
+
+		// the profiles counting to the same file share one meter, which
+		// takes the settings of only one of them
+		if c.Traffic.Enabled {
+			t := c.Traffic.withDefaults()
+			if other, ok := meters[t.Filename]; !ok {
+				meters[t.Filename] = profile
+			} else if t1 := config[other].Traffic.withDefaults(); t1.FlushInterval != t.FlushInterval || t1.KeepDays != t.KeepDays {
+				errs = append(errs, &storage.ConfigError{Filename: filename, Key: profile + ".Traffic", Err: fmt.Errorf("FlushInterval or KeepDays differs from the ones of %#v counting to %#v", other, t.Filename)})
+			}
+		}
+
+		for _, err := range c.Validate() {
+			if ce, ok := err.(*storage.ConfigError); ok {
+				ce.Filename = filename
+				ce.Key = profile + "." + ce.Key
+			}
+			errs = append(errs, err)
+		}
+
+		if c.TLS.Enabled {
+			switch {
+			case c.TLS.CertFile != "":
+				if _, err := NewTLSConfig(c.TLS, c.Address); err != nil {
+					errs = append(errs, &storage.ConfigError{Filename: filename, Key: profile + ".TLS", Err: err})
+				}
+			case c.TLS.RootCA != "":
+				names = append(names, c.TLS.RootCA)
+			}
+		}
+
+		for _, kind := range []struct {
+			key   string
+			names []string
+			is    func(filters.Filter) bool
+			name  string
+		}{
+			{"RequestFilters", c.RequestFilters, func(f filters.Filter) bool { _, ok := f.(filters.RequestFilter); return ok }, "RequestFilter"},
+			{"RoundTripFilters", c.RoundTripFilters, func(f filters.Filter) bool { _, ok := f.(filters.RoundTripFilter); return ok }, "RoundTripFilter"},
+			{"ResponseFilters", c.ResponseFilters, func(f filters.Filter) bool { _, ok := f.(filters.ResponseFilter); return ok }, "ResponseFilter"},
+		} {
+			for i, name := range kind.names {
+				key := fmt.Sprintf("%s.%s[%d]", profile, kind.key, i)
+				schema, ok := filters.LookupSchema(name)
+				switch {
+				case !ok:
+					errs = append(errs, &storage.ConfigError{Filename: filename, Key: key, Err: fmt.Errorf("unknown filter %#v", name)})
+				case !kind.is(schema.Prototype):
+					errs = append(errs, &storage.ConfigError{Filename: filename, Key: key, Err: fmt.Errorf("%#v is not a %s", name, kind.name)})
+				default:
+					names = append(names, name)
+				}
+			}
+		}
+	}
+
+	// the filters are checked once each, the ones referred to by the
+	// others, e.g. by the rules of autoproxy, included.
+	checked := make(map[string]struct{})
+	for len(names) > 0 {
+		name := names[0]
+		names = names[1:]
+
+		if _, ok := checked[name]; ok {
+			continue
+		}
+		checked[name] = struct{}{}
+
+		refs, errs1 := filters.CheckConfig(name)
+		errs = append(errs, errs1...)
+		names = append(names, refs...)
+	}
+
+	return errs
+}
@@ -0,0 +1,90 @@
+package httpproxy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/xuiv/goproxy/httpproxy/storage"
+)
+
+func TestCheckConfig(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		profiles string
+		gae      string
+		errs     []string
+	}{
+		{
+			"valid",
+			`{"Default": {"Enabled": true, "Address": "127.0.0.1:8087", "RoundTripFilters": ["gae"]}}`,
+			`{}`,
+			[]string{},
+		},
+		{
+			"unknown keys",
+			`{"Default": {"Enabled": true, "Address": "127.0.0.1:8087", "Adress": "", "RoundTripFilters": ["gae"]}}`,
+			`{"AppIDList": []}`,
+			[]string{
+				`httpproxy.json: Default.Adress: unknown key`,
+				`gae.json: AppIDList: unknown key`,
+			},
+		},
+		{
+			"wrong filter kind",
+			`{"Default": {"Enabled": true, "Address": "127.0.0.1:8087", "RequestFilters": ["gae"], "RoundTripFilters": ["nope"]}}`,
+			`{}`,
+			[]string{
+				`httpproxy.json: Default.RequestFilters[0]: "gae" is not a RequestFilter`,
+				`httpproxy.json: Default.RoundTripFilters[0]: unknown filter "nope"`,
+			},
+		},
+		{
+			"bad cipher",
+			`{"Default": {"Enabled": true, "Address": "127.0.0.1:8087", "RoundTripFilters": ["gae"]}}`,
+			`{"TLSConfig": {"Ciphers": ["TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_BOGUS"]}}`,
+			[]string{
+				`gae.json: TLSConfig.Ciphers[1]: cipher "TLS_BOGUS" is not supported`,
+			},
+		},
+		{
+			"HTTP2 flag conflict",
+			`{"Default": {"Enabled": true, "Address": "127.0.0.1:8087", "RoundTripFilters": ["gae"]}}`,
+			`{"DisableHTTP2": true, "ForceHTTP2": true}`,
+			[]string{
+				`gae.json: ForceHTTP2: DisableHTTP2 and ForceHTTP2 is conflict`,
+			},
+		},
+		{
+			"disabled profile",
+			`{"Default": {"Enabled": false, "RequestFilters": ["gae"]}}`,
+			`{"DisableHTTP2": true, "ForceHTTP2": true}`,
+			[]string{},
+		},
+		{
+			"shared traffic file",
+			`{"Default": {"Enabled": true, "Address": "127.0.0.1:8087", "Traffic": {"Enabled": true}},
+			  "PHP": {"Enabled": true, "Address": "127.0.0.1:8088", "Traffic": {"Enabled": true, "FlushInterval": 5}}}`,
+			`{}`,
+			[]string{
+				`httpproxy.json: PHP.Traffic: FlushInterval or KeepDays differs from the ones of "Default" counting to "traffic.json"`,
+			},
+		},
+	} {
+		dir := tempWorkDir(t)
+		for filename, data := range map[string]string{"httpproxy.json": c.profiles, "gae.json": c.gae} {
+			if err := ioutil.WriteFile(filepath.Join(dir, filename), []byte(data), 0644); err != nil {
+				t.Fatalf("ioutil.WriteFile error: %v", err)
+			}
+		}
+
+		errs := make([]string, 0)
+		for _, err := range CheckConfig(&storage.FileStore{Dirname: dir}, "httpproxy.json") {
+			errs = append(errs, err.Error())
+		}
+		if !reflect.DeepEqual(errs, c.errs) {
+			t.Errorf("%s: CheckConfig = %#v, want %#v", c.name, errs, c.errs)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xuiv/goproxy/httpproxy/filters"
+	"github.com/xuiv/goproxy/httpproxy/helpers"
+)
+
+var (
+	// connID numbers the entries of all ConnTables, so that an ID names one
+	// entry across the profiles.
+	connID uint64
+
+	// requestIDPrefix tells apart the request IDs of the runs of a process.
+	requestIDPrefix = func() string {
+		b := make([]byte, 4)
+		rand.Read(b)
+		return hex.EncodeToString(b)
+	}()
+)
+
+// ConnInfo is a snapshot of an entry of the ConnTable.
+type ConnInfo struct {
+	ID        uint64
+	RequestID string
+	Profile   string
+	Client    string
+	User      string `json:",omitempty"`
+	Method    string
+	Target    string
+	Filter    string
+	Tunnel    bool
+	Start     time.Time
+	Duration  float64 // seconds
+	BytesIn   int64
+	BytesOut  int64
+}
+
+// connEntry is a request in flight or a hijacked tunnel of a Handler.
+type connEntry struct {
+	ConnInfo
+
+	mu     sync.Mutex
+	filter string
+	w      *connWriter
+	body   *countingReadCloser
+	conn   net.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// the bytes counted by the TrafficMeter so far, guarded by mu
+	countedIn, countedOut int64
+}
+
+func (e *connEntry) setFilter(name string) {
+	e.mu.Lock()
+	e.filter = name
+	e.mu.Unlock()
+}
+
+func (e *connEntry) info() ConnInfo {
+	info := e.ConnInfo
+
+	e.mu.Lock()
+	info.Filter = e.filter
+	e.mu.Unlock()
+
+	info.User = filters.User(e.ctx)
+	info.Duration = time.Since(info.Start).Seconds()
+	info.BytesIn, info.BytesOut = e.w.bytes()
+	if e.body != nil {
+		info.BytesIn += atomic.LoadInt64(&e.body.n)
+	}
+	info.Tunnel = e.w.tunnel() != nil
+
+	return info
+}
+
+// close cancels the request and closes the client connection, the tunnel
+// is closed along with its client side by the relay.
+func (e *connEntry) close() {
+	e.cancel()
+	if c := e.w.tunnel(); c != nil {
+		c.Close()
+	} else if e.conn != nil {
+		e.conn.Close()
+	}
+}
+
+// ConnTable keeps the requests in flight and the hijacked tunnels of a
+// Handler, so that they could be listed and closed by ID.
+type ConnTable struct {
+	mu    sync.Mutex
+	conns map[uint64]*connEntry
+}
+
+func NewConnTable() *ConnTable {
+	return &ConnTable{
+		conns: make(map[uint64]*connEntry),
+	}
+}
+
+func (t *ConnTable) add(e *connEntry) {
+	e.ID = atomic.AddUint64(&connID, 1)
+	e.RequestID = requestIDPrefix + "-" + strconv.FormatUint(e.ID, 10)
+
+	t.mu.Lock()
+	t.conns[e.ID] = e
+	t.mu.Unlock()
+}
+
+func (t *ConnTable) remove(e *connEntry) {
+	t.mu.Lock()
+	delete(t.conns, e.ID)
+	t.mu.Unlock()
+}
+
+// List returns the entries of t ordered by ID.
+func (t *ConnTable) List() []ConnInfo {
+	t.mu.Lock()
+	entries := make([]*connEntry, 0, len(t.conns))
+	for _, e := range t.conns {
+		entries = append(entries, e)
+	}
+	t.mu.Unlock()
+
+	infos := make([]ConnInfo, 0, len(entries))
+	for _, e := range entries {
+		infos = append(infos, e.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+
+	return infos
+}
+
+// Close closes the entry id and returns a snapshot of it taken before, or
+// false if there is no such entry.
+func (t *ConnTable) Close(id uint64) (ConnInfo, bool) {
+	t.mu.Lock()
+	e, ok := t.conns[id]
+	t.mu.Unlock()
+
+	if !ok {
+		return ConnInfo{}, false
+	}
+
+	info := e.info()
+	e.close()
+	return info, true
+}
+
+// Trace returns the timeline of the request in flight requestID.
+func (t *ConnTable) Trace(requestID string) (*RequestTrace, bool) {
+	t.mu.Lock()
+	var entry *connEntry
+	for _, e := range t.conns {
+		if e.RequestID == requestID {
+			entry = e
+			break
+		}
+	}
+	t.mu.Unlock()
+
+	if entry == nil {
+		return nil, false
+	}
+
+	return &RequestTrace{
+		ConnInfo: entry.info(),
+		Events:   filters.GetTrace(entry.ctx),
+	}, true
+}
+
+// connWriter records the status and the bytes written to the client, the
+// connection it hijacks counts the bytes of the tunnel in both ways.
+type connWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+
+	mu       sync.Mutex
+	hijacked *helpers.CountingConn
+}
+
+func (w *connWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *connWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	atomic.AddInt64(&w.written, int64(n))
+	return n, err
+}
+
+func (w *connWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *connWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments http.Hijacker", w.ResponseWriter)
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := helpers.NewCountingConn(conn)
+
+	w.mu.Lock()
+	w.hijacked = c
+	w.mu.Unlock()
+
+	return c, brw, nil
+}
+
+// tunnel returns the hijacked connection, or nil.
+func (w *connWriter) tunnel() *helpers.CountingConn {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.hijacked
+}
+
+// bytes returns the bytes read from and written to the client.
+func (w *connWriter) bytes() (in, out int64) {
+	written := atomic.LoadInt64(&w.written)
+	if c := w.tunnel(); c != nil {
+		return c.ReadBytes(), written + c.WrittenBytes()
+	}
+	return 0, written
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(&r.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,141 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xuiv/goproxy/httpproxy/filters"
+)
+
+// testConnsFilter echoes the CONNECT tunnels and holds the other requests
+// until hold is closed.
+type testConnsFilter struct {
+	hold chan struct{}
+}
+
+func (f *testConnsFilter) FilterName() string {
+	return "test-conns"
+}
+
+func (f *testConnsFilter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	if req.Method == http.MethodConnect {
+		return (&testTunnelFilter{}).RoundTrip(ctx, req)
+	}
+	return (&testRoundTripFilter{body: []byte("done"), hold: f.hold}).RoundTrip(ctx, req)
+}
+
+// waitConns polls /conns until it lists n entries.
+func (a *testAdmin) waitConns(t *testing.T, n int) []ConnInfo {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var conns []ConnInfo
+		a.get(t, "/conns", &conns)
+		if len(conns) == n {
+			return conns
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("/conns lists %d entries, want %d: %+v", len(conns), n, conns)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConns(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %v", err)
+	}
+	hold := make(chan struct{})
+	h := NewHandler(ln, &FilterChain{RoundTripFilters: []filters.RoundTripFilter{&testConnsFilter{hold: hold}}}, "goproxy")
+	a := newTestAdmin(t, h)
+	s := NewHandlerServer(Config{}, h)
+	go s.Serve()
+	defer s.Shutdown(context.Background())
+
+	dial := func(request string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("net.Dial error: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, request)
+		return conn, bufio.NewReader(conn)
+	}
+
+	get, getr := dial("GET http://example.com/a HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	defer get.Close()
+	a.waitConns(t, 1)
+
+	tunnel, tunnelr := dial("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	defer tunnel.Close()
+	if resp, err := http.ReadResponse(tunnelr, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT = %v, %v, want 200", resp, err)
+	}
+	io.WriteString(tunnel, "hello\n")
+	if line, err := tunnelr.ReadString('\n'); err != nil || line != "hello\n" {
+		t.Fatalf("the tunnel echoes %#v, %v", line, err)
+	}
+
+	conns := a.waitConns(t, 2)
+	for i, c := range []struct {
+		conn   net.Conn
+		method string
+		target string
+		tunnel bool
+	}{
+		{get, http.MethodGet, "http://example.com/a", false},
+		{tunnel, http.MethodConnect, "example.com:443", true},
+	} {
+		info := conns[i]
+		if info.Method != c.method || info.Target != c.target || info.Tunnel != c.tunnel {
+			t.Errorf("/conns[%d] = %s %s tunnel=%v, want %s %s tunnel=%v", i, info.Method, info.Target, info.Tunnel, c.method, c.target, c.tunnel)
+		}
+		if info.Profile != "default" || info.Filter != "test-conns" || info.Client != c.conn.LocalAddr().String() {
+			t.Errorf("/conns[%d] = %+v, want the profile \"default\", the filter \"test-conns\" and the client %s", i, info, c.conn.LocalAddr())
+		}
+		if info.ID == 0 || !strings.HasSuffix(info.RequestID, fmt.Sprintf("-%d", info.ID)) || info.Start.IsZero() {
+			t.Errorf("/conns[%d] = %+v, want an ID, a RequestID of it and a Start", i, info)
+		}
+	}
+	if info := conns[1]; info.BytesIn != 6 || info.BytesOut != 6 {
+		t.Errorf("the tunnel has %d bytes in and %d out, want 6 and 6", info.BytesIn, info.BytesOut)
+	}
+	if conns[0].ID >= conns[1].ID {
+		t.Errorf("/conns is not ordered by ID: %d, %d", conns[0].ID, conns[1].ID)
+	}
+
+	// the User of the unauthenticated requests is left out
+	if body := a.do(http.MethodGet, "/conns").Body.String(); strings.Contains(body, `"User"`) {
+		t.Errorf("/conns = %s, want no User", body)
+	}
+	if rw := a.do(http.MethodGet, "/conns?profile=nope"); rw.Code != http.StatusNotFound {
+		t.Errorf("/conns of an unknown profile = %d, want 404", rw.Code)
+	}
+
+	// a tunnel is closed by ID, the request is listed until it is done
+	if rw := a.do(http.MethodPost, fmt.Sprintf("/conns/close?id=%d", conns[1].ID)); rw.Code != http.StatusOK {
+		t.Fatalf("/conns/close = %d: %s", rw.Code, rw.Body.String())
+	}
+	if _, err := tunnelr.ReadString('\n'); err == nil {
+		t.Errorf("the closed tunnel is still open")
+	}
+	if left := a.waitConns(t, 1); left[0].ID != conns[0].ID {
+		t.Errorf("/conns after the close = %+v, want the GET", left)
+	}
+	if rw := a.do(http.MethodPost, fmt.Sprintf("/conns/close?id=%d", conns[1].ID)); rw.Code != http.StatusNotFound {
+		t.Errorf("/conns/close of a closed tunnel = %d, want 404", rw.Code)
+	}
+
+	close(hold)
+	if resp, err := http.ReadResponse(getr, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET = %v, %v, want 200", resp, err)
+	}
+	a.waitConns(t, 0)
+}
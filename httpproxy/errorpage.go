@@ -0,0 +1,247 @@
+package httpproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+
+	"github.com/phuslu/glog"
+
+	"github.com/xuiv/goproxy/httpproxy/filters"
+	"github.com/xuiv/goproxy/httpproxy/helpers"
+	"github.com/xuiv/goproxy/httpproxy/storage"
+)
+
+const (
+	ErrorHTMLFilename = "error.html"
+	ErrorJSONFilename = "error.json"
+)
+
+const (
+	defaultErrorHTML = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Status}} {{.StatusText}}</title></head>
+<body><h1>{{.Status}} {{.StatusText}}</h1><p>{{.Error}}</p>
+<p>filter={{.Filter}} class={{.Class}} request_id={{.RequestID}}</p>
+{{if .RetryURL}}<p><a href="{{.RetryURL}}">Retry</a></p>{{end}}</body></html>
+`
+	defaultErrorJSON = `{
+    "type": "localproxy",
+    "host": {{json .Host}},
+    "software": {{json .Software}},
+    "filter": {{json .Filter}},
+    "class": {{json .Class}},
+    "request_id": {{json .RequestID}},
+    "error": {{json .Error}}
+}
+`
+)
+
+// The classes of the errors shown by the error pages.
+const (
+	ErrorClassDNS      = "dns"
+	ErrorClassDial     = "dial"
+	ErrorClassTLS      = "tls"
+	ErrorClassTimeout  = "timeout"
+	ErrorClassQuota    = "quota"
+	ErrorClassBlocked  = "blocked"
+	ErrorClassUpstream = "upstream"
+)
+
+// ErrorInfo is the data of the error page templates.
+type ErrorInfo struct {
+	Status     int
+	StatusText string
+	Class      string
+	Filter     string
+	Error      string
+	RequestID  string
+	RetryURL   string
+	Host       string
+	Software   string
+}
+
+// ErrorPages renders the errors of a Handler from the templates error.html
+// and error.json of the store, HTML is written to the browsers and JSON to
+// the others by the Accept header. The built-in templates are used for the
+// files which are absent.
+type ErrorPages struct {
+	html *htmltemplate.Template
+	json *texttemplate.Template
+}
+
+var (
+	builtinErrorPages     *ErrorPages
+	builtinErrorPagesOnce sync.Once
+)
+
+// defaultErrorPages returns the ErrorPages of the built-in templates, for the
+// filter chains built without ones.
+func defaultErrorPages() *ErrorPages {
+	builtinErrorPagesOnce.Do(func() {
+		var err error
+		if builtinErrorPages, err = NewErrorPages(nil); err != nil {
+			panic(err)
+		}
+	})
+	return builtinErrorPages
+}
+
+// NewErrorPages loads the templates of the error pages from store, a nil store
+// uses the built-in ones.
+func NewErrorPages(store storage.Store) (*ErrorPages, error) {
+	html, err := readErrorTemplate(store, ErrorHTMLFilename, defaultErrorHTML)
+	if err != nil {
+		return nil, err
+	}
+
+	json, err := readErrorTemplate(store, ErrorJSONFilename, defaultErrorJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ErrorPages{}
+	if p.html, err = htmltemplate.New(ErrorHTMLFilename).Parse(html); err != nil {
+		return nil, err
+	}
+	if p.json, err = texttemplate.New(ErrorJSONFilename).Funcs(texttemplate.FuncMap{"json": jsonString}).Parse(json); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func readErrorTemplate(store storage.Store, filename, fallback string) (string, error) {
+	if store == nil {
+		return fallback, nil
+	}
+
+	resp, err := store.Get(filename)
+	if storage.IsNotExist(resp, err) {
+		glog.V(2).Infof("ErrorPages: %#v is not found, use the built-in one", filename)
+		return fallback, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func jsonString(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// Write writes the error page of info to rw and returns its status code.
+func (p *ErrorPages) Write(rw http.ResponseWriter, req *http.Request, info *ErrorInfo) int {
+	if info.StatusText == "" {
+		info.StatusText = http.StatusText(info.Status)
+	}
+
+	contentType := helpers.NegotiateContentType(req.Header.Get("Accept"), "application/json", "text/html")
+	contentType, b := p.render(contentType, info)
+
+	rw.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(info.Status)
+	rw.Write(b)
+
+	return info.Status
+}
+
+// render executes the template of contentType with info, the error of info
+// is returned as text/plain if it fails.
+func (p *ErrorPages) render(contentType string, info *ErrorInfo) (string, []byte) {
+	var b bytes.Buffer
+	var err error
+	switch contentType {
+	case "text/html":
+		err = p.html.Execute(&b, info)
+	default:
+		err = p.json.Execute(&b, info)
+	}
+	if err != nil {
+		glog.Warningf("ErrorPages: execute %s template error: %v", contentType, err)
+		return "text/plain", []byte(info.Error + "\n")
+	}
+	return contentType, b.Bytes()
+}
+
+// classifyError returns the class of err and the status code of it, 504 for
+// the timeouts, 403 for the blocked requests, 503 for the used up quota of an
+// upstream and the Status of the traffic quota of a user.
+func classifyError(err error) (string, int) {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var timeoutErr interface{ Timeout() bool }
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certErr x509.CertificateInvalidError
+	var verifyErr *tls.CertificateVerificationError
+	var quotaErr *QuotaError
+
+	switch {
+	case errors.As(err, &quotaErr):
+		return ErrorClassQuota, quotaErr.Status
+	case errors.Is(err, filters.ErrBlocked):
+		return ErrorClassBlocked, http.StatusForbidden
+	case errors.Is(err, filters.ErrOverQuota):
+		return ErrorClassQuota, http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &timeoutErr) && timeoutErr.Timeout():
+		return ErrorClassTimeout, http.StatusGatewayTimeout
+	case errors.As(err, &dnsErr):
+		return ErrorClassDNS, http.StatusBadGateway
+	case errors.As(err, &recordErr),
+		errors.As(err, &authorityErr),
+		errors.As(err, &hostnameErr),
+		errors.As(err, &certErr),
+		errors.As(err, &verifyErr),
+		strings.Contains(err.Error(), "tls: "):
+		return ErrorClassTLS, http.StatusBadGateway
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return ErrorClassDial, http.StatusBadGateway
+	default:
+		return ErrorClassUpstream, http.StatusBadGateway
+	}
+}
+
+// newErrorInfo returns the ErrorInfo of err for req, which may be nil.
+func (h *Handler) newErrorInfo(req *http.Request, filter, requestID string, err error) *ErrorInfo {
+	class, status := classifyError(err)
+
+	info := &ErrorInfo{
+		Status:    status,
+		Class:     class,
+		Filter:    filter,
+		Error:     err.Error(),
+		RequestID: requestID,
+		Host:      h.Listener.Addr().String(),
+		Software:  h.Branding + " (go/" + runtime.Version() + " " + runtime.GOOS + "/" + runtime.GOARCH + ")",
+	}
+
+	if req != nil && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		info.RetryURL = req.URL.String()
+	}
+
+	return info
+}
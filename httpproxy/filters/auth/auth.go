@@ -2,9 +2,15 @@ package auth
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"runtime"
 	"strings"
 	"time"
@@ -13,107 +19,249 @@ import (
 	"github.com/phuslu/glog"
 
 	"github.com/xuiv/goproxy/httpproxy/filters"
+	"github.com/xuiv/goproxy/httpproxy/helpers"
 	"github.com/xuiv/goproxy/httpproxy/storage"
 )
 
 const (
 	filterName string = "auth"
+
+	defaultRealm    = "GoProxy Authentication Required"
+	defaultCacheTTL = 5 * time.Minute
+	defaultNonceTTL = 5 * time.Minute
+)
+
+var (
+	errNoCredentials = errors.New("no credentials")
 )
 
 type Config struct {
+	Realm    string
+	Digest   bool
+	NonceTTL int // seconds
+	// CacheSize and CacheTTL bound the cache of the verified Basic
+	// credentials, which saves a bcrypt per request. A negative CacheTTL
+	// disables it.
 	CacheSize int
-	Basic     []struct {
+	CacheTTL  int // seconds
+	// UserFile is an htpasswd file of bcrypt or {SHA} hashes, or an
+	// htdigest file for Digest, it is reloaded once changed.
+	UserFile string
+	Basic    []struct {
 		Username string
 		Password string
 	}
+	// WhiteList is the ips, CIDRs and ranges of the clients which need no
+	// credentials, e.g. "10.0.0.0/8" or "fd00::/8".
 	WhiteList []string
+	// External delegates the Basic and Bearer credentials to an http
+	// endpoint instead of the users above.
+	External ExternalConfig
+	// Policies limit what the users and the whitelisted ips may reach, the
+	// first one matching a user or an ip applies.
+	Policies []PolicyConfig
+}
+
+// Validate checks the users of auth.json and of the user file, the
+// external endpoint and the policies.
+func (c *Config) Validate() []error {
+	errs := make([]error, 0)
+
+	for i, v := range c.Basic {
+		if err := checkHash(v.Password); err != nil {
+			errs = append(errs, &storage.ConfigError{Key: fmt.Sprintf("Basic[%d].Password", i), Err: err})
+		}
+	}
+
+	if c.UserFile != "" {
+		realm := c.Realm
+		if realm == "" {
+			realm = defaultRealm
+		}
+
+		resp, err := storage.LookupStoreByFilterName(filterName).Get(c.UserFile)
+		if err != nil {
+			errs = append(errs, &storage.ConfigError{Key: "UserFile", Err: err})
+		} else {
+			for _, err := range parseUserFile(resp.Body, realm, make(map[string]*credential)) {
+				errs = append(errs, &storage.ConfigError{Key: "UserFile", Err: fmt.Errorf("%s: %v", c.UserFile, err)})
+			}
+			resp.Body.Close()
+		}
+	}
+
+	for i, ip := range c.WhiteList {
+		if _, err := helpers.NewIPMatcher([]string{ip}); err != nil {
+			errs = append(errs, &storage.ConfigError{Key: fmt.Sprintf("WhiteList[%d]", i), Err: err})
+		}
+	}
+
+	errs = append(errs, c.External.validate()...)
+
+	for i := range c.Policies {
+		errs = append(errs, c.Policies[i].validate(fmt.Sprintf("Policies[%d]", i))...)
+	}
+
+	return errs
 }
 
 type Filter struct {
 	Config
+	name      string
 	AuthCache lrucache.Cache
-	Basic     map[string]string
-	WhiteList map[string]struct{}
+	Users     *Users
+	WhiteList *helpers.IPMatcher
+	Policies  []*Policy
+
+	external *external
+	conns    *connLimiter
+	realm    string
+	cacheTTL time.Duration
+	nonceTTL time.Duration
+	nonceKey []byte
+	nonces   *nonceCounter
+}
+
+// result is the authentication of a request, it is made by Request and
+// answered by RoundTrip. err is the authentication error, which asks for the
+// credentials, and deny is the one of the policy or of the external
+// endpoint. header is added to the request.
+type result struct {
+	user   string
+	err    error
+	deny   error
+	header http.Header
+}
+
+type resultKey struct{}
+
+// cachedUser is a verified Basic credentials, it is valid for the users of
+// generation gen only.
+type cachedUser struct {
+	user string
+	gen  uint64
 }
 
 func init() {
-	filters.Register(filterName, func() (filters.Filter, error) {
-		filename := filterName + ".json"
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
+		filename := name + ".json"
 		config := new(Config)
 		err := storage.LookupStoreByFilterName(filterName).UnmarshallJson(filename, config)
 		if err != nil {
-			glog.Fatalf("UnmarshallJson(%#v) failed: %s", filename, err)
+			glog.Errorf("UnmarshallJson(%#v) failed: %s", filename, err)
+			return nil, err
 		}
-		return NewFilter(config)
+		return newFilter(name, config)
+	})
+	filters.RegisterSchema(filterName, filters.Schema{
+		NewConfig: func() interface{} { return new(Config) },
+		Prototype: (*Filter)(nil),
 	})
 }
 
 func NewFilter(config *Config) (filters.Filter, error) {
+	return newFilter(filterName, config)
+}
+
+func newFilter(name string, config *Config) (filters.Filter, error) {
 	f := &Filter{
 		Config:    *config,
+		name:      name,
 		AuthCache: lrucache.NewMultiLRUCache(uint(runtime.NumCPU()), uint(config.CacheSize)),
-		Basic:     make(map[string]string),
-		WhiteList: make(map[string]struct{}),
+		realm:     config.Realm,
+		cacheTTL:  time.Duration(config.CacheTTL) * time.Second,
+		nonceTTL:  time.Duration(config.NonceTTL) * time.Second,
+		nonceKey:  make([]byte, 32),
+		nonces:    &nonceCounter{counts: make(map[string]*nonceCount)},
+		conns:     &connLimiter{conns: make(map[string]int)},
+	}
+
+	if f.realm == "" {
+		f.realm = defaultRealm
+	}
+	if f.cacheTTL == 0 {
+		f.cacheTTL = defaultCacheTTL
+	}
+	if f.nonceTTL <= 0 {
+		f.nonceTTL = defaultNonceTTL
 	}
 
+	if _, err := rand.Read(f.nonceKey); err != nil {
+		return nil, err
+	}
+
+	basic := make(map[string]string)
 	for _, v := range config.Basic {
-		f.Basic[v.Username] = v.Password
+		basic[v.Username] = v.Password
+	}
+
+	users, err := NewUsers(basic, storage.LookupStoreByFilterName(filterName), config.UserFile, f.realm)
+	if err != nil {
+		return nil, fmt.Errorf("AUTH: %v", err)
+	}
+	f.Users = users
+
+	if f.WhiteList, err = helpers.NewIPMatcher(config.WhiteList); err != nil {
+		return nil, fmt.Errorf("AUTH: WhiteList: %v", err)
+	}
+
+	for _, v := range config.Policies {
+		p, err := NewPolicy(v)
+		if err != nil {
+			return nil, fmt.Errorf("AUTH: %v", err)
+		}
+		f.Policies = append(f.Policies, p)
 	}
 
-	for _, v := range config.WhiteList {
-		f.WhiteList[v] = struct{}{}
+	if config.External.URL != "" {
+		f.external = newExternal(config.External)
 	}
 
 	return f, nil
 }
 
 func (f *Filter) FilterName() string {
-	return filterName
+	return f.name
 }
 
+// Request authenticates req by its own credentials, or by the CONNECT of the
+// tunnel it is read from, and applies the policy of the user. A request which
+// fails is answered at once, since auth may be a RequestFilter only and the
+// filters after, e.g. stripssl, may hijack a CONNECT before RoundTrip.
 func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
-	if auth := req.Header.Get("Proxy-Authorization"); auth != "" {
-		req.Header.Del("Proxy-Authorization")
-		f.AuthCache.Set(req.RemoteAddr, auth, time.Now().Add(time.Hour))
+	ctx, r := f.check(ctx, req)
+
+	switch {
+	case r.err == nil && r.deny == nil:
+		return ctx, req, nil
+	case r.err == nil:
+		return ctx, nil, r.deny
 	}
-	return ctx, req, nil
+
+	glog.V(1).Infof("%s \"AUTH %s %s %s\" unauthenticated: %v", filters.LogPrefix(req), req.Method, req.Host, req.Proto, r.err)
+
+	rw := filters.GetResponseWriter(ctx)
+	rw.Header()["Proxy-Authenticate"] = f.challenges(r.err == errStaleNonce)
+	rw.WriteHeader(http.StatusProxyAuthRequired)
+	return ctx, filters.DummyRequest, nil
 }
 
 func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	ctx, r := f.check(ctx, req)
 
-	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
-		if _, ok := f.WhiteList[ip]; ok {
-			return ctx, nil, nil
-		}
-	}
-
-	if auth, ok := f.AuthCache.GetNotStale(req.RemoteAddr); ok && auth != nil {
-		parts := strings.SplitN(auth.(string), " ", 2)
-		if len(parts) == 2 {
-			switch parts[0] {
-			case "Basic":
-				if userpass, err := base64.StdEncoding.DecodeString(parts[1]); err == nil {
-					parts := strings.Split(string(userpass), ":")
-					user := parts[0]
-					pass := parts[1]
-					pass1, ok := f.Basic[user]
-					if ok && pass == pass1 {
-						return ctx, nil, nil
-					}
-				}
-			default:
-				glog.Errorf("Unrecognized auth type: %#v", parts[0])
-				break
-			}
-		}
+	switch {
+	case r.err == nil && r.deny == nil:
+		return ctx, nil, nil
+	case r.err == nil:
+		return ctx, nil, r.deny
 	}
 
-	glog.V(1).Infof("UnAuthenticated URL %v from %#v", req.URL.String(), req.RemoteAddr)
+	glog.V(1).Infof("UnAuthenticated URL %v from %s: %v", req.URL.String(), filters.LogPrefix(req), r.err)
 
 	noAuthResponse := &http.Response{
 		StatusCode: http.StatusProxyAuthRequired,
 		Header: http.Header{
-			"Proxy-Authenticate": []string{"Basic realm=\"GoProxy Authentication Required\""},
+			"Proxy-Authenticate": f.challenges(r.err == errStaleNonce),
 		},
 		Request:       req,
 		Close:         true,
@@ -122,3 +270,165 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 
 	return ctx, noAuthResponse, nil
 }
+
+// CheckPassword implements filters.PasswordChecker, the clients in WhiteList
+// need no credentials. The policies are applied to the requests later.
+func (f *Filter) CheckPassword(addr, username, password string) bool {
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{},
+		Header:     http.Header{},
+		RemoteAddr: addr,
+	}
+	if _, ok := f.whitelisted(req); ok {
+		return true
+	}
+
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+	r := f.authenticate(req)
+
+	return r.err == nil && r.deny == nil
+}
+
+// check authenticates req and applies the policy once, auth may be both a
+// RequestFilter and a RoundTripFilter of a profile or either of them.
+func (f *Filter) check(ctx context.Context, req *http.Request) (context.Context, *result) {
+	if r, ok := ctx.Value(resultKey{}).(*result); ok {
+		return ctx, r
+	}
+
+	var r *result
+	var policy *Policy
+	var key string
+	if ip, ok := f.whitelisted(req); ok {
+		r = &result{}
+		for _, p := range f.Policies {
+			if p.matchIP(ip) {
+				policy, key = p, "ip "+ip
+				break
+			}
+		}
+	} else {
+		r = f.authenticate(req)
+		if r.err == nil && r.deny == nil {
+			filters.SetUser(ctx, f.FilterName(), r.user)
+			for _, p := range f.Policies {
+				if p.matchUser(r.user) {
+					policy, key = p, "user "+r.user
+					break
+				}
+			}
+		}
+	}
+
+	if policy != nil {
+		filters.SetFilterPolicy(ctx, policy)
+		r.deny = policy.check(ctx, req)
+		if r.deny == nil && policy.MaxConns > 0 {
+			r.deny = f.conns.acquire(ctx, key, policy.MaxConns)
+		}
+		if r.deny != nil {
+			glog.V(1).Infof("%s \"AUTH %s %s %s\" denied: %v", filters.LogPrefix(req), req.Method, req.Host, req.Proto, r.deny)
+		}
+	}
+
+	// the headers of the external endpoint could not be forged by clients
+	if f.external != nil && r.err == nil && r.deny == nil {
+		for _, name := range f.external.Headers {
+			req.Header.Del(name)
+		}
+		for name, values := range r.header {
+			req.Header[name] = append([]string(nil), values...)
+		}
+	}
+
+	return context.WithValue(ctx, resultKey{}, r), r
+}
+
+func (f *Filter) whitelisted(req *http.Request) (string, bool) {
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil && f.WhiteList.MatchString(ip) {
+		return ip, true
+	}
+	return "", false
+}
+
+// authenticate checks the Proxy-Authorization header of req and removes it,
+// the requests without one are authenticated by their tunnel.
+func (f *Filter) authenticate(req *http.Request) *result {
+	auth := req.Header.Get("Proxy-Authorization")
+	req.Header.Del("Proxy-Authorization")
+
+	if auth == "" {
+		if user, ok := filters.TunnelUser(req.Context(), f.FilterName()); ok && f.knows(user) {
+			r := &result{user: user}
+			if f.external != nil {
+				r.header = f.externalHeader(user)
+			}
+			return r
+		}
+		return &result{err: errNoCredentials}
+	}
+
+	var user string
+	var err error
+	scheme, params := auth, ""
+	if i := strings.IndexByte(auth, ' '); i >= 0 {
+		scheme, params = auth[:i], strings.TrimSpace(auth[i+1:])
+	}
+	switch {
+	case f.external != nil && (strings.EqualFold(scheme, "Basic") || strings.EqualFold(scheme, "Bearer")):
+		return f.authenticateExternal(req, scheme, params)
+	case strings.EqualFold(scheme, "Basic"):
+		user, err = f.authenticateBasic(params)
+	case strings.EqualFold(scheme, "Digest") && f.Digest:
+		user, err = f.authenticateDigest(req, params)
+	default:
+		err = fmt.Errorf("unsupported auth scheme %#v", scheme)
+	}
+
+	return &result{user: user, err: err}
+}
+
+// knows reports whether user is one of the users of f, the ones of the
+// external endpoint are not known in advance.
+func (f *Filter) knows(user string) bool {
+	if f.external != nil {
+		return true
+	}
+	c, _ := f.Users.lookup(user)
+	return c != nil
+}
+
+func (f *Filter) authenticateBasic(token string) (string, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	if v, ok := f.AuthCache.GetNotStale(key); ok {
+		cu := v.(*cachedUser)
+		if _, gen := f.Users.lookup(cu.user); gen == cu.gen {
+			return cu.user, nil
+		}
+	}
+
+	data, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", errBadCredentials
+	}
+
+	i := strings.IndexByte(string(data), ':')
+	if i < 0 {
+		return "", errBadCredentials
+	}
+	user, password := string(data[:i]), string(data[i+1:])
+
+	c, gen := f.Users.lookup(user)
+	if c == nil || !c.verify(user, f.realm, password) {
+		return "", errBadCredentials
+	}
+
+	if f.cacheTTL > 0 {
+		f.AuthCache.Set(key, &cachedUser{user: user, gen: gen}, time.Now().Add(f.cacheTTL))
+	}
+
+	return user, nil
+}
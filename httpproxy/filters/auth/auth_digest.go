@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xuiv/goproxy/httpproxy/helpers"
+)
+
+var (
+	errBadCredentials = errors.New("bad credentials")
+	errStaleNonce     = errors.New("stale nonce")
+)
+
+// newNonce returns a nonce of Digest which carries the time it is issued
+// at, signed with the key of the filter, so that no nonce is kept.
+func (f *Filter) newNonce() string {
+	b := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Unix()))
+
+	mac := hmac.New(sha256.New, f.nonceKey)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(b))
+}
+
+// checkNonce returns errStaleNonce for the nonces older than NonceTTL, the
+// clients retry those with a new nonce without asking the user.
+func (f *Filter) checkNonce(nonce string) error {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != 8+sha256.Size {
+		return errBadCredentials
+	}
+
+	mac := hmac.New(sha256.New, f.nonceKey)
+	mac.Write(b[:8])
+	if !hmac.Equal(mac.Sum(nil), b[8:]) {
+		return errBadCredentials
+	}
+
+	issued := time.Unix(int64(binary.BigEndian.Uint64(b[:8])), 0)
+	if time.Since(issued) > f.nonceTTL {
+		return errStaleNonce
+	}
+
+	return nil
+}
+
+// nonceCounter keeps the last nc of the Digest nonces in use, so that a
+// captured response could not be replayed.
+type nonceCounter struct {
+	mu     sync.Mutex
+	counts map[string]*nonceCount
+	pruned time.Time
+}
+
+type nonceCount struct {
+	nc   uint64
+	used time.Time // the first use, the nonce is stale ttl after
+}
+
+// next records nc of nonce, it fails unless nc is greater than the last one.
+// The nonces used before ttl are dropped, they are stale by then.
+func (c *nonceCounter) next(nonce string, nc uint64, ttl time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.pruned) > ttl {
+		for k, v := range c.counts {
+			if now.Sub(v.used) > ttl {
+				delete(c.counts, k)
+			}
+		}
+		c.pruned = now
+	}
+
+	v, ok := c.counts[nonce]
+	if !ok {
+		c.counts[nonce] = &nonceCount{nc: nc, used: now}
+		return true
+	}
+	if nc <= v.nc {
+		return false
+	}
+	v.nc = nc
+	return true
+}
+
+// challenges returns the Proxy-Authenticate headers of a 407, stale tells
+// the Digest clients that only the nonce is expired.
+func (f *Filter) challenges(stale bool) []string {
+	basic := fmt.Sprintf("Basic realm=%q", f.realm)
+	if !f.Digest {
+		return []string{basic}
+	}
+
+	digest := fmt.Sprintf("Digest realm=%q, qop=\"auth\", algorithm=MD5, nonce=%q", f.realm, f.newNonce())
+	if stale {
+		digest += ", stale=true"
+	}
+
+	// the clients pick the strongest scheme they know
+	return []string{digest, basic}
+}
+
+// authenticateDigest checks the Digest credentials params of req, see RFC
+// 7616, only MD5 and qop "auth" or none of RFC 2069 are supported.
+func (f *Filter) authenticateDigest(req *http.Request, params string) (string, error) {
+	p := helpers.ParseAuthParams(params)
+
+	user := p["username"]
+	if user == "" || p["realm"] != f.realm || p["response"] == "" {
+		return "", errBadCredentials
+	}
+
+	switch strings.ToUpper(p["algorithm"]) {
+	case "", "MD5":
+	default:
+		return "", errBadCredentials
+	}
+
+	// the uri is the request target, "host:port" for CONNECT, some clients
+	// send the path of the absolute ones
+	if req.RequestURI != "" && p["uri"] != req.RequestURI && !(req.URL.IsAbs() && p["uri"] == req.URL.RequestURI()) {
+		return "", errBadCredentials
+	}
+
+	c, _ := f.Users.lookup(user)
+	if c == nil || c.ha1 == "" {
+		return "", errBadCredentials
+	}
+
+	ha2 := md5Hex(req.Method + ":" + p["uri"])
+
+	var response string
+	switch p["qop"] {
+	case "auth":
+		if p["nc"] == "" || p["cnonce"] == "" {
+			return "", errBadCredentials
+		}
+		response = md5Hex(strings.Join([]string{c.ha1, p["nonce"], p["nc"], p["cnonce"], "auth", ha2}, ":"))
+	case "":
+		response = md5Hex(c.ha1 + ":" + p["nonce"] + ":" + ha2)
+	default:
+		return "", errBadCredentials
+	}
+
+	if subtle.ConstantTimeCompare([]byte(response), []byte(strings.ToLower(p["response"]))) != 1 {
+		return "", errBadCredentials
+	}
+
+	// the nonce is checked last, a stale one with the right password asks
+	// the client to retry on its own
+	if err := f.checkNonce(p["nonce"]); err != nil {
+		return "", err
+	}
+
+	// the nc of qop "auth" grows with each request on a nonce, a replayed or
+	// reordered one is answered as stale so that the client gets a new
+	// nonce. The responses without qop carry no nc, they could be replayed
+	// until the nonce is stale.
+	if p["qop"] == "auth" {
+		nc, err := strconv.ParseUint(p["nc"], 16, 64)
+		if err != nil {
+			return "", errBadCredentials
+		}
+		if !f.nonces.next(p["nonce"], nc, f.nonceTTL) {
+			return "", errStaleNonce
+		}
+	}
+
+	return user, nil
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
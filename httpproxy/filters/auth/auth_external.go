@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"github.com/xuiv/goproxy/httpproxy/filters"
+	"github.com/xuiv/goproxy/httpproxy/storage"
+)
+
+const (
+	defaultExternalTimeout = 5 * time.Second
+	defaultExternalTTL     = time.Minute
+)
+
+// ExternalConfig delegates the Basic and Bearer credentials to an http
+// endpoint in the spirit of auth_request of nginx. The endpoint gets a GET
+// with the X-Auth-* headers and answers 2xx to allow, 401 or 403 to deny,
+// the answers are cached by the credentials, the client ip and the target.
+type ExternalConfig struct {
+	URL     string
+	Timeout int // seconds
+	TTL     int // seconds, of the allow answers
+	DenyTTL int // seconds, of the deny answers
+	// Headers are the headers of the allow answers which are added to the
+	// requests of the user, e.g. "X-User-Email".
+	Headers []string
+}
+
+func (c *ExternalConfig) validate() []error {
+	errs := make([]error, 0)
+
+	if c.URL != "" {
+		if u, err := url.Parse(c.URL); err != nil {
+			errs = append(errs, &storage.ConfigError{Key: "External.URL", Err: err})
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, &storage.ConfigError{Key: "External.URL", Err: fmt.Errorf("%#v is not an http url", c.URL)})
+		}
+	}
+
+	for i, name := range c.Headers {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			errs = append(errs, &storage.ConfigError{Key: fmt.Sprintf("External.Headers[%d]", i), Err: fmt.Errorf("invalid header %#v", name)})
+		}
+	}
+
+	return errs
+}
+
+// external is the client of the endpoint of ExternalConfig.
+type external struct {
+	ExternalConfig
+	client  *http.Client
+	ttl     time.Duration
+	denyTTL time.Duration
+}
+
+// answer is a cached answer of the endpoint.
+type answer struct {
+	allow  bool
+	user   string
+	header http.Header
+}
+
+func newExternal(config ExternalConfig) *external {
+	x := &external{
+		ExternalConfig: config,
+		client: &http.Client{
+			// the endpoint is never reached through a proxy
+			Transport: &http.Transport{
+				Proxy:               nil,
+				MaxIdleConnsPerHost: 16,
+				IdleConnTimeout:     time.Minute,
+			},
+			Timeout: time.Duration(config.Timeout) * time.Second,
+		},
+		ttl:     time.Duration(config.TTL) * time.Second,
+		denyTTL: time.Duration(config.DenyTTL) * time.Second,
+	}
+
+	if x.client.Timeout <= 0 {
+		x.client.Timeout = defaultExternalTimeout
+	}
+	if x.ttl == 0 {
+		x.ttl = defaultExternalTTL
+	}
+
+	return x
+}
+
+// authenticateExternal asks the endpoint about the Basic or Bearer
+// credentials of req. A failure of the endpoint denies req without asking
+// for the credentials again.
+func (f *Filter) authenticateExternal(req *http.Request, scheme, params string) *result {
+	x := f.external
+
+	var user, password, token string
+	if strings.EqualFold(scheme, "Basic") {
+		data, err := base64.StdEncoding.DecodeString(params)
+		if err != nil {
+			return &result{err: errBadCredentials}
+		}
+		i := strings.IndexByte(string(data), ':')
+		if i < 0 {
+			return &result{err: errBadCredentials}
+		}
+		user, password = string(data[:i]), string(data[i+1:])
+	} else {
+		token = params
+	}
+
+	client, _, _ := net.SplitHostPort(req.RemoteAddr)
+	target := req.Host
+	if req.Method != http.MethodConnect && req.URL.Host != "" {
+		target = req.URL.Host
+	}
+
+	sum := sha256.Sum256([]byte(scheme + " " + params + "\n" + client + "\n" + target))
+	key := "external:" + hex.EncodeToString(sum[:])
+
+	if v, ok := f.AuthCache.GetNotStale(key); ok {
+		a := v.(*answer)
+		if !a.allow {
+			return &result{err: errBadCredentials}
+		}
+		return &result{user: a.user, header: a.header}
+	}
+
+	a, err := x.ask(req.Context(), user, password, token, client, target, filters.RequestID(req.Context()))
+	if err != nil {
+		glog.Warningf("%s AUTH External %#v error: %v", filters.LogPrefix(req), x.URL, err)
+		return &result{deny: fmt.Errorf("auth endpoint error: %v", err)}
+	}
+
+	switch {
+	case a.allow && x.ttl > 0:
+		f.AuthCache.Set(key, a, time.Now().Add(x.ttl))
+	case !a.allow && x.denyTTL > 0:
+		f.AuthCache.Set(key, a, time.Now().Add(x.denyTTL))
+	}
+
+	if !a.allow {
+		return &result{err: errBadCredentials}
+	}
+
+	// the headers are kept by user too, for the requests of its tunnels
+	// which carry no credentials
+	if len(a.header) > 0 {
+		f.AuthCache.Set("external-user:"+a.user, a.header, time.Now().Add(x.ttl))
+	}
+
+	return &result{user: a.user, header: a.header}
+}
+
+// ask sends the credentials to the endpoint, the password is sent as its
+// SHA-256 only.
+func (x *external) ask(ctx context.Context, user, password, token, client, target, requestID string) (*answer, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, x.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if user != "" {
+		sum := sha256.Sum256([]byte(password))
+		req.Header.Set("X-Auth-User", user)
+		req.Header.Set("X-Auth-Password-Hash", "sha256="+hex.EncodeToString(sum[:]))
+	}
+	if token != "" {
+		req.Header.Set("X-Auth-Token", token)
+	}
+	req.Header.Set("X-Auth-Client-IP", client)
+	req.Header.Set("X-Auth-Target", target)
+	if requestID != "" {
+		req.Header.Set("X-Request-Id", requestID)
+	}
+
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		return &answer{allow: false}, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	a := &answer{allow: true, user: user}
+
+	// the endpoint may name the user of a token, or rename one
+	if name := resp.Header.Get("X-Auth-User"); name != "" {
+		a.user = name
+	}
+	if a.user == "" {
+		sum := sha256.Sum256([]byte(token))
+		a.user = "token-" + hex.EncodeToString(sum[:4])
+	}
+
+	for _, name := range x.Headers {
+		if values := resp.Header.Values(name); len(values) > 0 {
+			if a.header == nil {
+				a.header = make(http.Header)
+			}
+			a.header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+
+	return a, nil
+}
+
+// externalHeader returns the headers of the last allow answer of user.
+func (f *Filter) externalHeader(user string) http.Header {
+	if v, ok := f.AuthCache.GetNotStale("external-user:" + user); ok {
+		return v.(http.Header)
+	}
+	return nil
+}
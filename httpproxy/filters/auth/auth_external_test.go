@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xuiv/goproxy/httpproxy/filters"
+)
+
+// newTestEndpoint answers alice with the password "secret" and the token
+// "t0ken", it renames alice to alice@corp. bob is denied and boom fails.
+func newTestEndpoint(t *testing.T) (*httptest.Server, *int32) {
+	var asked int32
+
+	secret := sha256.Sum256([]byte("secret"))
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&asked, 1)
+
+		if req.Header.Get("X-Auth-Client-IP") != "203.0.113.1" {
+			t.Errorf("X-Auth-Client-IP = %#v", req.Header.Get("X-Auth-Client-IP"))
+		}
+
+		switch user := req.Header.Get("X-Auth-User"); {
+		case user == "alice" && req.Header.Get("X-Auth-Password-Hash") == "sha256="+hex.EncodeToString(secret[:]):
+			rw.Header().Set("X-Auth-User", "alice@corp")
+			rw.Header().Set("X-User-Email", "alice@example.org")
+			rw.Header().Set("X-Internal", "leaked")
+		case user == "dave":
+		case user == "" && req.Header.Get("X-Auth-Token") == "t0ken":
+		case user == "boom":
+			http.Error(rw, "boom", http.StatusBadGateway)
+			return
+		default:
+			http.Error(rw, "denied", http.StatusForbidden)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+
+	return server, &asked
+}
+
+// testExternalConfig asks the endpoint url, the X-User-Email of its answers
+// is passed on.
+func testExternalConfig(url string) *Config {
+	return &Config{External: ExternalConfig{URL: url, TTL: 60, DenyTTL: 60, Headers: []string{"X-User-Email"}}}
+}
+
+func externalCheck(f *Filter, authorization, target string, header http.Header) (*http.Request, *result) {
+	req, _ := http.NewRequest(http.MethodGet, "http://"+target+"/", nil)
+	req.RemoteAddr = "203.0.113.1:1234"
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Proxy-Authorization", authorization)
+
+	ctx := filters.NewContext(context.Background(), nil, nil, nil, "")
+	ctx, r := f.check(ctx, req)
+	return req.WithContext(ctx), r
+}
+
+func TestExternalAnswers(t *testing.T) {
+	server, asked := newTestEndpoint(t)
+	defer server.Close()
+
+	f := newTestFilter(t, filterName, testExternalConfig(server.URL))
+
+	forged := http.Header{"X-User-Email": {"admin@example.org"}}
+
+	req, r := externalCheck(f, "Basic "+basicToken("alice", "secret"), "example.com", forged)
+	if r.err != nil || r.deny != nil {
+		t.Fatalf("alice is not allowed, err=%v deny=%v", r.err, r.deny)
+	}
+	if r.user != "alice@corp" {
+		t.Errorf("the user of alice = %#v, want the renamed \"alice@corp\"", r.user)
+	}
+	if got := req.Header.Values("X-User-Email"); len(got) != 1 || got[0] != "alice@example.org" {
+		t.Errorf("X-User-Email = %#v, want the one of the endpoint only", got)
+	}
+	if got := req.Header.Get("X-Internal"); got != "" {
+		t.Errorf("X-Internal = %#v, want only the configured Headers", got)
+	}
+
+	// the endpoint added no headers for dave, the forged one is dropped still
+	req, r = externalCheck(f, "Basic "+basicToken("dave", "any"), "example.com", forged)
+	if r.err != nil || r.deny != nil {
+		t.Fatalf("dave is not allowed, err=%v deny=%v", r.err, r.deny)
+	}
+	if r.user != "dave" {
+		t.Errorf("the user of dave = %#v", r.user)
+	}
+	if got := req.Header.Values("X-User-Email"); len(got) != 0 {
+		t.Errorf("X-User-Email of dave = %#v, want none", got)
+	}
+
+	_, r = externalCheck(f, "Bearer t0ken", "example.com", nil)
+	if r.err != nil || r.deny != nil {
+		t.Fatalf("the token is not allowed, err=%v deny=%v", r.err, r.deny)
+	}
+	if sum := sha256.Sum256([]byte("t0ken")); r.user != "token-"+hex.EncodeToString(sum[:4]) {
+		t.Errorf("the user of the token = %#v", r.user)
+	}
+
+	for _, authorization := range []string{
+		"Basic " + basicToken("alice", "wrong"),
+		"Basic " + basicToken("bob", "secret"),
+		"Bearer wrong",
+	} {
+		req, r := externalCheck(f, authorization, "example.com", forged)
+		if r.err != errBadCredentials {
+			t.Errorf("%s: err = %v, want errBadCredentials", authorization, r.err)
+		}
+		if got := req.Header.Get("X-User-Email"); got != "admin@example.org" {
+			t.Errorf("%s: X-User-Email = %#v, the denied request is left as is", authorization, got)
+		}
+	}
+
+	// a failure of the endpoint is a deny, not a challenge
+	_, r = externalCheck(f, "Basic "+basicToken("boom", "secret"), "example.com", nil)
+	if r.err != nil || r.deny == nil {
+		t.Errorf("boom: err=%v deny=%v, want a deny", r.err, r.deny)
+	}
+
+	if n := atomic.LoadInt32(asked); n != 7 {
+		t.Errorf("the endpoint is asked %d times, want 7", n)
+	}
+}
+
+func TestExternalCache(t *testing.T) {
+	server, asked := newTestEndpoint(t)
+	defer server.Close()
+
+	f := newTestFilter(t, filterName, testExternalConfig(server.URL))
+
+	alice := "Basic " + basicToken("alice", "secret")
+	bob := "Basic " + basicToken("bob", "secret")
+	boom := "Basic " + basicToken("boom", "secret")
+
+	for i, c := range []struct {
+		authorization string
+		target        string
+		asked         int32
+	}{
+		{alice, "example.com", 1},
+		{alice, "example.com", 1},
+		{alice, "example.org", 2}, // the answers are cached by target too
+		{bob, "example.com", 3},
+		{bob, "example.com", 3},
+		{boom, "example.com", 4},
+		{boom, "example.com", 5}, // the failures are not cached
+	} {
+		req, r := externalCheck(f, c.authorization, c.target, nil)
+		if n := atomic.LoadInt32(asked); n != c.asked {
+			t.Fatalf("#%d: the endpoint is asked %d times, want %d", i, n, c.asked)
+		}
+		if c.authorization == alice {
+			if r.user != "alice@corp" || req.Header.Get("X-User-Email") != "alice@example.org" {
+				t.Errorf("#%d: the cached answer of alice is user=%#v header=%#v", i, r.user, req.Header)
+			}
+		}
+	}
+
+	// the headers of alice are kept for the requests of the tunnels of alice
+	if got := f.externalHeader("alice@corp").Get("X-User-Email"); got != "alice@example.org" {
+		t.Errorf("externalHeader(\"alice@corp\") = %#v", got)
+	}
+
+	f.external.ttl = 20 * time.Millisecond
+	f.external.denyTTL = 20 * time.Millisecond
+
+	externalCheck(f, alice, "example.net", nil)
+	externalCheck(f, bob, "example.net", nil)
+	externalCheck(f, alice, "example.net", nil)
+	externalCheck(f, bob, "example.net", nil)
+	if n := atomic.LoadInt32(asked); n != 7 {
+		t.Fatalf("the endpoint is asked %d times before the TTLs, want 7", n)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	externalCheck(f, alice, "example.net", nil)
+	externalCheck(f, bob, "example.net", nil)
+	if n := atomic.LoadInt32(asked); n != 9 {
+		t.Errorf("the endpoint is asked %d times after the TTLs, want 9", n)
+	}
+}
@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/xuiv/goproxy/httpproxy/filters"
+	"github.com/xuiv/goproxy/httpproxy/helpers"
+	"github.com/xuiv/goproxy/httpproxy/storage"
+)
+
+// PolicyConfig is the policy of the users and the whitelisted ips listed in
+// it, "*" matches all of them. The empty lists allow everything.
+type PolicyConfig struct {
+	Users      []string
+	IPs        []string // ips, CIDRs and ranges as WhiteList
+	Filters    []string // the RoundTripFilters which may serve the requests, "direct" covers "direct@corp"
+	Profiles   []string
+	AllowHosts []string
+	DenyHosts  []string
+	AllowPorts []int
+	DenyPorts  []int
+	MaxConns   int // the requests and tunnels in flight of each user or ip
+}
+
+func (c *PolicyConfig) validate(prefix string) []error {
+	errs := make([]error, 0)
+
+	for i, name := range c.Filters {
+		key := fmt.Sprintf("%s.Filters[%d]", prefix, i)
+		if schema, ok := filters.LookupSchema(name); !ok {
+			errs = append(errs, &storage.ConfigError{Key: key, Err: fmt.Errorf("unknown filter %#v", name)})
+		} else if _, ok := schema.Prototype.(filters.RoundTripFilter); !ok {
+			errs = append(errs, &storage.ConfigError{Key: key, Err: fmt.Errorf("%#v is not a RoundTripFilter", name)})
+		}
+	}
+
+	for i, ip := range c.IPs {
+		if _, err := helpers.NewIPMatcher([]string{ip}); err != nil {
+			errs = append(errs, &storage.ConfigError{Key: fmt.Sprintf("%s.IPs[%d]", prefix, i), Err: err})
+		}
+	}
+
+	for key, ports := range map[string][]int{"AllowPorts": c.AllowPorts, "DenyPorts": c.DenyPorts} {
+		for i, port := range ports {
+			if port <= 0 || port > 65535 {
+				errs = append(errs, &storage.ConfigError{Key: fmt.Sprintf("%s.%s[%d]", prefix, key, i), Err: fmt.Errorf("invalid port %d", port)})
+			}
+		}
+	}
+
+	if c.MaxConns < 0 {
+		errs = append(errs, &storage.ConfigError{Key: prefix + ".MaxConns", Err: fmt.Errorf("invalid MaxConns %d", c.MaxConns)})
+	}
+
+	return errs
+}
+
+// Policy is what a user or a whitelisted ip may reach.
+type Policy struct {
+	PolicyConfig
+
+	users      map[string]struct{}
+	ips        *helpers.IPMatcher
+	filters    map[string]struct{}
+	profiles   map[string]struct{}
+	allowHosts *helpers.HostMatcher
+	denyHosts  *helpers.HostMatcher
+	allowPorts map[int]struct{}
+	denyPorts  map[int]struct{}
+}
+
+func NewPolicy(config PolicyConfig) (*Policy, error) {
+	ips, err := helpers.NewIPMatcher(config.IPs)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Policy{
+		PolicyConfig: config,
+		users:        stringSet(config.Users),
+		ips:          ips,
+		filters:      make(map[string]struct{}),
+		profiles:     stringSet(config.Profiles),
+		allowHosts:   helpers.NewHostMatcher(config.AllowHosts),
+		denyHosts:    helpers.NewHostMatcher(config.DenyHosts),
+		allowPorts:   make(map[int]struct{}),
+		denyPorts:    make(map[int]struct{}),
+	}
+
+	for _, name := range config.Filters {
+		p.filters[name] = struct{}{}
+	}
+	for _, port := range config.AllowPorts {
+		p.allowPorts[port] = struct{}{}
+	}
+	for _, port := range config.DenyPorts {
+		p.denyPorts[port] = struct{}{}
+	}
+
+	return p, nil
+}
+
+func stringSet(a []string) map[string]struct{} {
+	m := make(map[string]struct{}, len(a))
+	for _, s := range a {
+		m[s] = struct{}{}
+	}
+	return m
+}
+
+func (p *Policy) matchUser(user string) bool {
+	_, ok := p.users[user]
+	_, all := p.users["*"]
+	return ok || all
+}
+
+func (p *Policy) matchIP(ip string) bool {
+	return p.ips.MatchString(ip)
+}
+
+// AllowFilter implements filters.FilterPolicy, auth itself is always
+// allowed.
+func (p *Policy) AllowFilter(name string) bool {
+	if base, _ := filters.SplitName(name); len(p.filters) == 0 || base == filterName {
+		return true
+	}
+	return filters.MatchName(p.filters, name)
+}
+
+// check returns an error wrapping filters.ErrBlocked if the profile or the
+// destination of req is not allowed.
+func (p *Policy) check(ctx context.Context, req *http.Request) error {
+	if len(p.profiles) > 0 {
+		if _, ok := p.profiles[filters.Profile(ctx)]; !ok {
+			return fmt.Errorf("%w: profile %s is not allowed", filters.ErrBlocked, filters.Profile(ctx))
+		}
+	}
+
+	host, port := destination(req)
+
+	if p.denyHosts.Match(host) || (len(p.AllowHosts) > 0 && !p.allowHosts.Match(host)) {
+		return fmt.Errorf("%w: host %s is not allowed", filters.ErrBlocked, host)
+	}
+
+	_, denied := p.denyPorts[port]
+	_, allowed := p.allowPorts[port]
+	if denied || (len(p.allowPorts) > 0 && !allowed) {
+		return fmt.Errorf("%w: port %d is not allowed", filters.ErrBlocked, port)
+	}
+
+	return nil
+}
+
+// destination returns the host and the port req goes to.
+func destination(req *http.Request) (string, int) {
+	host, port := req.Host, ""
+	if req.Method != http.MethodConnect && req.URL.Host != "" {
+		host = req.URL.Host
+	}
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+
+	if port == "" {
+		switch req.URL.Scheme {
+		case "https":
+			port = "443"
+		default:
+			port = "80"
+		}
+	}
+
+	n, _ := strconv.Atoi(port)
+	return host, n
+}
+
+// connLimiter counts the requests and tunnels in flight by user or ip.
+type connLimiter struct {
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+// acquire counts a request of key, it fails with filters.ErrOverQuota once
+// key has max in flight. The count is released when ctx is done, that is
+// when the handler finishes the request or its tunnel.
+func (l *connLimiter) acquire(ctx context.Context, key string, max int) error {
+	l.mu.Lock()
+	if l.conns[key] >= max {
+		l.mu.Unlock()
+		return fmt.Errorf("%w: %s has %d connections", filters.ErrOverQuota, key, max)
+	}
+	l.conns[key]++
+	l.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		l.mu.Lock()
+		if l.conns[key]--; l.conns[key] <= 0 {
+			delete(l.conns, key)
+		}
+		l.mu.Unlock()
+	}()
+
+	return nil
+}
@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/xuiv/goproxy/httpproxy/filters"
+)
+
+func TestPolicyMatch(t *testing.T) {
+	p := newTestFilter(t, filterName, &Config{Policies: []PolicyConfig{{
+		Users: []string{"alice", "bob"},
+		IPs:   []string{"10.0.0.0/8", "192.168.1.10-192.168.1.20", "fd00::1"},
+	}}}).Policies[0]
+
+	for user, ok := range map[string]bool{
+		"alice": true,
+		"bob":   true,
+		"carol": false,
+		"":      false,
+	} {
+		if p.matchUser(user) != ok {
+			t.Errorf("matchUser(%#v) = %v, want %v", user, !ok, ok)
+		}
+	}
+
+	for ip, ok := range map[string]bool{
+		"10.1.2.3":       true,
+		"11.0.0.1":       false,
+		"192.168.1.10":   true,
+		"192.168.1.15":   true,
+		"192.168.1.21":   false,
+		"fd00::1":        true,
+		"fd00::2":        false,
+		"not an ip":      false,
+		"192.168.1.9":    false,
+		"10.255.255.255": true,
+	} {
+		if p.matchIP(ip) != ok {
+			t.Errorf("matchIP(%#v) = %v, want %v", ip, !ok, ok)
+		}
+	}
+
+	all := newTestFilter(t, filterName, &Config{Policies: []PolicyConfig{{Users: []string{"*"}}}}).Policies[0]
+	for _, user := range []string{"alice", "carol", ""} {
+		if !all.matchUser(user) {
+			t.Errorf("matchUser(%#v) of \"*\" = false, want true", user)
+		}
+	}
+}
+
+func TestPolicyAllowFilter(t *testing.T) {
+	p := newTestFilter(t, filterName, &Config{Policies: []PolicyConfig{{Filters: []string{"direct"}}}}).Policies[0]
+
+	for name, ok := range map[string]bool{
+		"direct":      true,
+		"direct@corp": true,
+		"auth":        true,
+		"auth@corp":   true,
+		"gae":         false,
+		"php@corp":    false,
+	} {
+		if p.AllowFilter(name) != ok {
+			t.Errorf("AllowFilter(%#v) = %v, want %v", name, !ok, ok)
+		}
+	}
+
+	if !newTestFilter(t, filterName, &Config{Policies: []PolicyConfig{{}}}).Policies[0].AllowFilter("gae") {
+		t.Errorf("AllowFilter(\"gae\") without Filters = false, want true")
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	p := newTestFilter(t, filterName, &Config{Policies: []PolicyConfig{{
+		Profiles:   []string{"default"},
+		AllowHosts: []string{"*.example.org", "example.com"},
+		DenyHosts:  []string{"secret.example.org"},
+		AllowPorts: []int{80, 443, 8080},
+		DenyPorts:  []int{8080},
+	}}}).Policies[0]
+
+	cases := []struct {
+		method  string
+		url     string
+		host    string
+		profile string
+		ok      bool
+	}{
+		{http.MethodGet, "http://example.com/", "", "default", true},
+		{http.MethodGet, "http://www.example.org/", "", "default", true},
+		{http.MethodGet, "https://www.example.org/", "", "default", true},
+		{http.MethodConnect, "", "www.example.org:443", "default", true},
+		{http.MethodGet, "http://example.com/", "", "other", false},
+		{http.MethodGet, "http://example.net/", "", "default", false},
+		{http.MethodGet, "http://secret.example.org/", "", "default", false},
+		{http.MethodConnect, "", "secret.example.org:443", "default", false},
+		{http.MethodGet, "http://example.com:8080/", "", "default", false},
+		{http.MethodGet, "http://example.com:22/", "", "default", false},
+		{http.MethodConnect, "", "example.com:22", "default", false},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, c.url, nil)
+		if c.method == http.MethodConnect {
+			req.Host = c.host
+		}
+
+		ctx := filters.NewContext(context.Background(), nil, nil, nil, "")
+		filters.SetProfile(ctx, c.profile)
+
+		err := p.check(ctx, req)
+		if c.ok && err != nil {
+			t.Errorf("check(%s %s%s) in %s error: %v", c.method, c.url, c.host, c.profile, err)
+		}
+		if !c.ok && !errors.Is(err, filters.ErrBlocked) {
+			t.Errorf("check(%s %s%s) in %s = %v, want ErrBlocked", c.method, c.url, c.host, c.profile, err)
+		}
+	}
+
+	open := newTestFilter(t, filterName, &Config{Policies: []PolicyConfig{{}}}).Policies[0]
+	req, _ := http.NewRequest(http.MethodGet, "http://example.net:2222/", nil)
+	if err := open.check(filters.NewContext(context.Background(), nil, nil, nil, ""), req); err != nil {
+		t.Errorf("check of an empty policy error: %v", err)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	f := newTestFilter(t, filterName, &Config{
+		Basic:    testUsers("alice", "bob"),
+		Policies: []PolicyConfig{{Users: []string{"alice"}, MaxConns: 2}},
+	})
+
+	open := func(user string) (context.CancelFunc, error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		ctx = filters.NewContext(ctx, nil, nil, nil, "")
+
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "203.0.113.1:1234"
+		req.Header.Set("Proxy-Authorization", "Basic "+basicToken(user, "secret"))
+
+		_, r := f.check(ctx, req)
+		if r.err != nil {
+			t.Fatalf("check(%#v) error: %v", user, r.err)
+		}
+		if r.deny != nil {
+			cancel()
+		}
+		return cancel, r.deny
+	}
+
+	inflight := func() int {
+		f.conns.mu.Lock()
+		defer f.conns.mu.Unlock()
+		return f.conns.conns["user alice"]
+	}
+
+	// the counts are released in their own goroutines once the requests are
+	// done
+	waitFor := func(n int) {
+		deadline := time.Now().Add(time.Second)
+		for inflight() != n && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if got := inflight(); got != n {
+			t.Fatalf("alice has %d connections, want %d", got, n)
+		}
+	}
+
+	finish1, err := open("alice")
+	if err != nil {
+		t.Fatalf("the 1st request of alice error: %v", err)
+	}
+	finish2, err := open("alice")
+	if err != nil {
+		t.Fatalf("the 2nd request of alice error: %v", err)
+	}
+	waitFor(2)
+
+	if _, err := open("alice"); !errors.Is(err, filters.ErrOverQuota) {
+		t.Fatalf("the 3rd request of alice = %v, want ErrOverQuota", err)
+	}
+	waitFor(2)
+
+	// bob is not limited by the policy of alice
+	for i := 0; i < 3; i++ {
+		finish, err := open("bob")
+		if err != nil {
+			t.Fatalf("the request %d of bob error: %v", i, err)
+		}
+		defer finish()
+	}
+
+	finish1()
+	waitFor(1)
+
+	finish3, err := open("alice")
+	if err != nil {
+		t.Fatalf("the request of alice after a finished one error: %v", err)
+	}
+	waitFor(2)
+
+	finish2()
+	finish3()
+	waitFor(0)
+
+	f.conns.mu.Lock()
+	n := len(f.conns.conns)
+	f.conns.mu.Unlock()
+	if n != 0 {
+		t.Errorf("connLimiter has %d keys after all requests finished, want 0", n)
+	}
+}
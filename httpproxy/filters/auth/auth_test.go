@@ -0,0 +1,395 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xuiv/goproxy/httpproxy/filters"
+	"github.com/xuiv/goproxy/httpproxy/helpers"
+	"github.com/xuiv/goproxy/httpproxy/storage"
+)
+
+const (
+	testRealm = "goproxy"
+
+	// the hashes of "secret"
+	testBcrypt = "$2a$10$hwZ1ecHPlO/CoBLvv13Kk.3NamfqpfJimq4JSY3d3rAuvB8NFMHPi"
+	testSHA    = "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="
+	testHA1    = "e350a3cebd99aafab40fe6fa62dbf2ba" // carol:goproxy:secret
+)
+
+// newTestFilter returns the filter name of config, the Realm and the cache
+// settings left empty are the ones of the tests.
+func newTestFilter(t *testing.T, name string, config *Config) *Filter {
+	if config.Realm == "" {
+		config.Realm = testRealm
+	}
+	if config.CacheSize == 0 {
+		config.CacheSize = 16
+	}
+	if config.CacheTTL == 0 {
+		config.CacheTTL = 60
+	}
+
+	f, err := newFilter(name, config)
+	if err != nil {
+		t.Fatalf("newFilter(%#v) error: %v", name, err)
+	}
+	return f.(*Filter)
+}
+
+// testUsers returns the Basic users of a Config, all of the password
+// "secret".
+func testUsers(names ...string) []struct {
+	Username string
+	Password string
+} {
+	users := make([]struct {
+		Username string
+		Password string
+	}, 0, len(names))
+	for _, name := range names {
+		users = append(users, struct {
+			Username string
+			Password string
+		}{name, "secret"})
+	}
+	return users
+}
+
+func basicToken(user, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+}
+
+func TestCheckHash(t *testing.T) {
+	for hash, ok := range map[string]bool{
+		testBcrypt:       true,
+		testSHA:          true,
+		"secret":         true,
+		"":               true,
+		"$2a$10$short":   false,
+		"{SHA}secret":    false,
+		"{SHA}c2VjcmV0":  false,
+		"$apr1$xyz$abc":  false,
+		"$1$salt$hash":   false,
+		"$5$salt$hash":   false,
+		"$6$rounds$hash": false,
+	} {
+		if err := checkHash(hash); (err == nil) != ok {
+			t.Errorf("checkHash(%#v) = %v, want ok=%v", hash, err, ok)
+		}
+	}
+}
+
+func TestParseUserFile(t *testing.T) {
+	data := strings.Join([]string{
+		"# comment",
+		"",
+		"alice:" + testBcrypt,
+		"bob:" + testSHA,
+		"carol:" + testRealm + ":" + testHA1,
+		"carol:" + testSHA,
+		"dave:other:" + testHA1,
+		"erin:$apr1$xyz$abc",
+		"frank:" + testRealm + ":not-hex",
+		":nobody",
+		"a:b:c:d",
+	}, "\n")
+
+	users := map[string]*credential{
+		"alice": {hash: "builtin"},
+	}
+	errs := parseUserFile(strings.NewReader(data), testRealm, users)
+
+	if len(errs) != 4 {
+		t.Errorf("parseUserFile() errors = %v, want 4 of them", errs)
+	}
+
+	for user, want := range map[string]*credential{
+		"alice": {hash: testBcrypt},
+		"bob":   {hash: testSHA},
+		"carol": {hash: testSHA, ha1: testHA1},
+	} {
+		if c := users[user]; c == nil || *c != *want {
+			t.Errorf("users[%#v] = %+v, want %+v", user, c, want)
+		}
+	}
+
+	// the htdigest lines of the other realms and the invalid lines are skipped
+	for _, user := range []string{"dave", "erin", "frank", ""} {
+		if c, ok := users[user]; ok {
+			t.Errorf("users[%#v] = %+v, want none", user, c)
+		}
+	}
+}
+
+func TestCredentialVerify(t *testing.T) {
+	testCases := []struct {
+		name     string
+		c        credential
+		password string
+		want     bool
+	}{
+		{"bcrypt", credential{hash: testBcrypt}, "secret", true},
+		{"bcrypt wrong", credential{hash: testBcrypt}, "Secret", false},
+		{"sha", credential{hash: testSHA}, "secret", true},
+		{"sha wrong", credential{hash: testSHA}, "secret ", false},
+		{"plain", credential{hash: "secret", ha1: testHA1}, "secret", true},
+		{"plain wrong", credential{hash: "secret", ha1: testHA1}, "", false},
+		{"ha1", credential{ha1: testHA1}, "secret", true},
+		{"ha1 wrong", credential{ha1: testHA1}, "guess", false},
+		{"none", credential{}, "", false},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.c.verify("carol", testRealm, tc.password); got != tc.want {
+			t.Errorf("%s: verify(%#v) = %v, want %v", tc.name, tc.password, got, tc.want)
+		}
+	}
+
+	if ha1 := digestHA1("carol", testRealm, "secret"); ha1 != testHA1 {
+		t.Errorf("digestHA1() = %#v, want %#v", ha1, testHA1)
+	}
+}
+
+// nonceAt returns a nonce of f issued at t.
+func nonceAt(f *Filter, t time.Time) string {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.Unix()))
+
+	mac := hmac.New(sha256.New, f.nonceKey)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(b))
+}
+
+func TestAuthenticateDigest(t *testing.T) {
+	f := newTestFilter(t, "auth", &Config{Digest: true, Basic: testUsers("carol")})
+
+	const uri = "example.org:443"
+	nonce := f.newNonce()
+	ha2 := md5Hex(http.MethodConnect + ":" + uri)
+
+	badMAC := []byte(nonce)
+	if badMAC[len(badMAC)-1] == '0' {
+		badMAC[len(badMAC)-1] = '1'
+	} else {
+		badMAC[len(badMAC)-1] = '0'
+	}
+
+	digest := func(user, uri, nonce, qop, response string) string {
+		s := fmt.Sprintf(`username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`, user, testRealm, nonce, uri, response)
+		if qop != "" {
+			s += fmt.Sprintf(`, qop=%s, nc=00000001, cnonce="0a4f113b"`, qop)
+		}
+		return s
+	}
+	withQop := func(nonce string) string {
+		return md5Hex(strings.Join([]string{testHA1, nonce, "00000001", "0a4f113b", "auth", ha2}, ":"))
+	}
+	rfc2069 := func(nonce string) string {
+		return md5Hex(testHA1 + ":" + nonce + ":" + ha2)
+	}
+	stale := nonceAt(f, time.Now().Add(-time.Hour))
+
+	testCases := []struct {
+		name   string
+		params string
+		err    error
+	}{
+		{"qop auth", digest("carol", uri, nonce, "auth", withQop(nonce)), nil},
+		{"rfc 2069", digest("carol", uri, nonce, "", rfc2069(nonce)), nil},
+		{"wrong password", digest("carol", uri, nonce, "auth", md5Hex("carol:guess")), errBadCredentials},
+		{"unknown user", digest("mallory", uri, nonce, "auth", withQop(nonce)), errBadCredentials},
+		{"uri mismatch", digest("carol", "example.com:443", nonce, "auth", withQop(nonce)), errBadCredentials},
+		{"stale nonce", digest("carol", uri, stale, "auth", withQop(stale)), errStaleNonce},
+		{"bad hmac", digest("carol", uri, string(badMAC), "auth", withQop(string(badMAC))), errBadCredentials},
+		{"unknown qop", digest("carol", uri, nonce, "auth-int", withQop(nonce)), errBadCredentials},
+	}
+
+	for _, tc := range testCases {
+		req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Host: uri}, Host: uri, RequestURI: uri, Header: http.Header{}}
+		user, err := f.authenticateDigest(req, tc.params)
+		if err != tc.err {
+			t.Errorf("%s: authenticateDigest() error = %v, want %v", tc.name, err, tc.err)
+		}
+		if err == nil && user != "carol" {
+			t.Errorf("%s: authenticateDigest() user = %#v, want carol", tc.name, user)
+		}
+	}
+}
+
+func TestDigestReplay(t *testing.T) {
+	f := newTestFilter(t, "auth", &Config{Digest: true, Basic: testUsers("carol")})
+
+	const uri = "example.org:443"
+	ha2 := md5Hex(http.MethodConnect + ":" + uri)
+	one, two := f.newNonce(), nonceAt(f, time.Now().Add(-time.Second))
+
+	authenticate := func(nonce, nc string) error {
+		response := md5Hex(strings.Join([]string{testHA1, nonce, nc, "0a4f113b", "auth", ha2}, ":"))
+		params := fmt.Sprintf(`username="carol", realm="%s", nonce="%s", uri="%s", qop=auth, nc=%s, cnonce="0a4f113b", response="%s"`, testRealm, nonce, uri, nc, response)
+		req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Host: uri}, Host: uri, RequestURI: uri, Header: http.Header{}}
+		_, err := f.authenticateDigest(req, params)
+		return err
+	}
+
+	for _, c := range []struct {
+		name  string
+		nonce string
+		nc    string
+		err   error
+	}{
+		{"the 1st request", one, "00000001", nil},
+		{"a replay", one, "00000001", errStaleNonce},
+		{"the 2nd request", one, "00000002", nil},
+		{"a reordered request", one, "00000001", errStaleNonce},
+		{"a skipped nc", one, "0000000a", nil},
+		{"the 1st request of another nonce", two, "00000001", nil},
+		{"a replay of another nonce", two, "00000001", errStaleNonce},
+		{"a bad nc", one, "zz", errBadCredentials},
+	} {
+		if err := authenticate(c.nonce, c.nc); err != c.err {
+			t.Errorf("%s: authenticateDigest() error = %v, want %v", c.name, err, c.err)
+		}
+	}
+
+	// the nonces used before NonceTTL are dropped
+	f.nonces.mu.Lock()
+	f.nonces.counts[one].used = time.Now().Add(-2 * f.nonceTTL)
+	f.nonces.pruned = time.Now().Add(-2 * f.nonceTTL)
+	f.nonces.mu.Unlock()
+	if err := authenticate(two, "00000002"); err != nil {
+		t.Errorf("authenticateDigest() error = %v", err)
+	}
+	f.nonces.mu.Lock()
+	_, ok := f.nonces.counts[one]
+	n := len(f.nonces.counts)
+	f.nonces.mu.Unlock()
+	if ok || n != 1 {
+		t.Errorf("the nc of the nonce used before NonceTTL is kept, %d nonces", n)
+	}
+}
+
+func TestBasicCacheUserFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "auth.htpasswd")
+	if err := ioutil.WriteFile(filename, []byte("bob:"+testBcrypt+"\n"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile() error: %v", err)
+	}
+
+	f := newTestFilter(t, "auth", &Config{})
+	if f.Users, err = NewUsers(nil, &storage.FileStore{Dirname: dir}, "auth.htpasswd", testRealm); err != nil {
+		t.Fatalf("NewUsers() error: %v", err)
+	}
+
+	token := basicToken("bob", "secret")
+	for i := 0; i < 2; i++ {
+		if user, err := f.authenticateBasic(token); err != nil || user != "bob" {
+			t.Fatalf("authenticateBasic() = %#v, %v, want bob", user, err)
+		}
+	}
+	sum := sha256.Sum256([]byte(token))
+	if _, ok := f.AuthCache.GetNotStale(hex.EncodeToString(sum[:])); !ok {
+		t.Fatalf("the credentials of bob are not cached")
+	}
+
+	// the password of bob is changed, the cached one is no longer good
+	if err := ioutil.WriteFile(filename, []byte("bob:changed\nalice:"+testSHA+"\n"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile() error: %v", err)
+	}
+	f.Users.mu.Lock()
+	f.Users.checked = time.Time{}
+	f.Users.mu.Unlock()
+
+	if user, err := f.authenticateBasic(token); err != errBadCredentials {
+		t.Errorf("authenticateBasic() of the old password = %#v, %v, want %v", user, err, errBadCredentials)
+	}
+	if user, err := f.authenticateBasic(basicToken("bob", "changed")); err != nil || user != "bob" {
+		t.Errorf("authenticateBasic() of the new password = %#v, %v, want bob", user, err)
+	}
+	if _, gen := f.Users.lookup("bob"); gen != 2 {
+		t.Errorf("generation = %d, want 2", gen)
+	}
+
+	// bob is removed
+	if err := ioutil.WriteFile(filename, []byte("alice:"+testSHA+"\n"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile() error: %v", err)
+	}
+	f.Users.mu.Lock()
+	f.Users.checked = time.Time{}
+	f.Users.mu.Unlock()
+
+	if user, err := f.authenticateBasic(basicToken("bob", "changed")); err != errBadCredentials {
+		t.Errorf("authenticateBasic() of the removed bob = %#v, %v, want %v", user, err, errBadCredentials)
+	}
+}
+
+func TestTunnelUser(t *testing.T) {
+	a := newTestFilter(t, "auth@a", &Config{Basic: testUsers("bob")})
+	b := newTestFilter(t, "auth@b", &Config{Basic: testUsers("bob")})
+	c := newTestFilter(t, "auth@c", &Config{Basic: testUsers("carol")})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// the CONNECT authenticated by a
+	ctx := filters.NewContext(context.Background(), nil, nil, nil, "")
+	req := &http.Request{Method: http.MethodConnect, Host: "example.org:443", Header: http.Header{}, RemoteAddr: "10.0.0.1:1234"}
+	req.Header.Set("Proxy-Authorization", "Basic "+basicToken("bob", "secret"))
+	if r := a.authenticate(req.WithContext(ctx)); r.err != nil || r.user != "bob" {
+		t.Fatalf("authenticate(CONNECT) = %+v, want bob", r)
+	}
+	filters.SetUser(ctx, a.FilterName(), "bob")
+	tunnel := filters.ServeTunnel(ctx, server)
+
+	// a request read from the tunnel, e.g. by stripssl, and from another
+	// connection of the same address
+	fromTunnel := filters.NewContext(context.Background(), nil, nil, nil, "")
+	filters.SetConn(fromTunnel, helpers.NewCountingConn(tunnel))
+	other := filters.NewContext(context.Background(), nil, nil, nil, "")
+	filters.SetConn(other, client)
+
+	testCases := []struct {
+		name string
+		f    *Filter
+		ctx  context.Context
+		user string
+	}{
+		{"same filter", a, fromTunnel, "bob"},
+		{"other instance", b, fromTunnel, ""},
+		{"unknown user", c, fromTunnel, ""},
+		{"other conn", a, other, ""},
+		{"no conn", a, context.Background(), ""},
+	}
+
+	for _, tc := range testCases {
+		req := &http.Request{Method: http.MethodGet, Host: "example.org", Header: http.Header{}, RemoteAddr: "10.0.0.1:1234"}
+		r := tc.f.authenticate(req.WithContext(tc.ctx))
+		switch {
+		case tc.user != "" && (r.err != nil || r.user != tc.user):
+			t.Errorf("%s: authenticate() = %+v, want %s", tc.name, r, tc.user)
+		case tc.user == "" && r.err != errNoCredentials:
+			t.Errorf("%s: authenticate() = %+v, want %v", tc.name, r, errNoCredentials)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/xuiv/goproxy/httpproxy/storage"
+)
+
+const (
+	// userFileCheckInterval is how often the user file is checked for
+	// changes, the checks are made by the requests.
+	userFileCheckInterval = 5 * time.Second
+)
+
+// credential is what a user is authenticated against. hash is a bcrypt hash,
+// a "{SHA}" hash of htpasswd or a plain password, ha1 is the MD5 of
+// "user:realm:password" which Digest needs, it is known for the plain
+// passwords and the htdigest lines only.
+type credential struct {
+	hash string
+	ha1  string
+}
+
+func (c *credential) verify(user, realm, password string) bool {
+	switch {
+	case strings.HasPrefix(c.hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(c.hash), []byte(password)) == nil
+	case strings.HasPrefix(c.hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(c.hash[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	case c.hash != "":
+		return subtle.ConstantTimeCompare([]byte(c.hash), []byte(password)) == 1
+	case c.ha1 != "":
+		return subtle.ConstantTimeCompare([]byte(c.ha1), []byte(digestHA1(user, realm, password))) == 1
+	default:
+		return false
+	}
+}
+
+// checkHash returns an error if hash looks like a hash of htpasswd which is
+// not supported, the others are plain passwords.
+func checkHash(hash string) error {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err
+	case strings.HasPrefix(hash, "{SHA}"):
+		if b, err := base64.StdEncoding.DecodeString(hash[5:]); err != nil || len(b) != sha1.Size {
+			return fmt.Errorf("invalid {SHA} hash")
+		}
+	case strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "$1$"), strings.HasPrefix(hash, "$5$"), strings.HasPrefix(hash, "$6$"):
+		return fmt.Errorf("unsupported hash %#v, use bcrypt or {SHA}", hash[:strings.IndexByte(hash[1:], '$')+2])
+	}
+	return nil
+}
+
+func digestHA1(user, realm, password string) string {
+	return md5Hex(user + ":" + realm + ":" + password)
+}
+
+// parseUserFile parses the lines of an htpasswd file, "user:hash", and of an
+// htdigest file, "user:realm:ha1", into users, a user may have both lines.
+// The htdigest lines of the other realms are skipped.
+func parseUserFile(r io.Reader, realm string, users map[string]*credential) []error {
+	var errs []error
+	seen := make(map[string]*credential)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Split(line, ":")
+		if parts[0] == "" || len(parts) > 3 {
+			errs = append(errs, fmt.Errorf("line %d: invalid user line", n))
+			continue
+		}
+
+		// the file replaces the built-in user of the same name
+		c, ok := seen[parts[0]]
+		if !ok {
+			c = &credential{}
+		}
+
+		switch len(parts) {
+		case 2:
+			if err := checkHash(parts[1]); err != nil {
+				errs = append(errs, fmt.Errorf("line %d: %v", n, err))
+				continue
+			}
+			c.hash = parts[1]
+		case 3:
+			if b, err := hex.DecodeString(parts[2]); err != nil || len(b) != md5.Size {
+				errs = append(errs, fmt.Errorf("line %d: invalid htdigest hash", n))
+				continue
+			}
+			if parts[1] != realm {
+				continue
+			}
+			c.ha1 = strings.ToLower(parts[2])
+		default:
+			errs = append(errs, fmt.Errorf("line %d: invalid user line", n))
+			continue
+		}
+
+		seen[parts[0]] = c
+		users[parts[0]] = c
+	}
+
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
+// Users is the users of auth.json and of the user file, the user file is
+// reloaded once it changes.
+type Users struct {
+	Store    storage.Store
+	Filename string
+	Realm    string
+
+	builtin map[string]*credential
+
+	mu      sync.RWMutex
+	users   map[string]*credential
+	gen     uint64
+	stamp   string
+	checked time.Time
+}
+
+// NewUsers returns the Users of the built-in users, a map of the names to
+// the passwords or the hashes, and of the user file filename of store.
+func NewUsers(builtin map[string]string, store storage.Store, filename, realm string) (*Users, error) {
+	u := &Users{
+		Store:    store,
+		Filename: filename,
+		Realm:    realm,
+		builtin:  make(map[string]*credential),
+	}
+
+	for user, password := range builtin {
+		if err := checkHash(password); err != nil {
+			return nil, fmt.Errorf("user %#v: %v", user, err)
+		}
+		c := &credential{hash: password}
+		if !strings.HasPrefix(password, "$2") && !strings.HasPrefix(password, "{SHA}") {
+			c.ha1 = digestHA1(user, realm, password)
+		}
+		u.builtin[user] = c
+	}
+
+	if err := u.reload(); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// lookup returns the credential of user and the generation of the users,
+// which changes with every reload.
+func (u *Users) lookup(user string) (*credential, uint64) {
+	if u.Filename != "" {
+		// one of the concurrent requests checks the file
+		u.mu.Lock()
+		stale := time.Since(u.checked) > userFileCheckInterval
+		if stale {
+			u.checked = time.Now()
+		}
+		u.mu.Unlock()
+
+		if stale {
+			if err := u.reload(); err != nil {
+				glog.Warningf("AUTH: reload %#v error: %v, keep the old users", u.Filename, err)
+			}
+		}
+	}
+
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.users[user], u.gen
+}
+
+// reload reads the user file if it is changed since the last read.
+func (u *Users) reload() error {
+	users := make(map[string]*credential, len(u.builtin))
+	for user, c := range u.builtin {
+		c1 := *c
+		users[user] = &c1
+	}
+
+	var stamp string
+	if u.Filename != "" {
+		resp, err := u.Store.Head(u.Filename)
+		if err != nil {
+			return err
+		}
+		stamp = fmt.Sprintf("%s %d", resp.Header.Get("Last-Modified"), resp.ContentLength)
+
+		u.mu.RLock()
+		unchanged := u.users != nil && stamp == u.stamp
+		u.mu.RUnlock()
+		if unchanged {
+			return nil
+		}
+
+		resp, err = u.Store.Get(u.Filename)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		for _, err := range parseUserFile(resp.Body, u.Realm, users) {
+			glog.Warningf("AUTH: %s: %v", u.Filename, err)
+		}
+		glog.V(2).Infof("AUTH: load %d users from %#v", len(users), u.Filename)
+	}
+
+	u.mu.Lock()
+	u.users = users
+	u.gen++
+	u.stamp = stamp
+	u.checked = time.Now()
+	u.mu.Unlock()
+
+	return nil
+}
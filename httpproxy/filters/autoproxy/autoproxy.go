@@ -2,11 +2,13 @@ package autoproxy
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"mime"
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -56,7 +58,7 @@ type Config struct {
 	}
 	IPHTML struct {
 		Enabled   bool
-		WhiteList []string
+		WhiteList []string // ips, CIDRs and ranges which may post ip.html
 	}
 	BlackList struct {
 		Enabled   bool
@@ -64,9 +66,85 @@ type Config struct {
 	}
 }
 
-var (
-	onceUpdater sync.Once
-)
+// Validate checks the filters named by the enabled rules, which must be
+// RoundTripFilters, and the remote dns server of RegionFilters.
+func (c *Config) Validate() []error {
+	errs := make([]error, 0)
+
+	check := func(key, name string) {
+		schema, ok := filters.LookupSchema(name)
+		if !ok {
+			errs = append(errs, &storage.ConfigError{Key: key, Err: fmt.Errorf("unknown filter %#v", name)})
+		} else if _, ok := schema.Prototype.(filters.RoundTripFilter); !ok {
+			errs = append(errs, &storage.ConfigError{Key: key, Err: fmt.Errorf("%#v is not a RoundTripFilter", name)})
+		}
+	}
+
+	if c.SiteFilters.Enabled {
+		for _, host := range sortedKeys(c.SiteFilters.Rules) {
+			check(fmt.Sprintf("SiteFilters.Rules[%q]", host), c.SiteFilters.Rules[host])
+		}
+	}
+
+	if c.RegionFilters.Enabled {
+		if c.RegionFilters.EnableRemoteDNS && net.ParseIP(c.RegionFilters.DNSServer) == nil {
+			errs = append(errs, &storage.ConfigError{Key: "RegionFilters.DNSServer", Err: fmt.Errorf("%#v is not an ip address", c.RegionFilters.DNSServer)})
+		}
+		for _, region := range sortedKeys(c.RegionFilters.Rules) {
+			if name := c.RegionFilters.Rules[region]; name != "" {
+				check(fmt.Sprintf("RegionFilters.Rules[%q]", region), name)
+			}
+		}
+		for _, ip := range sortedKeys(c.RegionFilters.IPRules) {
+			if name := c.RegionFilters.IPRules[ip]; name != "" {
+				check(fmt.Sprintf("RegionFilters.IPRules[%q]", ip), name)
+			}
+		}
+	}
+
+	if _, err := url.Parse(c.GFWList.URL); err != nil {
+		errs = append(errs, &storage.ConfigError{Key: "GFWList.URL", Err: err})
+	}
+
+	if c.IPHTML.Enabled {
+		for i, ip := range c.IPHTML.WhiteList {
+			if _, err := helpers.NewIPMatcher([]string{ip}); err != nil {
+				errs = append(errs, &storage.ConfigError{Key: fmt.Sprintf("IPHTML.WhiteList[%d]", i), Err: err})
+			}
+		}
+	}
+
+	return errs
+}
+
+// ReferencedFilters returns the filters named by the enabled rules.
+func (c *Config) ReferencedFilters() []string {
+	var names []string
+	if c.SiteFilters.Enabled {
+		for _, host := range sortedKeys(c.SiteFilters.Rules) {
+			names = append(names, c.SiteFilters.Rules[host])
+		}
+	}
+	if c.RegionFilters.Enabled {
+		for _, rules := range []map[string]string{c.RegionFilters.Rules, c.RegionFilters.IPRules} {
+			for _, key := range sortedKeys(rules) {
+				if name := rules[key]; name != "" {
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	return names
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
 
 type GFWList struct {
 	URL      *url.URL
@@ -78,6 +156,7 @@ type GFWList struct {
 
 type Filter struct {
 	Config
+	name                 string
 	Store                storage.Store
 	IndexFilesEnabled    bool
 	IndexServerName      string
@@ -88,37 +167,53 @@ type Filter struct {
 	GFWList              *GFWList
 	MobileConfigEnabled  bool
 	IPHTMLEnabled        bool
-	IPHTMLWhiteList      *helpers.HostMatcher
+	IPHTMLWhiteList      *helpers.IPMatcher
 	BlackListEnabled     bool
 	BlackListSiteMatcher *helpers.HostMatcher
 	SiteFiltersEnabled   bool
 	SiteFiltersRules     *helpers.HostMatcher
 	RegionFiltersEnabled bool
-	RegionFiltersRules   map[string]filters.RoundTripFilter
-	RegionFiltersIPRules map[string]filters.RoundTripFilter
+	RegionFiltersRules   map[string]string
+	RegionFiltersIPRules map[string]string
 	RegionResolver       *helpers.Resolver
 	RegionLocator        *ip17mon.Locator
 	RegionFilterCache    lrucache.Cache
 	Transport            *http.Transport
+	closeOnce            sync.Once
 }
 
 func init() {
 	mime.AddExtensionType(".crt", "application/x-x509-ca-cert")
 	mime.AddExtensionType(".mobileconfig", "application/x-apple-aspen-config")
 
-	filters.Register(filterName, func() (filters.Filter, error) {
-		filename := filterName + ".json"
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
+		filename := name + ".json"
 		config := new(Config)
 		err := storage.LookupStoreByFilterName(filterName).UnmarshallJson(filename, config)
 		if err != nil {
-			glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			glog.Errorf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			return nil, err
 		}
 
-		return NewFilter(config)
+		return newFilter(name, config, storage.LookupStoreByFilterName(filterName))
+	})
+	filters.RegisterSchema(filterName, filters.Schema{
+		NewConfig: func() interface{} { return new(Config) },
+		Prototype: (*Filter)(nil),
 	})
 }
 
-func NewFilter(config *Config) (_ filters.Filter, err error) {
+func NewFilter(config *Config) (filters.Filter, error) {
+	return NewFilterWithStore(config, storage.LookupStoreByFilterName(filterName))
+}
+
+// NewFilterWithStore creates an autoproxy filter which reads the gfwlist,
+// the region data and the index files from store.
+func NewFilterWithStore(config *Config, store storage.Store) (filters.Filter, error) {
+	return newFilter(filterName, config, store)
+}
+
+func newFilter(name string, config *Config, store storage.Store) (_ filters.Filter, err error) {
 	var gfwlist GFWList
 
 	gfwlist.Encoding = config.GFWList.Encoding
@@ -130,11 +225,6 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 		return nil, err
 	}
 
-	store := storage.LookupStoreByFilterName(filterName)
-	if err != nil {
-		return nil, err
-	}
-
 	if _, err := store.Head(gfwlist.Filename); err != nil {
 		return nil, err
 	}
@@ -143,6 +233,7 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 
 	f := &Filter{
 		Config:               *config,
+		name:                 name,
 		Store:                store,
 		IndexFilesEnabled:    config.IndexFiles.Enabled,
 		IndexServerName:      config.IndexFiles.ServerName,
@@ -165,20 +256,18 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 	}
 
 	if f.IPHTMLEnabled {
-		f.IPHTMLWhiteList = helpers.NewHostMatcher(config.IPHTML.WhiteList)
+		if f.IPHTMLWhiteList, err = helpers.NewIPMatcher(config.IPHTML.WhiteList); err != nil {
+			return nil, fmt.Errorf("AUTOPROXY: IPHTML.WhiteList: %v", err)
+		}
 	}
 
 	if f.SiteFiltersEnabled {
 		fm := make(map[string]interface{})
 		for host, name := range config.SiteFilters.Rules {
-			f, err := filters.GetFilter(name)
-			if err != nil {
-				glog.Fatalf("AUTOPROXY: filters.GetFilter(%#v) for %#v error: %v", name, host, err)
-			}
-			if _, ok := f.(filters.RoundTripFilter); !ok {
-				glog.Fatalf("AUTOPROXY: filters.GetFilter(%#v) return %T, not a RoundTripFilter", name, f)
+			if _, err := roundTripFilter(name); err != nil {
+				return nil, fmt.Errorf("AUTOPROXY: SiteFilters rule %#v error: %v", host, err)
 			}
-			fm[host] = f
+			fm[host] = name
 		}
 		f.SiteFiltersRules = helpers.NewHostMatcherWithValue(fm)
 	}
@@ -186,13 +275,13 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 	if f.RegionFiltersEnabled {
 		resp, err := store.Get(f.Config.RegionFilters.DataFile)
 		if err != nil {
-			glog.Fatalf("AUTOPROXY: store.Get(%#v) error: %v", f.Config.RegionFilters.DataFile, err)
+			return nil, fmt.Errorf("AUTOPROXY: store.Get(%#v) error: %v", f.Config.RegionFilters.DataFile, err)
 		}
 		defer resp.Body.Close()
 
 		data, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			glog.Fatalf("AUTOPROXY: ioutil.ReadAll(%#v) error: %v", resp.Body, err)
+			return nil, fmt.Errorf("AUTOPROXY: ioutil.ReadAll(%#v) error: %v", resp.Body, err)
 		}
 
 		f.RegionLocator = ip17mon.NewLocatorWithData(data)
@@ -201,42 +290,30 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 		if config.RegionFilters.EnableRemoteDNS {
 			f.RegionResolver.DNSServer = net.ParseIP(config.RegionFilters.DNSServer)
 			if f.RegionResolver.DNSServer == nil {
-				glog.Fatalf("AUTOPROXY: net.ParseIP(%+v) failed", config.RegionFilters.DNSServer)
+				return nil, fmt.Errorf("AUTOPROXY: net.ParseIP(%+v) failed", config.RegionFilters.DNSServer)
 			}
 		}
 
-		fm := make(map[string]filters.RoundTripFilter)
+		fm := make(map[string]string)
 		for region, name := range config.RegionFilters.Rules {
 			if name == "" {
 				continue
 			}
-			f, err := filters.GetFilter(name)
-			if err != nil {
-				glog.Fatalf("AUTOPROXY: filters.GetFilter(%#v) for %#v error: %v", name, region, err)
+			if _, err := roundTripFilter(name); err != nil {
+				return nil, fmt.Errorf("AUTOPROXY: RegionFilters rule %#v error: %v", region, err)
 			}
-			f1, ok := f.(filters.RoundTripFilter)
-			if !ok {
-				glog.Fatalf("AUTOPROXY: filters.GetFilter(%#v) return %T, not a RoundTripFilter", name, f)
-			}
-			fm[strings.ToLower(region)] = f1
+			fm[strings.ToLower(region)] = name
 		}
 		f.RegionFiltersRules = fm
 
-		fm = make(map[string]filters.RoundTripFilter)
+		fm = make(map[string]string)
 		for ip, name := range config.RegionFilters.IPRules {
-			if name == "" {
-				fm[ip] = nil
-				continue
-			}
-			f, err := filters.GetFilter(name)
-			if err != nil {
-				glog.Fatalf("AUTOPROXY: filters.GetFilter(%#v) for %#v error: %v", name, ip, err)
-			}
-			f1, ok := f.(filters.RoundTripFilter)
-			if !ok {
-				glog.Fatalf("AUTOPROXY: filters.GetFilter(%#v) return %T, not a RoundTripFilter", name, f)
+			if name != "" {
+				if _, err := roundTripFilter(name); err != nil {
+					return nil, fmt.Errorf("AUTOPROXY: RegionFilters IPRule %#v error: %v", ip, err)
+				}
 			}
-			fm[ip] = f1
+			fm[ip] = name
 		}
 		f.RegionFiltersIPRules = fm
 
@@ -244,14 +321,68 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 	}
 
 	if f.GFWListEnabled {
-		go onceUpdater.Do(f.pacUpdater)
+		startPacUpdater(f)
 	}
 
 	return f, nil
 }
 
 func (f *Filter) FilterName() string {
-	return filterName
+	return f.name
+}
+
+// Close leaves the gfwlist updater of the filter, which is stopped once no
+// filter is using it.
+func (f *Filter) Close() error {
+	f.closeOnce.Do(func() {
+		if f.GFWListEnabled {
+			stopPacUpdater(f)
+		}
+	})
+	return nil
+}
+
+// roundTripFilter looks up the rule target by name, the targets are not held
+// by the filter so that the ones swapped in by Staged.Commit of a reload are
+// picked up.
+func roundTripFilter(name string) (filters.RoundTripFilter, error) {
+	f, err := filters.GetFilter(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f1, ok := f.(filters.RoundTripFilter)
+	if !ok {
+		return nil, fmt.Errorf("filters.GetFilter(%#v) return %T, not a RoundTripFilter", name, f)
+	}
+
+	return f1, nil
+}
+
+// delegate passes req to the filter f picked by the rules, unless the policy
+// of the user does not allow f or the traffic quota of f is used up.
+func delegate(ctx context.Context, f filters.RoundTripFilter, req *http.Request) (context.Context, *http.Response, error) {
+	if !filters.AllowFilter(ctx, f.FilterName()) {
+		return ctx, nil, fmt.Errorf("%w: %s is not allowed", filters.ErrBlocked, f.FilterName())
+	}
+	if err := filters.CheckQuota(ctx, f.FilterName()); err != nil {
+		return ctx, nil, err
+	}
+	return f.RoundTrip(ctx, req)
+}
+
+func setRoundTripFilter(ctx context.Context, name string) {
+	if name == "" {
+		return
+	}
+
+	f1, err := roundTripFilter(name)
+	if err != nil {
+		glog.Warningf("AUTOPROXY: roundTripFilter(%#v) error: %v", name, err)
+		return
+	}
+
+	filters.SetRoundTripFilter(ctx, f1)
 }
 
 func (f *Filter) FindCountryByIP(ip string) (string, error) {
@@ -281,51 +412,57 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 
 	if f.BlackListEnabled {
 		if f.BlackListSiteMatcher.Match(host) {
-			glog.V(2).Infof("%s \"AUTOPROXY BlackList %s %s %s\"", req.RemoteAddr, req.Method, req.URL.String(), req.Proto)
-			return ctx, filters.DummyRequest, nil
+			glog.V(2).Infof("%s \"AUTOPROXY BlackList %s %s %s\"", filters.LogPrefix(req), req.Method, req.URL.String(), req.Proto)
+			filters.SetLogField(ctx, "autoproxy_rule", "BlackList")
+			return ctx, nil, fmt.Errorf("%w: %s is in the autoproxy blacklist", filters.ErrBlocked, host)
 		}
 	}
 
 	if f.SiteFiltersEnabled {
-		if f1, ok := f.SiteFiltersRules.Lookup(host); ok {
-			glog.V(2).Infof("%s \"AUTOPROXY SiteFilters %s %s %s\" with %T", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, f1)
-			filters.SetRoundTripFilter(ctx, f1.(filters.RoundTripFilter))
+		if name, ok := f.SiteFiltersRules.Lookup(host); ok {
+			glog.V(2).Infof("%s \"AUTOPROXY SiteFilters %s %s %s\" with %s", filters.LogPrefix(req), req.Method, req.URL.String(), req.Proto, name)
+			filters.SetLogField(ctx, "autoproxy_rule", "SiteFilters")
+			setRoundTripFilter(ctx, name.(string))
 			return ctx, req, nil
 		}
 	}
 
 	if f.RegionFiltersEnabled {
-		if f1, ok := f.RegionFilterCache.Get(host); ok {
-			if f1 != nil {
-				filters.SetRoundTripFilter(ctx, f1.(filters.RoundTripFilter))
-			}
+		if name, ok := f.RegionFilterCache.Get(host); ok {
+			filters.SetLogField(ctx, "autoproxy_rule", "RegionFilters")
+			setRoundTripFilter(ctx, name.(string))
 		} else if ips, err := f.RegionResolver.LookupIP(host); err == nil && len(ips) > 0 {
 			ip := ips[0]
 
 			if ip.IsLoopback() && !(strings.Contains(host, ".local") || strings.Contains(host, "localhost.")) {
-				glog.V(2).Infof("%s \"AUTOPROXY RegionFilters BYPASS Loopback %s %s %s\" with nil", req.RemoteAddr, req.Method, req.URL.String(), req.Proto)
-				f.RegionFilterCache.Set(host, nil, time.Now().Add(time.Hour))
+				glog.V(2).Infof("%s \"AUTOPROXY RegionFilters BYPASS Loopback %s %s %s\" with nil", filters.LogPrefix(req), req.Method, req.URL.String(), req.Proto)
+				f.RegionFilterCache.Set(host, "", time.Now().Add(time.Hour))
+				filters.SetLogField(ctx, "autoproxy_rule", "RegionFilters:Loopback")
 			} else if ip.To4() == nil {
-				if f1, ok := f.RegionFiltersRules["ipv6"]; ok {
-					glog.V(2).Infof("%s \"AUTOPROXY RegionFilters IPv6 %s %s %s\" with %T", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, f1)
-					f.RegionFilterCache.Set(host, f1, time.Now().Add(time.Hour))
-					filters.SetRoundTripFilter(ctx, f1)
+				if name, ok := f.RegionFiltersRules["ipv6"]; ok {
+					glog.V(2).Infof("%s \"AUTOPROXY RegionFilters IPv6 %s %s %s\" with %s", filters.LogPrefix(req), req.Method, req.URL.String(), req.Proto, name)
+					f.RegionFilterCache.Set(host, name, time.Now().Add(time.Hour))
+					filters.SetLogField(ctx, "autoproxy_rule", "RegionFilters:IPv6")
+					setRoundTripFilter(ctx, name)
 				}
-			} else if f1, ok := f.RegionFiltersIPRules[ip.String()]; ok {
-				glog.V(2).Infof("%s \"AUTOPROXY RegionFilters IPRules %s %s %s\" with %T", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, f1)
-				f.RegionFilterCache.Set(host, f1, time.Now().Add(time.Hour))
-				filters.SetRoundTripFilter(ctx, f1)
+			} else if name, ok := f.RegionFiltersIPRules[ip.String()]; ok {
+				glog.V(2).Infof("%s \"AUTOPROXY RegionFilters IPRules %s %s %s\" with %s", filters.LogPrefix(req), req.Method, req.URL.String(), req.Proto, name)
+				filters.SetLogField(ctx, "autoproxy_rule", "RegionFilters:IPRules")
+				f.RegionFilterCache.Set(host, name, time.Now().Add(time.Hour))
+				setRoundTripFilter(ctx, name)
 			} else if country, err := f.FindCountryByIP(ip.String()); err == nil {
-				if f1, ok := f.RegionFiltersRules[country]; ok {
-					glog.V(2).Infof("%s \"AUTOPROXY RegionFilters %s %s %s %s\" with %T", req.RemoteAddr, country, req.Method, req.URL.String(), req.Proto, f1)
-					f.RegionFilterCache.Set(host, f1, time.Now().Add(time.Hour))
-					filters.SetRoundTripFilter(ctx, f1)
-				} else if f1, ok := f.RegionFiltersRules["default"]; ok {
-					glog.V(2).Infof("%s \"AUTOPROXY RegionFilters Default %s %s %s\" with %T", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, f1)
-					f.RegionFilterCache.Set(host, f1, time.Now().Add(time.Hour))
-					filters.SetRoundTripFilter(ctx, f1)
+				if name, ok := f.RegionFiltersRules[country]; ok {
+					glog.V(2).Infof("%s \"AUTOPROXY RegionFilters %s %s %s %s\" with %s", filters.LogPrefix(req), country, req.Method, req.URL.String(), req.Proto, name)
+					filters.SetLogField(ctx, "autoproxy_rule", "RegionFilters:"+country)
+					f.RegionFilterCache.Set(host, name, time.Now().Add(time.Hour))
+					setRoundTripFilter(ctx, name)
+				} else if name, ok := f.RegionFiltersRules["default"]; ok {
+					glog.V(2).Infof("%s \"AUTOPROXY RegionFilters Default %s %s %s\" with %s", filters.LogPrefix(req), req.Method, req.URL.String(), req.Proto, name)
+					filters.SetLogField(ctx, "autoproxy_rule", "RegionFilters:default")
+					f.RegionFilterCache.Set(host, name, time.Now().Add(time.Hour))
+					setRoundTripFilter(ctx, name)
 				} else {
-					f.RegionFilterCache.Set(host, nil, time.Now().Add(time.Hour))
+					f.RegionFilterCache.Set(host, "", time.Now().Add(time.Hour))
 				}
 			}
 		}
@@ -336,17 +473,21 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 
 func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
 	if f := filters.GetRoundTripFilter(ctx); f != nil {
-		return f.RoundTrip(ctx, req)
+		return delegate(ctx, f, req)
 	}
 
 	switch {
 	case f.SiteFiltersEnabled && req.URL.Scheme == "https":
-		if f1, ok := f.SiteFiltersRules.Lookup(helpers.GetHostName(req)); ok && f1 != nil {
-			return f1.(filters.RoundTripFilter).RoundTrip(ctx, req)
+		if name, ok := f.SiteFiltersRules.Lookup(helpers.GetHostName(req)); ok {
+			if f1, err := roundTripFilter(name.(string)); err == nil {
+				return delegate(ctx, f1, req)
+			}
 		}
 	case f.RegionFiltersEnabled && req.URL.Scheme == "https":
-		if f1, ok := f.RegionFilterCache.Get(helpers.GetHostName(req)); ok && f1 != nil {
-			return f1.(filters.RoundTripFilter).RoundTrip(ctx, req)
+		if name, ok := f.RegionFilterCache.Get(helpers.GetHostName(req)); ok && name.(string) != "" {
+			if f1, err := roundTripFilter(name.(string)); err == nil {
+				return delegate(ctx, f1, req)
+			}
 		}
 	}
 
@@ -355,16 +496,16 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 			if _, ok := f.IndexFilesSet[req.URL.Path[1:]]; ok || req.URL.Path == "/" {
 				switch {
 				case f.GFWListEnabled && strings.HasSuffix(req.URL.Path, ".pac"):
-					glog.V(2).Infof("%s \"AUTOPROXY ProxyPac %s %s %s\" - -", req.RemoteAddr, req.Method, req.RequestURI, req.Proto)
+					glog.V(2).Infof("%s \"AUTOPROXY ProxyPac %s %s %s\" - -", filters.LogPrefix(req), req.Method, req.RequestURI, req.Proto)
 					return f.ProxyPacRoundTrip(ctx, req)
 				case f.MobileConfigEnabled && strings.HasSuffix(req.URL.Path, ".mobileconfig"):
-					glog.V(2).Infof("%s \"AUTOPROXY ProxyMobileConfig %s %s %s\" - -", req.RemoteAddr, req.Method, req.RequestURI, req.Proto)
+					glog.V(2).Infof("%s \"AUTOPROXY ProxyMobileConfig %s %s %s\" - -", filters.LogPrefix(req), req.Method, req.RequestURI, req.Proto)
 					return f.ProxyMobileConfigRoundTrip(ctx, req)
 				case f.IPHTMLEnabled && req.URL.Path == "/ip.html":
-					glog.V(2).Infof("%s \"AUTOPROXY IPHTML %s %s %s\" - -", req.RemoteAddr, req.Method, req.RequestURI, req.Proto)
+					glog.V(2).Infof("%s \"AUTOPROXY IPHTML %s %s %s\" - -", filters.LogPrefix(req), req.Method, req.RequestURI, req.Proto)
 					return f.IPHTMLRoundTrip(ctx, req)
 				default:
-					glog.V(2).Infof("%s \"AUTOPROXY IndexFiles %s %s %s\" - -", req.RemoteAddr, req.Method, req.RequestURI, req.Proto)
+					glog.V(2).Infof("%s \"AUTOPROXY IndexFiles %s %s %s\" - -", filters.LogPrefix(req), req.Method, req.RequestURI, req.Proto)
 					return f.IndexFilesRoundTrip(ctx, req)
 				}
 			}
@@ -15,6 +15,7 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/phuslu/glog"
@@ -148,14 +149,94 @@ function FindProxyForURL(url, host) {
 	return ctx, resp, nil
 }
 
-func (f *Filter) pacUpdater() {
-	// glog.V(2).Infof("start updater for %+v, expiry=%s, duration=%s", f.GFWList.URL.String(), f.GFWList.Expiry, f.GFWList.Duration)
+// pacUpdater downloads a gfwlist file for all the filters reading it, so
+// that the instances of autoproxy and the filters rebuilt by a reload do not
+// each start one. It uses the settings of the latest filter and stops once
+// the last filter is closed.
+type pacUpdater struct {
+	filters []*Filter
+	done    chan struct{}
+}
+
+var (
+	pacUpdatersMu sync.Mutex
+	pacUpdaters   = make(map[string]*pacUpdater)
+)
+
+// startPacUpdater adds f to the updater of its gfwlist file, the updater is
+// started on first use.
+func startPacUpdater(f *Filter) {
+	pacUpdatersMu.Lock()
+	defer pacUpdatersMu.Unlock()
+
+	u := pacUpdaters[f.GFWList.Filename]
+	if u == nil {
+		u = &pacUpdater{done: make(chan struct{})}
+		pacUpdaters[f.GFWList.Filename] = u
+		go u.loop()
+	}
+	u.filters = append(u.filters, f)
+}
+
+// stopPacUpdater removes f from the updater of its gfwlist file, the updater
+// is stopped if f is the last one.
+func stopPacUpdater(f *Filter) {
+	pacUpdatersMu.Lock()
+	defer pacUpdatersMu.Unlock()
+
+	u := pacUpdaters[f.GFWList.Filename]
+	if u == nil {
+		return
+	}
+	for i, f1 := range u.filters {
+		if f1 == f {
+			u.filters = append(u.filters[:i], u.filters[i+1:]...)
+			break
+		}
+	}
+	if len(u.filters) == 0 {
+		close(u.done)
+		delete(pacUpdaters, f.GFWList.Filename)
+	}
+}
 
-	ticker := time.Tick(f.GFWList.Duration)
+// filter returns the latest filter of u, nil if u is stopped.
+func (u *pacUpdater) filter() *Filter {
+	pacUpdatersMu.Lock()
+	defer pacUpdatersMu.Unlock()
 
+	if len(u.filters) == 0 {
+		return nil
+	}
+	return u.filters[len(u.filters)-1]
+}
+
+// clearCaches clears the cached proxy.pac of all the filters of u.
+func (u *pacUpdater) clearCaches() {
+	pacUpdatersMu.Lock()
+	defer pacUpdatersMu.Unlock()
+
+	for _, f := range u.filters {
+		f.ProxyPacCache.Clear()
+	}
+}
+
+func (u *pacUpdater) loop() {
 	for {
+		f := u.filter()
+		if f == nil {
+			return
+		}
+
 		select {
-		case <-ticker:
+		case <-u.done:
+			return
+		case <-time.After(f.GFWList.Duration):
+			f = u.filter()
+			if f == nil {
+				return
+			}
+
 			glog.V(2).Infof("Begin auto gfwlist(%#v) update...", f.GFWList.URL.String())
 			resp, err := f.Store.Head(f.GFWList.Filename)
 			if err != nil {
@@ -221,7 +302,7 @@ func (f *Filter) pacUpdater() {
 			continue
 		}
 
-		f.ProxyPacCache.Clear()
+		u.clearCaches()
 
 		glog.Infof("Update %#v from %#v OK", f.GFWList.Filename, f.GFWList.URL.String())
 		resp.Body.Close()
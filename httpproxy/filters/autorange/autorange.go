@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/phuslu/glog"
@@ -29,33 +30,47 @@ type Config struct {
 
 type Filter struct {
 	Config
+	name           string
 	SiteMatcher    *helpers.HostMatcher
 	SupportFilters map[string]struct{}
 	MaxSize        int
 	BufSize        int
 	Threads        int
+	done           chan struct{}
+	closeOnce      sync.Once
 }
 
 func init() {
-	filters.Register(filterName, func() (filters.Filter, error) {
-		filename := filterName + ".json"
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
+		filename := name + ".json"
 		config := new(Config)
 		err := storage.LookupStoreByFilterName(filterName).UnmarshallJson(filename, config)
 		if err != nil {
-			glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			glog.Errorf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			return nil, err
 		}
-		return NewFilter(config)
+		return newFilter(name, config)
+	})
+	filters.RegisterSchema(filterName, filters.Schema{
+		NewConfig: func() interface{} { return new(Config) },
+		Prototype: (*Filter)(nil),
 	})
 }
 
 func NewFilter(config *Config) (filters.Filter, error) {
+	return newFilter(filterName, config)
+}
+
+func newFilter(name string, config *Config) (filters.Filter, error) {
 	f := &Filter{
 		Config:         *config,
+		name:           name,
 		SiteMatcher:    helpers.NewHostMatcher(config.Sites),
 		SupportFilters: make(map[string]struct{}),
 		MaxSize:        config.MaxSize,
 		BufSize:        config.BufSize,
 		Threads:        config.Threads,
+		done:           make(chan struct{}),
 	}
 
 	for _, name := range config.SupportFilters {
@@ -66,7 +81,15 @@ func NewFilter(config *Config) (filters.Filter, error) {
 }
 
 func (f *Filter) FilterName() string {
-	return filterName
+	return f.name
+}
+
+// Close stops all the background range fetchers of the filter.
+func (f *Filter) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.done)
+	})
+	return nil
 }
 
 func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
@@ -116,7 +139,7 @@ func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Con
 	if f1 == nil {
 		return ctx, resp, nil
 	}
-	if _, ok := f.SupportFilters[f1.FilterName()]; !ok {
+	if !filters.MatchName(f.SupportFilters, f1.FilterName()) {
 		glog.V(2).Infof("AUTORANGE hit a unsupported filter=%#v", f1)
 		return ctx, resp, nil
 	}
@@ -153,10 +176,11 @@ func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Con
 
 	r, w := AutoPipe(f.Threads)
 
-	go func(w *autoPipeWriter, filter filters.RoundTripFilter, req0 *http.Request, start, length int64) {
+	// the range fetches are stopped along with the request of the client
+	go func(ctx context.Context, w *autoPipeWriter, filter filters.RoundTripFilter, req0 *http.Request, start, length int64) {
 		glog.V(2).Infof("AUTORANGE begin rangefetch for %#v by using %#v", req0.URL.String(), filter.FilterName())
 
-		req, err := http.NewRequest(req0.Method, req0.URL.String(), nil)
+		req, err := http.NewRequestWithContext(ctx, req0.Method, req0.URL.String(), nil)
 		if err != nil {
 			glog.Warningf("AUTORANGE http.NewRequest(%#v) error: %#v", req, err)
 			return
@@ -173,6 +197,17 @@ func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Con
 		}
 		var index uint32
 		for {
+			select {
+			case <-f.done:
+				glog.V(2).Infof("AUTORANGE stop rangefetch for %#v", req.URL.String())
+				w.CloseWithError(ErrStoppedPipe)
+				return
+			case <-ctx.Done():
+				glog.V(2).Infof("AUTORANGE cancel rangefetch for %#v: %v", req.URL.String(), ctx.Err())
+				w.CloseWithError(ctx.Err())
+				return
+			default:
+			}
 			if w.FatalErr() {
 				break
 			}
@@ -183,7 +218,7 @@ func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Con
 			}
 			//FIXME: make this configurable!
 			if w.Len() > 128*1024*1024 {
-				time.Sleep(100 * time.Millisecond)
+				helpers.SleepContext(ctx, 100*time.Millisecond)
 				continue
 			}
 
@@ -194,15 +229,22 @@ func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Con
 			}
 			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
 
-			_, resp, err := filter.RoundTrip(nil, req)
+			_, resp, err := filter.RoundTrip(ctx, req)
 			if err != nil {
-				glog.Warningf("AUTORANGE %#v.RoundTrip(%v) error: %#v", filter, req, err)
-				time.Sleep(1 * time.Second)
+				filters.Trace(ctx, "autorange_chunk", "bytes=%d-%d err=%v", start, end, err)
+				if ctx.Err() == nil {
+					glog.Warningf("AUTORANGE %#v.RoundTrip(%v) error: %#v", filter, req, err)
+				}
+				helpers.SleepContext(ctx, 1*time.Second)
 				continue
 			}
+			filters.Trace(ctx, "autorange_chunk", "bytes=%d-%d status=%d", start, end, resp.StatusCode)
 			if resp.StatusCode != http.StatusPartialContent {
+				if resp.Body != nil {
+					resp.Body.Close()
+				}
 				if resp.StatusCode >= http.StatusBadRequest {
-					time.Sleep(1 * time.Second)
+					helpers.SleepContext(ctx, 1*time.Second)
 				}
 				continue
 			}
@@ -224,7 +266,7 @@ func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Con
 			start = end + 1
 			index++
 		}
-	}(w, f1, resp.Request, end+1, length)
+	}(ctx, w, f1, resp.Request, end+1, length)
 
 	resp.Body = helpers.NewMultiReadCloser(resp.Body, r)
 
@@ -8,8 +8,9 @@ import (
 )
 
 var (
-	ErrClosedPipe = errors.New("io: read/write on closed pipe")
-	ErrFailedPipe = errors.New("pipe failed previously")
+	ErrClosedPipe  = errors.New("io: read/write on closed pipe")
+	ErrFailedPipe  = errors.New("pipe failed previously")
+	ErrStoppedPipe = errors.New("pipe stopped by filter")
 )
 
 type autoPipe struct {
@@ -202,9 +203,13 @@ func (p *autoPipe) rclose(err error) {
 }
 
 func (p *autoPipe) wclose() {
+	p.wcloseWithError(io.EOF)
+}
+
+func (p *autoPipe) wcloseWithError(err error) {
 	p.l.Lock()
 	defer p.l.Unlock()
-	p.werr = io.EOF
+	p.werr = err
 	p.rwait.Signal()
 }
 
@@ -308,6 +313,11 @@ func (w *autoPipeWriter) Close() error {
 	return nil
 }
 
+func (w *autoPipeWriter) CloseWithError(err error) error {
+	w.p.wcloseWithError(err)
+	return nil
+}
+
 func (w *autoPipeWriter) FatalErr() bool {
 	return w.p.fatalErr()
 }
@@ -46,25 +46,48 @@ type Config struct {
 	}
 }
 
+// Validate reports the problems of config which NewFilter would fail on.
+func (c *Config) Validate() []error {
+	errs := make([]error, 0)
+	if c.Transport.Proxy.Enabled {
+		if u, err := url.Parse(c.Transport.Proxy.URL); err != nil {
+			errs = append(errs, &storage.ConfigError{Key: "Transport.Proxy.URL", Err: err})
+		} else if u.Scheme == "" || u.Host == "" {
+			errs = append(errs, &storage.ConfigError{Key: "Transport.Proxy.URL", Err: fmt.Errorf("%#v is not a proxy url", c.Transport.Proxy.URL)})
+		}
+	}
+	return errs
+}
+
 type Filter struct {
 	Config
+	name string
 	filters.RoundTripFilter
 	transport *http.Transport
 }
 
 func init() {
-	filters.Register(filterName, func() (filters.Filter, error) {
-		filename := filterName + ".json"
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
+		filename := name + ".json"
 		config := new(Config)
 		err := storage.LookupStoreByFilterName(filterName).UnmarshallJson(filename, config)
 		if err != nil {
-			glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			glog.Errorf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			return nil, err
 		}
-		return NewFilter(config)
+		return newFilter(name, config)
+	})
+	filters.RegisterSchema(filterName, filters.Schema{
+		NewConfig: func() interface{} { return new(Config) },
+		Prototype: (*Filter)(nil),
 	})
 }
 
 func NewFilter(config *Config) (filters.Filter, error) {
+	return newFilter(filterName, config)
+}
+
+func newFilter(name string, config *Config) (filters.Filter, error) {
 	d := &helpers.Dialer{
 		Dialer: &net.Dialer{
 			KeepAlive: time.Duration(config.Transport.Dialer.KeepAlive) * time.Second,
@@ -88,7 +111,8 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	}
 
 	tr := &http.Transport{
-		Dial: d.Dial,
+		Dial:        d.Dial,
+		DialContext: d.DialContext,
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: config.Transport.TLSClientConfig.InsecureSkipVerify,
 			ClientSessionCache: tls.NewLRUClientSessionCache(config.Transport.TLSClientConfig.ClientSessionCacheSize),
@@ -101,21 +125,23 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	if config.Transport.Proxy.Enabled {
 		fixedURL, err := url.Parse(config.Transport.Proxy.URL)
 		if err != nil {
-			glog.Fatalf("url.Parse(%#v) error: %s", config.Transport.Proxy.URL, err)
+			return nil, fmt.Errorf("url.Parse(%#v) error: %s", config.Transport.Proxy.URL, err)
 		}
 
 		switch fixedURL.Scheme {
 		case "http", "https":
 			tr.Proxy = http.ProxyURL(fixedURL)
 			tr.Dial = nil
+			tr.DialContext = nil
 			tr.DialTLS = nil
 		default:
 			dialer, err := proxy.FromURL(fixedURL, d, nil)
 			if err != nil {
-				glog.Fatalf("proxy.FromURL(%#v) error: %s", fixedURL.String(), err)
+				return nil, fmt.Errorf("proxy.FromURL(%#v) error: %s", fixedURL.String(), err)
 			}
 
 			tr.Dial = dialer.Dial
+			tr.DialContext = nil
 			tr.DialTLS = nil
 			tr.Proxy = nil
 		}
@@ -123,22 +149,33 @@ func NewFilter(config *Config) (filters.Filter, error) {
 
 	return &Filter{
 		Config:    *config,
+		name:      name,
 		transport: tr,
 	}, nil
 }
 
 func (f *Filter) FilterName() string {
-	return filterName
+	return f.name
+}
+
+// dial dials the target of a CONNECT the way the transport dials, so that
+// the dns lookup and the connect are traced.
+func (f *Filter) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if f.transport.DialContext != nil {
+		return f.transport.DialContext(ctx, network, address)
+	}
+	return f.transport.Dial(network, address)
 }
 
 func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
 	switch req.Method {
 	case "CONNECT":
-		glog.V(2).Infof("%s \"DIRECT %s %s %s\" - -", req.RemoteAddr, req.Method, req.Host, req.Proto)
-		rconn, err := f.transport.Dial("tcp", req.Host)
+		glog.V(2).Infof("%s \"DIRECT %s %s %s\" - -", filters.LogPrefix(req), req.Method, req.Host, req.Proto)
+		rconn, err := f.dial(ctx, "tcp", req.Host)
 		if err != nil {
 			return ctx, nil, err
 		}
+		defer rconn.Close()
 
 		rw := filters.GetResponseWriter(ctx)
 
@@ -160,14 +197,16 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 			return ctx, nil, fmt.Errorf("%#v.Hijack() error: %v", hijacker, err)
 		}
 		defer lconn.Close()
+		defer filters.TrackConn(ctx, lconn, rconn)()
 
-		go helpers.IOCopy(rconn, lconn)
-		helpers.IOCopy(lconn, rconn)
+		up, down, err := filters.Relay(ctx, lconn, rconn)
+		glog.V(3).Infof("%s \"DIRECT %s %s %s\" relayed %d/%d bytes, err=%v", filters.LogPrefix(req), req.Method, req.Host, req.Proto, up, down, err)
 
 		return ctx, filters.DummyResponse, nil
 	default:
 		helpers.FixRequestURL(req)
 		helpers.FixRequestHeader(req)
+		filters.SanitizeRequest(ctx, req)
 		resp, err := f.transport.RoundTrip(req)
 
 		if err != nil {
@@ -175,7 +214,7 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 		}
 
 		if req.RemoteAddr != "" {
-			glog.V(2).Infof("%s \"DIRECT %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+			glog.V(2).Infof("%s \"DIRECT %s %s %s\" %d %s", filters.LogPrefix(req), req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
 		}
 
 		return ctx, resp, err
@@ -2,13 +2,29 @@ package filters
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
+
+	"github.com/phuslu/glog"
+
+	"github.com/xuiv/goproxy/httpproxy/storage"
 )
 
 var (
 	DummyRequest  *http.Request  = &http.Request{}
 	DummyResponse *http.Response = &http.Response{}
+
+	// ErrBlocked is wrapped by the errors of the requests refused by a
+	// filter, e.g. the sites in the blacklist of autoproxy.
+	ErrBlocked = errors.New("filters: blocked")
+	// ErrOverQuota is wrapped by the errors of the requests which could not
+	// be served as the quota of the upstream is used up.
+	ErrOverQuota = errors.New("filters: over quota")
 )
 
 type Filter interface {
@@ -30,43 +46,395 @@ type ResponseFilter interface {
 	Response(context.Context, *http.Response) (context.Context, *http.Response, error)
 }
 
+// PasswordChecker is implemented by the filters which check the credentials
+// of the clients, e.g. auth, so that the SOCKS5 handshake could refuse a bad
+// username/password before the request is read. addr is the address of the
+// client.
+type PasswordChecker interface {
+	CheckPassword(addr, username, password string) bool
+}
+
 var (
-	mu  = new(sync.Mutex)
+	mu  = new(sync.RWMutex)
 	mm  = make(map[string]*sync.Mutex)
-	fnm = make(map[string]func() (Filter, error))
+	fnm = make(map[string]func(name string) (Filter, error))
 	fm  = make(map[string]Filter)
+	fdm = make(map[string]string)
+	fbm = make(map[string]string)
+	fim = make(map[string]struct{})
+	fsm = make(map[string]Schema)
+
+	reloadMu = new(sync.Mutex)
 )
 
-func Register(name string, New func() (Filter, error)) {
+// Register registers New as the constructor of the filter name. New is called
+// with the name passed to GetFilter, which is either name itself or a named
+// instance of it like "direct@corp", and should read its config from the
+// json file of that name.
+func Register(name string, New func(name string) (Filter, error)) {
 	mu.Lock()
 	defer mu.Unlock()
 	if _, ok := fnm[name]; !ok {
 		fnm[name] = New
-		fm[name] = nil
-		mm[name] = new(sync.Mutex)
 	}
 }
 
+// Schema describes a filter to the config checks, which never create the
+// filters.
+type Schema struct {
+	// NewConfig returns a pointer to an empty config of the filter.
+	NewConfig func() interface{}
+	// Prototype is a nil pointer of the filter type, it tells whether the
+	// filter is a RequestFilter, a RoundTripFilter or a ResponseFilter.
+	Prototype Filter
+}
+
+// ConfigValidator is implemented by the configs which could check themselves,
+// the errors are *storage.ConfigError naming the keys of the problems.
+type ConfigValidator interface {
+	Validate() []error
+}
+
+// FilterReferrer is implemented by the configs which name other filters, e.g.
+// the rules of autoproxy, so that the configs of those are checked too.
+type FilterReferrer interface {
+	ReferencedFilters() []string
+}
+
+// RegisterSchema registers the Schema of the filter name.
+func RegisterSchema(name string, schema Schema) {
+	mu.Lock()
+	defer mu.Unlock()
+	fsm[name] = schema
+}
+
+// LookupSchema returns the Schema of the filter name, or of the filter of the
+// named instance name.
+func LookupSchema(name string) (Schema, bool) {
+	base, _ := SplitName(name)
+
+	mu.RLock()
+	defer mu.RUnlock()
+	schema, ok := fsm[base]
+	return schema, ok
+}
+
+// CheckConfig reads the json config of the filter name without creating the
+// filter, and returns all the problems of it, the unknown keys included,
+// along with the filters it refers to.
+func CheckConfig(name string) ([]string, []error) {
+	base, instance := SplitName(name)
+	if base == "" || (instance == "" && base != name) {
+		return nil, []error{fmt.Errorf("filters: invalid filter name %#v", name)}
+	}
+
+	schema, ok := LookupSchema(name)
+	if !ok {
+		return nil, []error{fmt.Errorf("filters: unknown filter %#v", base)}
+	}
+
+	filename := name + ".json"
+	store := storage.LookupStoreByFilterName(base)
+
+	config := schema.NewConfig()
+	if err := store.UnmarshallJson(filename, config); err != nil {
+		return nil, []error{&storage.ConfigError{Filename: filename, Err: err}}
+	}
+
+	errs := make([]error, 0)
+
+	keys, err := storage.UnknownJsonKeys(store, filename, config)
+	if err != nil {
+		errs = append(errs, &storage.ConfigError{Filename: filename, Err: err})
+	}
+	for _, key := range keys {
+		errs = append(errs, &storage.ConfigError{Filename: filename, Key: key, Err: errors.New("unknown key")})
+	}
+
+	if v, ok := config.(ConfigValidator); ok {
+		for _, err := range v.Validate() {
+			if ce, ok := err.(*storage.ConfigError); ok {
+				ce.Filename = filename
+			} else {
+				err = &storage.ConfigError{Filename: filename, Err: err}
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	var refs []string
+	if r, ok := config.(FilterReferrer); ok {
+		refs = r.ReferencedFilters()
+	}
+
+	return refs, errs
+}
+
+// SplitName splits a filter name like "direct@corp" into the registered
+// filter name and the instance name.
+func SplitName(name string) (string, string) {
+	if i := strings.Index(name, storage.InstanceSep); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
+
+// MatchName reports whether the filter name is in names, either by itself or,
+// for a named instance like "direct@corp", by the registered filter name, so
+// that "direct" matches all the instances of direct.
+func MatchName(names map[string]struct{}, name string) bool {
+	if _, ok := names[name]; ok {
+		return true
+	}
+	base, _ := SplitName(name)
+	_, ok := names[base]
+	return ok
+}
+
+// GetFilter returns the filter of name, which is created on first use. The
+// named instances of a filter, e.g. "direct@corp" and "direct@backup", are
+// separate filters built from their own configs.
 func GetFilter(name string) (Filter, error) {
-	if f, ok := fm[name]; ok && f != nil {
+	base, instance := SplitName(name)
+	if base == "" || (instance == "" && base != name) {
+		return nil, fmt.Errorf("filters: invalid filter name %#v", name)
+	}
+
+	mu.RLock()
+	f := fm[name]
+	_, ok := fnm[base]
+	mu1 := mm[name]
+	mu.RUnlock()
+
+	if f != nil {
 		return f, nil
 	}
+	if !ok {
+		return nil, fmt.Errorf("filters: unknown filter %#v", base)
+	}
 
-	mu := mm[name]
-	mu.Lock()
-	defer mu.Unlock()
+	if mu1 == nil {
+		mu.Lock()
+		if mm[name] == nil {
+			mm[name] = new(sync.Mutex)
+		}
+		mu1 = mm[name]
+		mu.Unlock()
+	}
 
-	if f, ok := fm[name]; ok && f != nil {
+	mu1.Lock()
+	defer mu1.Unlock()
+
+	mu.RLock()
+	f = fm[name]
+	mu.RUnlock()
+
+	if f != nil {
 		return f, nil
 	}
 
-	f, err := fnm[name]()
+	digest := configDigest(name)
+
+	f, err := newFilter(name)
 	if err != nil {
 		return nil, err
 	}
 
+	mu.Lock()
 	fm[name] = f
+	fdm[name] = digest
+	mu.Unlock()
 
 	return f, nil
 
 }
+
+// Install adds f built by its NewFilter as the filter of name, so that the
+// filter chains and the rules of the other filters could refer to it by name
+// without a json config. The installed filters are never reloaded.
+func Install(name string, f Filter) error {
+	base, instance := SplitName(name)
+	if base == "" || (instance == "" && base != name) {
+		return fmt.Errorf("filters: invalid filter name %#v", name)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if fm[name] != nil {
+		return fmt.Errorf("filters: filter %#v already exists", name)
+	}
+	fm[name] = f
+	fim[name] = struct{}{}
+
+	return nil
+}
+
+// LookupFilter returns the filter of name if it has been created, unlike
+// GetFilter it never creates one.
+func LookupFilter(name string) (Filter, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	f := fm[name]
+	return f, f != nil
+}
+
+func newFilter(name string) (Filter, error) {
+	base, _ := SplitName(name)
+
+	mu.RLock()
+	New := fnm[base]
+	mu.RUnlock()
+
+	return New(name)
+}
+
+func configDigest(name string) string {
+	base, _ := SplitName(name)
+	digest, err := storage.JsonConfigDigest(storage.LookupStoreByFilterName(base), name+".json")
+	if err != nil {
+		return ""
+	}
+	return digest
+}
+
+// Stale returns the names of created filters whose config files are changed
+// since they were created, a config which failed to rebuild is skipped until
+// it is changed again.
+func Stale() []string {
+	mu.RLock()
+	dm := make(map[string]string)
+	bm := make(map[string]string)
+	for name, f := range fm {
+		if _, ok := fim[name]; ok {
+			continue
+		}
+		if f != nil {
+			dm[name] = fdm[name]
+			bm[name] = fbm[name]
+		}
+	}
+	mu.RUnlock()
+
+	names := make([]string, 0)
+	for name, digest := range dm {
+		if d := configDigest(name); d != digest && d != bm[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Staged is the filters rebuilt by Stage, it holds the reload lock until it
+// is committed or discarded.
+type Staged struct {
+	Names []string
+
+	fs   map[string]Filter
+	ds   map[string]string
+	done bool
+}
+
+// Stage rebuilds the stale filters without swapping them in, so that the
+// filter chains could be built with them before anything is changed. Nothing
+// is staged if one of them fails to build. The Staged must be committed or
+// discarded.
+func Stage() (*Staged, error) {
+	reloadMu.Lock()
+
+	s := &Staged{
+		Names: Stale(),
+		fs:    make(map[string]Filter),
+		ds:    make(map[string]string),
+	}
+
+	for _, name := range s.Names {
+		s.ds[name] = configDigest(name)
+		f, err := newFilter(name)
+		if err != nil {
+			mu.Lock()
+			fbm[name] = s.ds[name]
+			mu.Unlock()
+			s.Discard()
+			return nil, fmt.Errorf("filters: rebuild %#v error: %+v", name, err)
+		}
+		s.fs[name] = f
+	}
+
+	return s, nil
+}
+
+// GetFilter returns the staged filter of name, or the one of GetFilter.
+func (s *Staged) GetFilter(name string) (Filter, error) {
+	if f, ok := s.fs[name]; ok {
+		return f, nil
+	}
+	return GetFilter(name)
+}
+
+// Commit swaps the staged filters in. The replaced filters are closed in
+// background once drained returns, i.e. once the requests which may use them
+// are done, so that e.g. the downloads of autorange keep running.
+func (s *Staged) Commit(drained func()) {
+	if s.done {
+		return
+	}
+	s.done = true
+	defer reloadMu.Unlock()
+
+	old := make(map[string]Filter)
+	mu.Lock()
+	for name, f := range s.fs {
+		old[name] = fm[name]
+		fm[name] = f
+		fdm[name] = s.ds[name]
+		delete(fbm, name)
+	}
+	mu.Unlock()
+
+	if len(old) == 0 {
+		return
+	}
+
+	go func() {
+		if drained != nil {
+			drained()
+		}
+		closeFilters(old)
+	}()
+}
+
+// Discard closes the staged filters, the running ones are left as they are.
+func (s *Staged) Discard() {
+	if s.done {
+		return
+	}
+	s.done = true
+	defer reloadMu.Unlock()
+
+	closeFilters(s.fs)
+}
+
+// CloseAll closes the created filters which hold background goroutines.
+func CloseAll() {
+	mu.RLock()
+	fs := make(map[string]Filter)
+	for name, f := range fm {
+		fs[name] = f
+	}
+	mu.RUnlock()
+
+	closeFilters(fs)
+}
+
+func closeFilters(fs map[string]Filter) {
+	for name, f := range fs {
+		if c, ok := f.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				glog.Warningf("%T.Close() for %#v error: %+v", f, name, err)
+			}
+		}
+	}
+}
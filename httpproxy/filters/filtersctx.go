@@ -2,24 +2,66 @@ package filters
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"github.com/xuiv/goproxy/httpproxy/helpers"
 )
 
 const (
 	contextKey int = 0x3f71df90 // fmt.Sprintf("%x", md5.Sum([]byte("phuslu")))[:8]
+
+	// maxTraceEvents bounds the timeline of a request, e.g. a long autorange
+	// download, the later events are dropped.
+	maxTraceEvents = 256
 )
 
+// TraceEvent is a timed event of the timeline of a request.
+type TraceEvent struct {
+	Elapsed float64 // milliseconds since the request arrived
+	Event   string
+	Detail  string `json:",omitempty"`
+}
+
 type racer struct {
 	h   http.Handler
 	ln  net.Listener
 	rw  http.ResponseWriter
 	rtf RoundTripFilter
 	b   string
+	ct  *helpers.ConnTracker
+	ro  *helpers.RelayOptions
+	fp  *helpers.ForwardPolicy
+	id  string
+	rh  string
+	u   string
+	ub  string
+	c   net.Conn
+	p   string
+	pol FilterPolicy
+	qc  func(name string) error
+	rc  func(up, down int64)
+
+	sanitized bool
+
+	// mu guards the fields below and u, ub, pol and qc, which the admin
+	// listener and the traffic meter read while the request is served
+	mu     sync.Mutex
+	fields map[string]interface{}
+	start  time.Time
+	trace  []TraceEvent
 }
 
 func NewContext(ctx context.Context, h http.Handler, ln net.Listener, rw http.ResponseWriter, brand string) context.Context {
-	return context.WithValue(ctx, contextKey, &racer{h, ln, rw, nil, brand})
+	return context.WithValue(ctx, contextKey, &racer{h: h, ln: ln, rw: rw, b: brand, start: time.Now()})
 }
 
 func GetHandler(ctx context.Context) http.Handler {
@@ -46,6 +88,404 @@ func SetRoundTripFilter(ctx context.Context, filter RoundTripFilter) {
 	ctx.Value(contextKey).(*racer).rtf = filter
 }
 
+func SetConnTracker(ctx context.Context, ct *helpers.ConnTracker) {
+	ctx.Value(contextKey).(*racer).ct = ct
+}
+
+// TrackConn registers hijacked connections to the handler, the returned
+// func must be called when they are finished.
+func TrackConn(ctx context.Context, conns ...net.Conn) func() {
+	ct := ctx.Value(contextKey).(*racer).ct
+	if ct == nil {
+		return func() {}
+	}
+	ct.Add(conns...)
+	return func() { ct.Remove(conns...) }
+}
+
+func SetRelayOptions(ctx context.Context, opts *helpers.RelayOptions) {
+	ctx.Value(contextKey).(*racer).ro = opts
+}
+
+func SetForwardPolicy(ctx context.Context, policy *helpers.ForwardPolicy) {
+	ctx.Value(contextKey).(*racer).fp = policy
+}
+
+func SetRequestID(ctx context.Context, id string) {
+	ctx.Value(contextKey).(*racer).id = id
+}
+
+// RequestID returns the ID the handler gave to the request, or "" for the
+// requests which are not served by a httpproxy.Handler.
+func RequestID(ctx context.Context) string {
+	r, ok := ctx.Value(contextKey).(*racer)
+	if !ok {
+		return ""
+	}
+	return r.id
+}
+
+// SetUser records the user authenticated the request by the filter named by,
+// e.g. auth, for the access log and the filters after it.
+func SetUser(ctx context.Context, by, user string) {
+	r := ctx.Value(contextKey).(*racer)
+	r.mu.Lock()
+	r.u, r.ub = user, by
+	r.mu.Unlock()
+}
+
+// User returns the user recorded by SetUser, or "".
+func User(ctx context.Context) string {
+	r, ok := ctx.Value(contextKey).(*racer)
+	if !ok {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.u
+}
+
+// SetProfile records the name of the profile which serves the request.
+func SetProfile(ctx context.Context, profile string) {
+	ctx.Value(contextKey).(*racer).p = profile
+}
+
+// Profile returns the profile recorded by SetProfile, or "".
+func Profile(ctx context.Context) string {
+	r, ok := ctx.Value(contextKey).(*racer)
+	if !ok {
+		return ""
+	}
+	return r.p
+}
+
+// FilterPolicy limits the RoundTripFilters a request may reach, e.g. the
+// policy of the user set by auth.
+type FilterPolicy interface {
+	AllowFilter(name string) bool
+}
+
+// SetFilterPolicy sets the FilterPolicy of the request, the handler skips
+// the RoundTripFilters it does not allow and the filters which delegate to
+// others, e.g. autoproxy, refuse those with ErrBlocked.
+func SetFilterPolicy(ctx context.Context, policy FilterPolicy) {
+	r := ctx.Value(contextKey).(*racer)
+	r.mu.Lock()
+	r.pol = policy
+	r.mu.Unlock()
+}
+
+// AllowFilter reports whether the FilterPolicy of the request allows the
+// RoundTripFilter name, all are allowed without one.
+func AllowFilter(ctx context.Context, name string) bool {
+	r, ok := ctx.Value(contextKey).(*racer)
+	if !ok {
+		return true
+	}
+	r.mu.Lock()
+	policy := r.pol
+	r.mu.Unlock()
+	if policy == nil {
+		return true
+	}
+	return policy.AllowFilter(name)
+}
+
+// SetQuotaCheck sets the check of the traffic quotas of the request, which
+// is called with the RoundTripFilter about to serve it by the handler and by
+// the filters which delegate to others, e.g. autoproxy.
+func SetQuotaCheck(ctx context.Context, check func(name string) error) {
+	r := ctx.Value(contextKey).(*racer)
+	r.mu.Lock()
+	r.qc = check
+	r.mu.Unlock()
+}
+
+// CheckQuota returns the error of the quota check of the request for the
+// RoundTripFilter name, nil without one.
+func CheckQuota(ctx context.Context, name string) error {
+	r, ok := ctx.Value(contextKey).(*racer)
+	if !ok {
+		return nil
+	}
+	r.mu.Lock()
+	check := r.qc
+	r.mu.Unlock()
+	if check == nil {
+		return nil
+	}
+	return check(name)
+}
+
+// SetRelayCounter sets the func which Relay calls with the bytes of a tunnel
+// once it is closed, which may be after the handler returns.
+func SetRelayCounter(ctx context.Context, count func(up, down int64)) {
+	ctx.Value(contextKey).(*racer).rc = count
+}
+
+// SetConn records the accepted client connection the request is read from,
+// see TunnelUser.
+func SetConn(ctx context.Context, conn net.Conn) {
+	ctx.Value(contextKey).(*racer).c = conn
+}
+
+// tunnelConn is the client connection of a CONNECT request which is served
+// again by the handler, the requests read from it belong to user, as
+// authenticated by the filter named by.
+type tunnelConn struct {
+	net.Conn
+	user string
+	by   string
+}
+
+// NetConn returns the wrapped connection, for the half-close of the relay.
+func (c *tunnelConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// ServeTunnel returns conn, the hijacked client connection of the CONNECT
+// request of ctx, wrapped so that the requests which the handler reads from
+// it later, e.g. the ones decrypted by stripssl, belong to the user of the
+// CONNECT. See TunnelUser.
+func ServeTunnel(ctx context.Context, conn net.Conn) net.Conn {
+	r := ctx.Value(contextKey).(*racer)
+	r.mu.Lock()
+	user, by := r.u, r.ub
+	r.mu.Unlock()
+	if user == "" {
+		return conn
+	}
+	return &tunnelConn{Conn: conn, user: user, by: by}
+}
+
+// TunnelUser returns the user of the tunnel the request of ctx is read from,
+// if the connection recorded by SetConn is, or wraps, one returned by
+// ServeTunnel and its user is authenticated by the filter named by.
+func TunnelUser(ctx context.Context, by string) (string, bool) {
+	r, ok := ctx.Value(contextKey).(*racer)
+	if !ok {
+		return "", false
+	}
+
+	for c := r.c; c != nil; {
+		switch c1 := c.(type) {
+		case *tunnelConn:
+			return c1.user, c1.by == by
+		case interface{ NetConn() net.Conn }:
+			c = c1.NetConn()
+		default:
+			return "", false
+		}
+	}
+
+	return "", false
+}
+
+// SetRequestIDHeader names the header which carries the request ID upstream,
+// it is added by SanitizeRequest. An empty name keeps the ID local.
+func SetRequestIDHeader(ctx context.Context, name string) {
+	ctx.Value(contextKey).(*racer).rh = name
+}
+
+// LogPrefix returns the client address of req followed by its request ID,
+// the filters start their log lines with it so that the lines of concurrent
+// requests could be told apart.
+func LogPrefix(req *http.Request) string {
+	return logPrefix(req.Context(), req.RemoteAddr)
+}
+
+func logPrefix(ctx context.Context, addr string) string {
+	if id := RequestID(ctx); id != "" {
+		return addr + " [" + id + "]"
+	}
+	return addr
+}
+
+// SanitizeRequest removes the hop-by-hop headers of req and applies the
+// forward policy of the profile, the filters which send req upstream call it
+// before that. It is applied once per request, even if the filters delegate
+// to each other.
+func SanitizeRequest(ctx context.Context, req *http.Request) {
+	r, ok := ctx.Value(contextKey).(*racer)
+	if !ok {
+		helpers.RemoveHopHeaders(req.Header)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sanitized {
+		return
+	}
+	r.sanitized = true
+
+	// the branding carries a version, the pseudonym of Via is a single token
+	pseudonym := r.b
+	if fields := strings.Fields(r.b); len(fields) > 0 {
+		pseudonym = fields[0]
+	}
+	helpers.SanitizeRequestHeader(req, r.fp, pseudonym)
+
+	if r.rh != "" && r.id != "" {
+		req.Header.Set(r.rh, r.id)
+	}
+}
+
+// Relay relays a hijacked client connection and a remote connection with the
+// tunnel limits of the profile, the tunnels closed by the limits are logged
+// with the side which went idle.
+func Relay(ctx context.Context, lconn, rconn net.Conn) (int64, int64, error) {
+	var opts *helpers.RelayOptions
+	var count func(up, down int64)
+	if r, ok := ctx.Value(contextKey).(*racer); ok {
+		opts, count = r.ro, r.rc
+	}
+
+	up, down, err := helpers.RelayWithOptions(lconn, rconn, opts)
+	if terr, ok := err.(*helpers.RelayTimeoutError); ok {
+		glog.Infof("%s tunnel to %s closed: %v", logPrefix(ctx, lconn.RemoteAddr().String()), rconn.RemoteAddr(), terr)
+		SetLogField(ctx, "tunnel_timeout", terr.Side)
+	}
+	Trace(ctx, "tunnel_closed", "up=%d down=%d err=%v", up, down, err)
+	if count != nil {
+		count(up, down)
+	}
+
+	return up, down, err
+}
+
+// SetLogField adds a field to the access log record of the request, e.g. the
+// appid used by gae or the rule matched by autoproxy. It is a no-op for the
+// requests which are not served by a httpproxy.Handler.
+func SetLogField(ctx context.Context, key string, value interface{}) {
+	r, ok := ctx.Value(contextKey).(*racer)
+	if !ok {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fields == nil {
+		r.fields = make(map[string]interface{})
+	}
+	r.fields[key] = value
+}
+
+// GetLogFields returns a copy of the fields added by SetLogField.
+func GetLogFields(ctx context.Context) map[string]interface{} {
+	r, ok := ctx.Value(contextKey).(*racer)
+	if !ok {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.fields) == 0 {
+		return nil
+	}
+	fields := make(map[string]interface{}, len(r.fields))
+	for key, value := range r.fields {
+		fields[key] = value
+	}
+	return fields
+}
+
+// Trace appends a timed event to the timeline of the request, e.g. the appid
+// tried by gae or a chunk fetched by autorange. It is a no-op for the
+// requests which are not served by a httpproxy.Handler.
+func Trace(ctx context.Context, event string, format string, a ...interface{}) {
+	r, ok := ctx.Value(contextKey).(*racer)
+	if !ok {
+		return
+	}
+
+	e := TraceEvent{
+		Elapsed: float64(time.Since(r.start)) / float64(time.Millisecond),
+		Event:   event,
+	}
+	if format != "" {
+		e.Detail = fmt.Sprintf(format, a...)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.trace) < maxTraceEvents {
+		r.trace = append(r.trace, e)
+	}
+}
+
+// GetTrace returns a copy of the timeline of the request.
+func GetTrace(ctx context.Context) []TraceEvent {
+	r, ok := ctx.Value(contextKey).(*racer)
+	if !ok {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]TraceEvent(nil), r.trace...)
+}
+
+// ClientTrace returns a httptrace.ClientTrace which records the dns lookups,
+// connects, tls handshakes and the first response byte of the round trips
+// of the request to its timeline. The helpers dialers report to it too, a
+// connect to several comma separated addresses is a race of MultiDialer and
+// the connect done names the winner.
+func ClientTrace(ctx context.Context) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			Trace(ctx, "get_conn", "%s", hostPort)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			Trace(ctx, "got_conn", "remote=%s reused=%v", info.Conn.RemoteAddr(), info.Reused)
+		},
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			Trace(ctx, "dns_start", "%s", info.Host)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			if info.Err != nil {
+				Trace(ctx, "dns_done", "err=%v", info.Err)
+				return
+			}
+			addrs := make([]string, len(info.Addrs))
+			for i, addr := range info.Addrs {
+				addrs[i] = addr.String()
+			}
+			Trace(ctx, "dns_done", "%s", strings.Join(addrs, ","))
+		},
+		ConnectStart: func(network, addr string) {
+			Trace(ctx, "connect_start", "%s %s", network, addr)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				Trace(ctx, "connect_done", "%s %s err=%v", network, addr, err)
+				return
+			}
+			Trace(ctx, "connect_done", "%s %s", network, addr)
+		},
+		TLSHandshakeStart: func() {
+			Trace(ctx, "tls_handshake_start", "")
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				Trace(ctx, "tls_handshake_done", "err=%v", err)
+				return
+			}
+			Trace(ctx, "tls_handshake_done", "server_name=%s proto=%s resumed=%v", state.ServerName, state.NegotiatedProtocol, state.DidResume)
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err != nil {
+				Trace(ctx, "wrote_request", "err=%v", info.Err)
+				return
+			}
+			Trace(ctx, "wrote_request", "")
+		},
+		GotFirstResponseByte: func() {
+			Trace(ctx, "first_response_byte", "")
+		},
+	}
+}
+
 func WithString(ctx context.Context, name, value string) context.Context {
 	return context.WithValue(ctx, name, value)
 }
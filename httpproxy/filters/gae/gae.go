@@ -8,11 +8,13 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"flag"
+	"fmt"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/golibs/lrucache"
@@ -87,8 +89,53 @@ type Config struct {
 	}
 }
 
+// Validate reports the problems of config which NewFilter would fail on.
+func (c *Config) Validate() []error {
+	errs := make([]error, 0)
+	invalid := func(key, format string, a ...interface{}) {
+		errs = append(errs, &storage.ConfigError{Key: key, Err: fmt.Errorf(format, a...)})
+	}
+
+	if len(c.AppIDs) > 0 && len(c.CustomDomains) > 0 {
+		invalid("CustomDomains", "AppIDs and CustomDomains is conflict")
+	}
+	if c.TLSConfig.Version != "" && helpers.TLSVersion(c.TLSConfig.Version) == 0 {
+		invalid("TLSConfig.Version", "version %#v is not supported", c.TLSConfig.Version)
+	}
+	for i, name := range c.TLSConfig.Ciphers {
+		if helpers.TLSCipher(name) == 0 {
+			invalid(fmt.Sprintf("TLSConfig.Ciphers[%d]", i), "cipher %#v is not supported", name)
+		}
+	}
+	for key, value := range map[string]string{"GoogleG2PKP": c.GoogleG2PKP, "GoogleG3PKP": c.GoogleG3PKP} {
+		if _, err := base64.StdEncoding.DecodeString(value); err != nil {
+			invalid(key, "%v", err)
+		}
+	}
+	if c.EnableRemoteDNS && (len(c.DNSServers) == 0 || net.ParseIP(c.DNSServers[0]) == nil) {
+		invalid("DNSServers", "EnableRemoteDNS needs an IP address as the first DNSServers")
+	}
+	if c.DisableHTTP2 && c.ForceHTTP2 {
+		invalid("ForceHTTP2", "DisableHTTP2 and ForceHTTP2 is conflict")
+	}
+	if c.Transport.Proxy.Enabled {
+		if c.EnableQuic {
+			invalid("Transport.Proxy.Enabled", "EnableQuic is conflict with Proxy setting")
+		}
+		if c.ForceHTTP2 {
+			invalid("Transport.Proxy.Enabled", "Proxy.Enabled and ForceHTTP2 is conflict")
+		}
+		if _, err := url.Parse(c.Transport.Proxy.URL); err != nil {
+			invalid("Transport.Proxy.URL", "%v", err)
+		}
+	}
+
+	return errs
+}
+
 type Filter struct {
 	Config
+	name               string
 	GAETransport       *GAETransport
 	Transport          *Transport
 	ForceHTTPSMatcher  *helpers.HostMatcher
@@ -99,21 +146,36 @@ type Filter struct {
 	FakeOptionsMatcher *helpers.HostMatcher
 	SiteMatcher        *helpers.HostMatcher
 	DirectSiteMatcher  *helpers.HostMatcher
+	done               chan struct{}
+	closeOnce          sync.Once
 }
 
 func init() {
-	filters.Register(filterName, func() (filters.Filter, error) {
-		filename := filterName + ".json"
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
+		filename := name + ".json"
 		config := new(Config)
 		err := storage.LookupStoreByFilterName(filterName).UnmarshallJson(filename, config)
 		if err != nil {
-			glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			glog.Errorf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			return nil, err
 		}
-		return NewFilter(config)
+		return newFilter(name, config)
+	})
+	filters.RegisterSchema(filterName, filters.Schema{
+		NewConfig: func() interface{} { return new(Config) },
+		Prototype: (*Filter)(nil),
 	})
 }
 
 func NewFilter(config *Config) (filters.Filter, error) {
+	return newFilter(filterName, config)
+}
+
+func newFilter(name string, config *Config) (filters.Filter, error) {
+	if errs := config.Validate(); len(errs) > 0 {
+		return nil, fmt.Errorf("GAE: %v", errs[0])
+	}
+
 	dnsServers := make([]net.IP, 0)
 	for _, s := range config.DNSServers {
 		if ip := net.ParseIP(s); ip != nil {
@@ -162,21 +224,23 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	} else {
 		googleTLSConfig.MinVersion = tls.VersionTLS12
 	}
-	pickupCiphers := func(names []string) []uint16 {
+	pickupCiphers := func(names []string) ([]uint16, error) {
 		ciphers := make([]uint16, 0)
 		for _, name := range names {
 			cipher := helpers.TLSCipher(name)
 			if cipher == 0 {
-				glog.Fatalf("GAE: cipher %#v is not supported.", name)
+				return nil, fmt.Errorf("GAE: cipher %#v is not supported.", name)
 			}
 			ciphers = append(ciphers, cipher)
 		}
 		rand.Shuffle(len(ciphers), func(i int, j int) {
 			ciphers[i], ciphers[j] = ciphers[j], ciphers[i]
 		})
-		return ciphers
+		return ciphers, nil
+	}
+	if googleTLSConfig.CipherSuites, err = pickupCiphers(config.TLSConfig.Ciphers); err != nil {
+		return nil, err
 	}
-	googleTLSConfig.CipherSuites = pickupCiphers(config.TLSConfig.Ciphers)
 	if len(config.TLSConfig.ServerName) > 0 {
 		googleTLSConfig.ServerName = config.TLSConfig.ServerName[rand.Intn(len(config.TLSConfig.ServerName))]
 	}
@@ -223,7 +287,7 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	if config.EnableRemoteDNS {
 		r.DNSServer = net.ParseIP(config.DNSServers[0])
 		if r.DNSServer == nil {
-			glog.Fatalf("net.ParseIP(%+v) failed: %s", config.DNSServers[0], err)
+			return nil, fmt.Errorf("net.ParseIP(%+v) failed", config.DNSServers[0])
 		}
 	}
 
@@ -236,12 +300,12 @@ func NewFilter(config *Config) (filters.Filter, error) {
 		LogToStderr:       flag.Lookup("logtostderr") != nil,
 		TLSConfig:         nil,
 		SiteToAlias:       helpers.NewHostMatcherWithString(config.SiteToAlias),
-		IPBlackList:       lrucache.NewLRUCache(1024),
+		IPBlackList:       helpers.NewKeyedCache(lrucache.NewLRUCache(1024)),
 		HostMap:           hostmap,
 		GoogleTLSConfig:   googleTLSConfig,
 		GoogleValidator:   googleValidator,
-		TLSConnDuration:   lrucache.NewLRUCache(8192),
-		TLSConnError:      lrucache.NewLRUCache(8192),
+		TLSConnDuration:   helpers.NewKeyedCache(lrucache.NewLRUCache(8192)),
+		TLSConnError:      helpers.NewKeyedCache(lrucache.NewLRUCache(8192)),
 		TLSConnReadBuffer: config.Transport.Dialer.SocketReadBuffer,
 		GoodConnExpiry:    5 * time.Minute,
 		ErrorConnExpiry:   30 * time.Minute,
@@ -274,7 +338,7 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	}
 
 	t1 := &http.Transport{
-		DialTLS:               md.DialTLS,
+		DialTLSContext:        md.DialTLSContext,
 		DisableKeepAlives:     config.Transport.DisableKeepAlives,
 		DisableCompression:    true,
 		ResponseHeaderTimeout: time.Duration(config.Transport.ResponseHeaderTimeout) * time.Second,
@@ -285,11 +349,11 @@ func NewFilter(config *Config) (filters.Filter, error) {
 
 	if config.Transport.Proxy.Enabled {
 		if config.EnableQuic {
-			glog.Fatalf("EnableQuic is conflict with Proxy setting!")
+			return nil, fmt.Errorf("EnableQuic is conflict with Proxy setting!")
 		}
 		fixedURL, err := url.Parse(config.Transport.Proxy.URL)
 		if err != nil {
-			glog.Fatalf("url.Parse(%#v) error: %s", config.Transport.Proxy.URL, err)
+			return nil, fmt.Errorf("url.Parse(%#v) error: %s", config.Transport.Proxy.URL, err)
 		}
 
 		dialer0 := &net.Dialer{
@@ -300,11 +364,11 @@ func NewFilter(config *Config) (filters.Filter, error) {
 
 		dialer, err := proxy.FromURL(fixedURL, dialer0, &helpers.MultiResolver{md})
 		if err != nil {
-			glog.Fatalf("proxy.FromURL(%#v) error: %s", fixedURL.String(), err)
+			return nil, fmt.Errorf("proxy.FromURL(%#v) error: %s", fixedURL.String(), err)
 		}
 
 		t1.Dial = dialer.Dial
-		t1.DialTLS = nil
+		t1.DialTLSContext = nil
 		t1.Proxy = nil
 		t1.TLSClientConfig = md.GoogleTLSConfig
 	}
@@ -327,9 +391,9 @@ func NewFilter(config *Config) (filters.Filter, error) {
 			GetClientKey:          GetHostnameCacheKey,
 		}
 	case config.DisableHTTP2 && config.ForceHTTP2:
-		glog.Fatalf("GAE: DisableHTTP2=%v and ForceHTTP2=%v is conflict!", config.DisableHTTP2, config.ForceHTTP2)
+		return nil, fmt.Errorf("GAE: DisableHTTP2=%v and ForceHTTP2=%v is conflict!", config.DisableHTTP2, config.ForceHTTP2)
 	case config.Transport.Proxy.Enabled && config.ForceHTTP2:
-		glog.Fatalf("GAE: Proxy.Enabled=%v and ForceHTTP2=%v is conflict!", config.Transport.Proxy.Enabled, config.ForceHTTP2)
+		return nil, fmt.Errorf("GAE: Proxy.Enabled=%v and ForceHTTP2=%v is conflict!", config.Transport.Proxy.Enabled, config.ForceHTTP2)
 	case config.ForceHTTP2:
 		tr.RoundTripper = &http2.Transport{
 			DialTLS:            md.DialTLS2,
@@ -368,6 +432,8 @@ func NewFilter(config *Config) (filters.Filter, error) {
 		}
 	}
 
+	done := make(chan struct{})
+
 	if config.EnableDeadProbe && !config.Transport.Proxy.Enabled {
 		isNetAvailable := func() bool {
 			c, err := net.DialTimeout("tcp", net.JoinHostPort(config.DNSServers[0], "53"), 300*time.Millisecond)
@@ -424,23 +490,33 @@ func NewFilter(config *Config) (filters.Filter, error) {
 		}
 
 		go func() {
-			time.Sleep(1 * time.Minute)
+			sleep := func(d time.Duration) bool {
+				select {
+				case <-done:
+					return false
+				case <-time.After(d):
+					return true
+				}
+			}
+			if !sleep(1 * time.Minute) {
+				return
+			}
 			for {
 				if config.EnableQuic {
-					time.Sleep(time.Duration(2+rand.Intn(2)) * time.Second)
+					if !sleep(time.Duration(2+rand.Intn(2)) * time.Second) {
+						return
+					}
 					probeQuic()
 				} else {
-					time.Sleep(time.Duration(2+rand.Intn(4)) * time.Second)
+					if !sleep(time.Duration(2+rand.Intn(4)) * time.Second) {
+						return
+					}
 					probeTLS()
 				}
 			}
 		}()
 	}
 
-	if len(config.AppIDs) > 0 && len(config.CustomDomains) > 0 {
-		glog.Fatalf("GAE AppIDs and CustomDomains is conflict!")
-	}
-
 	urls := []url.URL{}
 	for _, s := range config.AppIDs {
 		urls = append(urls, url.URL{
@@ -460,6 +536,7 @@ func NewFilter(config *Config) (filters.Filter, error) {
 
 	f := &Filter{
 		Config: *config,
+		name:   name,
 		GAETransport: &GAETransport{
 			Transport:   tr,
 			MultiDialer: md,
@@ -476,6 +553,7 @@ func NewFilter(config *Config) (filters.Filter, error) {
 		ForceGAESuffixs:    forceGAESuffixs,
 		FakeOptionsMatcher: helpers.NewHostMatcherWithStrings(config.FakeOptions),
 		DirectSiteMatcher:  helpers.NewHostMatcherWithString(config.Site2Alias),
+		done:               done,
 	}
 
 	if config.Transport.Proxy.Enabled {
@@ -486,7 +564,15 @@ func NewFilter(config *Config) (filters.Filter, error) {
 }
 
 func (f *Filter) FilterName() string {
-	return filterName
+	return f.name
+}
+
+// Close stops the dead probe of the filter.
+func (f *Filter) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.done)
+	})
+	return nil
 }
 
 func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
@@ -505,7 +591,7 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 				Close:         true,
 				ContentLength: -1,
 			}
-			glog.V(2).Infof("%s \"GAE FORCEHTTPS %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+			glog.V(2).Infof("%s \"GAE FORCEHTTPS %s %s %s\" %d %s", filters.LogPrefix(req), req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
 			return ctx, resp, nil
 		}
 	}
@@ -519,7 +605,7 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 						rawurl = strings.Replace(rawurl, "http://", "https://", 1)
 					}
 				}
-				glog.V(2).Infof("%s \"GAE REDIRECT %s %s %s\" - -", req.RemoteAddr, req.Method, rawurl, req.Proto)
+				glog.V(2).Infof("%s \"GAE REDIRECT %s %s %s\" - -", filters.LogPrefix(req), req.Method, rawurl, req.Proto)
 				return ctx, &http.Response{
 					StatusCode: http.StatusFound,
 					Header: http.Header{
@@ -533,7 +619,7 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 		case "/books":
 			if req.URL.Host == "books.google.cn" {
 				rawurl := strings.Replace(req.URL.String(), "books.google.cn", "books.google.com", 1)
-				glog.V(2).Infof("%s \"GAE REDIRECT %s %s %s\" - -", req.RemoteAddr, req.Method, rawurl, req.Proto)
+				glog.V(2).Infof("%s \"GAE REDIRECT %s %s %s\" - -", filters.LogPrefix(req), req.Method, rawurl, req.Proto)
 				return ctx, &http.Response{
 					StatusCode: http.StatusFound,
 					Header: http.Header{
@@ -577,7 +663,7 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 			if headers := req.Header.Get("Access-Control-Request-Headers"); headers != "" {
 				resp.Header.Set("Access-Control-Allow-Headers", headers)
 			}
-			glog.V(2).Infof("%s \"GAE FAKEOPTIONS %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+			glog.V(2).Infof("%s \"GAE FAKEOPTIONS %s %s %s\" %d %s", filters.LogPrefix(req), req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
 			return ctx, resp, nil
 		}
 	}
@@ -594,7 +680,7 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 				Close:         true,
 				ContentLength: 0,
 			}
-			glog.V(2).Infof("%s \"GAE FAKEWEBSOCKET %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+			glog.V(2).Infof("%s \"GAE FAKEWEBSOCKET %s %s %s\" %d %s", filters.LogPrefix(req), req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
 			return ctx, resp, nil
 		}
 	}
@@ -604,9 +690,10 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 		prefix = "DIRECT"
 	}
 
+	filters.SanitizeRequest(ctx, req)
 	resp, err := tr.RoundTrip(req)
 	if err != nil {
-		glog.Warningf("%s \"GAE %s %s %s %s\" error: %T(%v)", req.RemoteAddr, prefix, req.Method, req.URL.String(), req.Proto, err, err)
+		glog.Warningf("%s \"GAE %s %s %s %s\" error: %T(%v)", filters.LogPrefix(req), prefix, req.Method, req.URL.String(), req.Proto, err, err)
 		if resp != nil && resp.Body != nil {
 			resp.Body.Close()
 		}
@@ -628,7 +715,7 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 		}
 	}
 
-	glog.V(2).Infof("%s \"GAE %s %s %s %s\" %d %s", req.RemoteAddr, prefix, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+	glog.V(2).Infof("%s \"GAE %s %s %s %s\" %d %s", filters.LogPrefix(req), prefix, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
 	return ctx, resp, err
 }
 
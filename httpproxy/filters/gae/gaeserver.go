@@ -61,6 +61,27 @@ func (s *Servers) ToggleBadServer(fetchserver url.URL) {
 	s.curURL.Store(s.urls1[0])
 }
 
+// URLs returns copies of the good and the bad fetch servers.
+func (s *Servers) URLs() ([]url.URL, []url.URL) {
+	s.muURL.RLock()
+	defer s.muURL.RUnlock()
+	return append([]url.URL(nil), s.urls1...), append([]url.URL(nil), s.urls2...)
+}
+
+// LookupServer returns the fetch server of host, good or bad.
+func (s *Servers) LookupServer(host string) (url.URL, bool) {
+	s.muURL.RLock()
+	defer s.muURL.RUnlock()
+	for _, urls := range [][]url.URL{s.urls1, s.urls2} {
+		for _, u := range urls {
+			if u.Host == host {
+				return u, true
+			}
+		}
+	}
+	return url.URL{}, false
+}
+
 func (s *Servers) EncodeRequest(req *http.Request, fetchserver url.URL, deadline time.Duration, brotli bool) (*http.Request, error) {
 	var err error
 	var b bytes.Buffer
@@ -111,7 +132,7 @@ func (s *Servers) EncodeRequest(req *http.Request, fetchserver url.URL, deadline
 		req1.Body = helpers.NewMultiReadCloser(bytes.NewReader(b0), &b)
 	}
 
-	return req1, nil
+	return req1.WithContext(req.Context()), nil
 }
 
 func (s *Servers) DecodeResponse(resp *http.Response) (resp1 *http.Response, err error) {
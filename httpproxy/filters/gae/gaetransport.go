@@ -14,7 +14,15 @@ import (
 	quic "github.com/phuslu/quic-go"
 	"github.com/phuslu/quic-go/h2quic"
 
+	"github.com/xuiv/goproxy/httpproxy/filters"
 	"github.com/xuiv/goproxy/httpproxy/helpers"
+	"github.com/xuiv/goproxy/httpproxy/metrics"
+)
+
+var (
+	roundTripsTotal  = metrics.NewCounterVec("goproxy_gae_roundtrips_total", "GAE round trips to the front ends, by protocol.", "proto")
+	retriesTotal     = metrics.NewCounterVec("goproxy_gae_retries_total", "GAE requests retried, by reason.", "reason")
+	badServerToggles = metrics.NewCounterVec("goproxy_gae_bad_server_toggles_total", "GAE fetch servers toggled to bad, by reason.", "reason")
 )
 
 type Transport struct {
@@ -119,18 +127,29 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 
 	for i := 0; i < retry; i++ {
 		if isQuic {
+			roundTripsTotal.Inc("quic")
 			resp, err = t.roundTripQuic(req)
 		} else {
+			roundTripsTotal.Inc("tls")
 			resp, err = t.roundTripTLS(req)
 		}
 
 		if err != nil {
+			if req.Context().Err() != nil {
+				break
+			}
 			glog.Warningf("GAE %T.RoundTrip(%#v) error: %+v", t.RoundTripper, req.URL.String(), err)
+			if i < retry-1 {
+				retriesTotal.Inc("transport_error")
+			}
 			continue
 		}
 
 		if resp != nil && resp.StatusCode == http.StatusBadRequest {
 			glog.Warningf("GAE %T.RoundTrip(%#v) get HTTP Error %d", t.RoundTripper, req.URL.String(), resp.StatusCode)
+			if i < retry-1 {
+				retriesTotal.Inc("bad_request")
+			}
 			continue
 		}
 
@@ -191,17 +210,30 @@ func (t *GAETransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	brotli := t.BrotliSites.Match(req.Host) && strings.Contains(req.Header.Get("Accept-Encoding"), "br")
 	retryTimes := t.RetryTimes
 	retryDelay := t.RetryDelay
+	// the client may go away between the retries, stop spending the quota
+	ctx := req.Context()
 	for i := 0; i < retryTimes; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		server := t.Servers.PickFetchServer(req, i)
+		filters.SetLogField(req.Context(), "gae_server", server.Host)
+		filters.Trace(ctx, "gae_appid", "%s attempt=%d", server.Host, i+1)
 		req1, err := t.Servers.EncodeRequest(req, server, deadline, brotli)
 		if err != nil {
 			return nil, fmt.Errorf("GAE EncodeRequest: %s", err.Error())
 		}
 
 		resp, err := t.Transport.RoundTrip(req1)
+		if err != nil {
+			filters.Trace(ctx, "gae_response", "%s err=%v", server.Host, err)
+		} else {
+			filters.Trace(ctx, "gae_response", "%s status=%d", server.Host, resp.StatusCode)
+		}
 
 		if err != nil {
-			if i == retryTimes-1 {
+			if i == retryTimes-1 || ctx.Err() != nil {
 				return nil, err
 			} else {
 				glog.Warningf("GAE: request \"%s\" error: %T(%v), retry...", req.URL.String(), err, err)
@@ -209,12 +241,17 @@ func (t *GAETransport) RoundTrip(req *http.Request) (*http.Response, error) {
 					helpers.CloseConnections(t.Transport.RoundTripper)
 					return nil, err
 				}
+				retriesTotal.Inc("error")
 				continue
 			}
 		}
 
 		if resp.StatusCode != http.StatusOK {
 			if i == retryTimes-1 {
+				if resp.StatusCode == http.StatusServiceUnavailable {
+					resp.Body.Close()
+					return nil, fmt.Errorf("%w: %s", filters.ErrOverQuota, server.Host)
+				}
 				return resp, nil
 			}
 
@@ -222,7 +259,12 @@ func (t *GAETransport) RoundTrip(req *http.Request) (*http.Response, error) {
 			case http.StatusServiceUnavailable:
 				glog.Warningf("GAE: %s over qouta, try switch to next appid...", server.Host)
 				t.Servers.ToggleBadServer(server)
-				time.Sleep(retryDelay)
+				badServerToggles.Inc("service_unavailable")
+				retriesTotal.Inc("service_unavailable")
+				resp.Body.Close()
+				if err := helpers.SleepContext(ctx, retryDelay); err != nil {
+					return nil, err
+				}
 				continue
 			case http.StatusFound,
 				http.StatusBadGateway,
@@ -238,6 +280,7 @@ func (t *GAETransport) RoundTrip(req *http.Request) (*http.Response, error) {
 						}
 					}
 				}
+				retriesTotal.Inc("bad_ip")
 				continue
 			default:
 				return resp, nil
@@ -267,16 +310,26 @@ func (t *GAETransport) RoundTrip(req *http.Request) (*http.Response, error) {
 			case bytes.Contains(body, []byte("DEADLINE_EXCEEDED")):
 				//FIXME: deadline += 10 * time.Second
 				glog.Warningf("GAE: %s urlfetch %#v get DEADLINE_EXCEEDED, retry with deadline=%s...", req1.Host, req.URL.String(), deadline)
-				time.Sleep(deadline)
+				retriesTotal.Inc("deadline_exceeded")
+				if err := helpers.SleepContext(ctx, deadline); err != nil {
+					return nil, err
+				}
 				continue
 			case bytes.Contains(body, []byte("ver quota")):
 				glog.Warningf("GAE: %s urlfetch %#v get over quota, retry...", req1.Host, req.URL.String())
 				t.Servers.ToggleBadServer(server)
-				time.Sleep(retryDelay)
+				badServerToggles.Inc("over_quota")
+				retriesTotal.Inc("over_quota")
+				if err := helpers.SleepContext(ctx, retryDelay); err != nil {
+					return nil, err
+				}
 				continue
 			case bytes.Contains(body, []byte("urlfetch: CLOSED")):
 				glog.Warningf("GAE: %s urlfetch %#v get urlfetch: CLOSED, retry...", req1.Host, req.URL.String())
-				time.Sleep(retryDelay)
+				retriesTotal.Inc("urlfetch_closed")
+				if err := helpers.SleepContext(ctx, retryDelay); err != nil {
+					return nil, err
+				}
 				continue
 			default:
 				resp1.Body = ioutil.NopCloser(bytes.NewReader(body))
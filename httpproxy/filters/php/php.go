@@ -3,6 +3,7 @@ package php
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
 	"net/url"
@@ -48,24 +49,47 @@ type Config struct {
 	}
 }
 
+// Validate reports the problems of config which NewFilter would fail on.
+func (c *Config) Validate() []error {
+	errs := make([]error, 0)
+	if c.Transport.Proxy.Enabled {
+		if u, err := url.Parse(c.Transport.Proxy.URL); err != nil {
+			errs = append(errs, &storage.ConfigError{Key: "Transport.Proxy.URL", Err: err})
+		} else if u.Scheme == "" || u.Host == "" {
+			errs = append(errs, &storage.ConfigError{Key: "Transport.Proxy.URL", Err: fmt.Errorf("%#v is not a proxy url", c.Transport.Proxy.URL)})
+		}
+	}
+	return errs
+}
+
 type Filter struct {
 	Config
+	name      string
 	Transport *Transport
 }
 
 func init() {
-	filters.Register(filterName, func() (filters.Filter, error) {
-		filename := filterName + ".json"
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
+		filename := name + ".json"
 		config := new(Config)
 		err := storage.LookupStoreByFilterName(filterName).UnmarshallJson(filename, config)
 		if err != nil {
-			glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			glog.Errorf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			return nil, err
 		}
-		return NewFilter(config)
+		return newFilter(name, config)
+	})
+	filters.RegisterSchema(filterName, filters.Schema{
+		NewConfig: func() interface{} { return new(Config) },
+		Prototype: (*Filter)(nil),
 	})
 }
 
 func NewFilter(config *Config) (filters.Filter, error) {
+	return newFilter(filterName, config)
+}
+
+func newFilter(name string, config *Config) (filters.Filter, error) {
 	servers := make([]Server, 0)
 	for _, s := range config.Servers {
 		u, err := url.Parse(s.URL)
@@ -105,7 +129,8 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	}
 
 	tr := &http.Transport{
-		Dial: d.Dial,
+		Dial:        d.Dial,
+		DialContext: d.DialContext,
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: false,
 			ClientSessionCache: tls.NewLRUClientSessionCache(1000),
@@ -117,21 +142,23 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	if config.Transport.Proxy.Enabled {
 		fixedURL, err := url.Parse(config.Transport.Proxy.URL)
 		if err != nil {
-			glog.Fatalf("url.Parse(%#v) error: %s", config.Transport.Proxy.URL, err)
+			return nil, fmt.Errorf("url.Parse(%#v) error: %s", config.Transport.Proxy.URL, err)
 		}
 
 		switch fixedURL.Scheme {
 		case "http", "https":
 			tr.Proxy = http.ProxyURL(fixedURL)
 			tr.Dial = nil
+			tr.DialContext = nil
 			tr.DialTLS = nil
 		default:
 			dialer, err := proxy.FromURL(fixedURL, d, nil)
 			if err != nil {
-				glog.Fatalf("proxy.FromURL(%#v) error: %s", fixedURL.String(), err)
+				return nil, fmt.Errorf("proxy.FromURL(%#v) error: %s", fixedURL.String(), err)
 			}
 
 			tr.Dial = dialer.Dial
+			tr.DialContext = nil
 			tr.DialTLS = nil
 			tr.Proxy = nil
 		}
@@ -146,6 +173,7 @@ func NewFilter(config *Config) (filters.Filter, error) {
 
 	return &Filter{
 		Config: *config,
+		name:   name,
 		Transport: &Transport{
 			RoundTripper: tr,
 			Servers:      servers,
@@ -154,15 +182,16 @@ func NewFilter(config *Config) (filters.Filter, error) {
 }
 
 func (p *Filter) FilterName() string {
-	return filterName
+	return p.name
 }
 
 func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	filters.SanitizeRequest(ctx, req)
 	resp, err := f.Transport.RoundTrip(req)
 	if err != nil {
 		return ctx, nil, err
 	} else {
-		glog.V(2).Infof("%s \"PHP %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+		glog.V(2).Infof("%s \"PHP %s %s %s\" %d %s", filters.LogPrefix(req), req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
 	}
 	return ctx, resp, nil
 }
@@ -36,23 +36,33 @@ type Config struct {
 
 type Filter struct {
 	Config
+	name           string
 	Transport      *http.Transport
 	SSHClientCache lrucache.Cache
 }
 
 func init() {
-	filters.Register(filterName, func() (filters.Filter, error) {
-		filename := filterName + ".json"
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
+		filename := name + ".json"
 		config := new(Config)
 		err := storage.LookupStoreByFilterName(filterName).UnmarshallJson(filename, config)
 		if err != nil {
-			glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			glog.Errorf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			return nil, err
 		}
-		return NewFilter(config)
+		return newFilter(name, config)
+	})
+	filters.RegisterSchema(filterName, filters.Schema{
+		NewConfig: func() interface{} { return new(Config) },
+		Prototype: (*Filter)(nil),
 	})
 }
 
 func NewFilter(config *Config) (filters.Filter, error) {
+	return newFilter(filterName, config)
+}
+
+func newFilter(name string, config *Config) (filters.Filter, error) {
 	ss := &Servers{
 		servers:    make([]Server, 0),
 		sshClients: lrucache.NewLRUCache(uint(len(config.Servers))),
@@ -84,22 +94,24 @@ func NewFilter(config *Config) (filters.Filter, error) {
 
 	return &Filter{
 		Config:    *config,
+		name:      name,
 		Transport: tr,
 	}, nil
 }
 
 func (p *Filter) FilterName() string {
-	return filterName
+	return p.name
 }
 
 func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
 	switch req.Method {
 	case "CONNECT":
-		glog.V(2).Infof("%s \"SSH2 %s %s %s\" - -", req.RemoteAddr, req.Method, req.Host, req.Proto)
+		glog.V(2).Infof("%s \"SSH2 %s %s %s\" - -", filters.LogPrefix(req), req.Method, req.Host, req.Proto)
 		rconn, err := f.Transport.Dial("tcp", req.Host)
 		if err != nil {
 			return ctx, nil, err
 		}
+		defer rconn.Close()
 
 		rw := filters.GetResponseWriter(ctx)
 
@@ -121,13 +133,15 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 			return ctx, nil, fmt.Errorf("%#v.Hijack() error: %v", hijacker, err)
 		}
 		defer lconn.Close()
+		defer filters.TrackConn(ctx, lconn, rconn)()
 
-		go helpers.IOCopy(rconn, lconn)
-		helpers.IOCopy(lconn, rconn)
+		up, down, err := filters.Relay(ctx, lconn, rconn)
+		glog.V(3).Infof("%s \"SSH2 %s %s %s\" relayed %d/%d bytes, err=%v", filters.LogPrefix(req), req.Method, req.Host, req.Proto, up, down, err)
 
 		return ctx, filters.DummyResponse, nil
 	default:
 		helpers.FixRequestURL(req)
+		filters.SanitizeRequest(ctx, req)
 		resp, err := f.Transport.RoundTrip(req)
 
 		if err != nil {
@@ -135,7 +149,7 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 		}
 
 		if req.RemoteAddr != "" {
-			glog.V(2).Infof("%s \"SSH2 %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+			glog.V(2).Infof("%s \"SSH2 %s %s %s\" %d %s", filters.LogPrefix(req), req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
 		}
 
 		return ctx, resp, err
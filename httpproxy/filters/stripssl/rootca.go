@@ -53,7 +53,7 @@ func NewRootCA(name string, vaildFor time.Duration, certDir string, portable boo
 	if portable {
 		exe, err := os.Executable()
 		if err != nil {
-			glog.Fatalf("os.Executable() error: %+v", err)
+			return nil, err
 		}
 		store = &storage.FileStore{filepath.Dir(exe)}
 	} else {
@@ -39,6 +39,7 @@ type Config struct {
 
 type Filter struct {
 	Config
+	name           string
 	CA             *RootCA
 	CAExpiry       time.Duration
 	TLSMaxVersion  uint16
@@ -49,35 +50,46 @@ type Filter struct {
 }
 
 func init() {
-	filters.Register(filterName, func() (filters.Filter, error) {
-		filename := filterName + ".json"
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
+		filename := name + ".json"
 		config := new(Config)
 		err := storage.LookupStoreByFilterName(filterName).UnmarshallJson(filename, config)
 		if err != nil {
-			glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			glog.Errorf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			return nil, err
 		}
-		return NewFilter(config)
+		return newFilter(name, config)
+	})
+	filters.RegisterSchema(filterName, filters.Schema{
+		NewConfig: func() interface{} { return new(Config) },
+		Prototype: (*Filter)(nil),
 	})
 }
 
 var (
-	defaultCA *RootCA
-	onceCA    sync.Once
+	defaultCA    *RootCA
+	defaultCAErr error
+	onceCA       sync.Once
 )
 
-func NewFilter(config *Config) (_ filters.Filter, err error) {
+func NewFilter(config *Config) (filters.Filter, error) {
+	return newFilter(filterName, config)
+}
+
+func newFilter(name string, config *Config) (_ filters.Filter, err error) {
 	onceCA.Do(func() {
-		defaultCA, err = NewRootCA(config.RootCA.Name,
+		defaultCA, defaultCAErr = NewRootCA(config.RootCA.Name,
 			time.Duration(config.RootCA.Duration)*time.Second,
 			config.RootCA.Dirname,
 			config.RootCA.Portable)
-		if err != nil {
-			glog.Fatalf("NewRootCA(%#v) error: %v", config.RootCA.Name, err)
-		}
 	})
+	if defaultCAErr != nil {
+		return nil, fmt.Errorf("NewRootCA(%#v) error: %v", config.RootCA.Name, defaultCAErr)
+	}
 
 	f := &Filter{
 		Config:         *config,
+		name:           name,
 		TLSMaxVersion:  tls.VersionTLS12,
 		CA:             defaultCA,
 		CAExpiry:       time.Duration(config.RootCA.Duration) * time.Second,
@@ -103,7 +115,7 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 }
 
 func (f *Filter) FilterName() string {
-	return filterName
+	return f.name
 }
 
 func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
@@ -112,7 +124,7 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 	}
 
 	if f1 := filters.GetRoundTripFilter(ctx); f1 != nil {
-		if _, ok := f.Ignores[f1.FilterName()]; ok {
+		if filters.MatchName(f.Ignores, f1.FilterName()) {
 			return ctx, req, nil
 		}
 	}
@@ -141,6 +153,7 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 	if err != nil {
 		return ctx, nil, fmt.Errorf("http.ResponseWriter Hijack failed: %s", err)
 	}
+	conn = filters.ServeTunnel(ctx, conn)
 
 	_, err = io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\n")
 	if err != nil {
@@ -148,7 +161,7 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 		return ctx, nil, err
 	}
 
-	glog.V(2).Infof("%s \"STRIP %s %s %s\" - -", req.RemoteAddr, req.Method, req.Host, req.Proto)
+	glog.V(2).Infof("%s \"STRIP %s %s %s\" - -", filters.LogPrefix(req), req.Method, req.Host, req.Proto)
 
 	var c net.Conn = conn
 	if needStripSSL {
@@ -159,32 +172,7 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 				host = h
 			}
 
-			name := GetCommonName(host)
-			ecc := helpers.HasECCCiphers(hello.CipherSuites)
-
-			var cacheKey string
-			if ecc {
-				cacheKey = name
-			} else {
-				cacheKey = name + ",rsa"
-			}
-
-			var config interface{}
-			var ok bool
-			if config, ok = f.TLSConfigCache.Get(cacheKey); !ok {
-				cert, err := f.CA.Issue(name, f.CAExpiry, ecc)
-				if err != nil {
-					return nil, err
-				}
-				config = &tls.Config{
-					Certificates:             []tls.Certificate{*cert},
-					MaxVersion:               f.TLSMaxVersion,
-					MinVersion:               tls.VersionTLS10,
-					PreferServerCipherSuites: true,
-				}
-				f.TLSConfigCache.Set(cacheKey, config, time.Now().Add(7*24*time.Hour))
-			}
-			return config.(*tls.Config), nil
+			return f.issueTLSConfig(host, helpers.HasECCCiphers(hello.CipherSuites))
 		}
 
 		config := &tls.Config{
@@ -194,7 +182,7 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 		tlsConn := tls.Server(conn, config)
 
 		if err := tlsConn.Handshake(); err != nil {
-			glog.V(2).Infof("%s %T.Handshake() error: %#v", req.RemoteAddr, tlsConn, err)
+			glog.V(2).Infof("%s %T.Handshake() error: %#v", filters.LogPrefix(req), tlsConn, err)
 			conn.Close()
 			return ctx, nil, err
 		}
@@ -212,8 +200,55 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 		return ctx, nil, err
 	}
 
-	go helpers.IOCopy(loConn, c)
-	go helpers.IOCopy(c, loConn)
+	// the relay outlives the request, it is tracked so that a shutdown
+	// drains or closes it along with the other tunnels
+	untrack := filters.TrackConn(ctx, c, loConn)
+	go func() {
+		defer untrack()
+		filters.Relay(ctx, c, loConn)
+		c.Close()
+		loConn.Close()
+	}()
 
 	return ctx, filters.DummyRequest, nil
 }
+
+// issueTLSConfig returns a cached tls.Config with a certificate of host issued
+// by the RootCA.
+func (f *Filter) issueTLSConfig(host string, ecc bool) (*tls.Config, error) {
+	name := GetCommonName(host)
+
+	var cacheKey string
+	if ecc {
+		cacheKey = name
+	} else {
+		cacheKey = name + ",rsa"
+	}
+
+	var config interface{}
+	var ok bool
+	if config, ok = f.TLSConfigCache.Get(cacheKey); !ok {
+		cert, err := f.CA.Issue(name, f.CAExpiry, ecc)
+		if err != nil {
+			return nil, err
+		}
+		config = &tls.Config{
+			Certificates:             []tls.Certificate{*cert},
+			MaxVersion:               f.TLSMaxVersion,
+			MinVersion:               tls.VersionTLS10,
+			PreferServerCipherSuites: true,
+		}
+		f.TLSConfigCache.Set(cacheKey, config, time.Now().Add(7*24*time.Hour))
+	}
+	return config.(*tls.Config), nil
+}
+
+// IssueCertificate returns a certificate of host issued by the RootCA, it is
+// used by the profiles which serve the proxy over tls.
+func (f *Filter) IssueCertificate(host string, ecc bool) (*tls.Certificate, error) {
+	config, err := f.issueTLSConfig(host, ecc)
+	if err != nil {
+		return nil, err
+	}
+	return &config.Certificates[0], nil
+}
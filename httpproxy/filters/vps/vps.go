@@ -29,23 +29,33 @@ type Config struct {
 }
 
 type Filter struct {
+	name    string
 	Servers []*Server
 	Sites   *helpers.HostMatcher
 }
 
 func init() {
-	filters.Register(filterName, func() (filters.Filter, error) {
-		filename := filterName + ".json"
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
+		filename := name + ".json"
 		config := new(Config)
 		err := storage.LookupStoreByFilterName(filterName).UnmarshallJson(filename, config)
 		if err != nil {
-			glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			glog.Errorf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			return nil, err
 		}
-		return NewFilter(config)
+		return newFilter(name, config)
+	})
+	filters.RegisterSchema(filterName, filters.Schema{
+		NewConfig: func() interface{} { return new(Config) },
+		Prototype: (*Filter)(nil),
 	})
 }
 
 func NewFilter(config *Config) (filters.Filter, error) {
+	return newFilter(filterName, config)
+}
+
+func newFilter(name string, config *Config) (filters.Filter, error) {
 	servers := make([]*Server, 0)
 	for _, fs := range config.Servers {
 		u, err := url.Parse(fs.URL)
@@ -67,12 +77,13 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	}
 
 	return &Filter{
+		name:    name,
 		Servers: servers,
 	}, nil
 }
 
 func (p *Filter) FilterName() string {
-	return filterName
+	return p.name
 }
 
 func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
@@ -117,11 +128,12 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 	// 	ctx.Hijack(true)
 	// 	return ctx, nil, nil
 	// }
+	filters.SanitizeRequest(ctx, req)
 	resp, err := server.RoundTrip(req)
 	if err != nil {
 		return ctx, nil, err
 	} else {
-		glog.V(2).Infof("%s \"VPS %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+		glog.V(2).Infof("%s \"VPS %s %s %s\" %d %s", filters.LogPrefix(req), req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
 	}
 	return ctx, resp, err
 }
@@ -7,20 +7,8 @@ import (
 	"net/url"
 
 	"github.com/phuslu/net/http2"
-)
 
-var (
-	reqWriteExcludeHeader = map[string]bool{
-		"Vary":                true,
-		"Via":                 true,
-		"X-Forwarded-For":     true,
-		"Proxy-Authorization": true,
-		"Proxy-Connection":    true,
-		"Upgrade":             true,
-		"X-Chrome-Variations": true,
-		"Connection":          true,
-		"Cache-Control":       true,
-	}
+	"github.com/xuiv/goproxy/httpproxy/helpers"
 )
 
 type Server struct {
@@ -32,7 +20,7 @@ type Server struct {
 }
 
 func (f *Server) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	for key, shouldDelete := range reqWriteExcludeHeader {
+	for key, shouldDelete := range helpers.ReqWriteExcludeHeader {
 		if shouldDelete && req.Header.Get(key) != "" {
 			req.Header.Del(key)
 		}
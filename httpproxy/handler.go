@@ -2,39 +2,284 @@ package httpproxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"os"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/phuslu/glog"
 
 	"github.com/xuiv/goproxy/httpproxy/filters"
 	"github.com/xuiv/goproxy/httpproxy/helpers"
+	"github.com/xuiv/goproxy/httpproxy/metrics"
 )
 
-type Handler struct {
-	Listener         helpers.Listener
+// FilterChain holds the filters of a profile and the settings they share,
+// e.g. the limits of the tunnels and the forward policy, it is replaced as a
+// whole on reload so that a request never sees a half updated chain.
+type FilterChain struct {
 	RequestFilters   []filters.RequestFilter
 	RoundTripFilters []filters.RoundTripFilter
 	ResponseFilters  []filters.ResponseFilter
-	Branding         string
+	ErrorPages       *ErrorPages
+	RelayOptions     *helpers.RelayOptions
+	FlushInterval    time.Duration
+	ForwardPolicy    *helpers.ForwardPolicy
+	RequestIDHeader  string
+	TrafficMeter     *TrafficMeter
+	Quotas           []*Quota
+
+	// the requests being served with the chain, the filters replaced by a
+	// reload are closed once the old chains are drained
+	inflight int64
+	closed   int32
+}
+
+// close releases the TrafficMeter of fc once fc is no longer used, it may be
+// called more than once.
+func (fc *FilterChain) close() {
+	if !atomic.CompareAndSwapInt32(&fc.closed, 0, 1) || fc.TrafficMeter == nil {
+		return
+	}
+	if err := fc.TrafficMeter.Close(); err != nil {
+		glog.Warningf("TrafficMeter close %#v error: %v", fc.TrafficMeter.Filename, err)
+	}
+}
+
+// drain waits for the requests being served with fc.
+func (fc *FilterChain) drain() {
+	for {
+		// a request may have loaded fc right before it is replaced
+		time.Sleep(100 * time.Millisecond)
+		if atomic.LoadInt64(&fc.inflight) == 0 {
+			return
+		}
+	}
+}
+
+var (
+	requestsTotal      = metrics.NewCounterVec("goproxy_requests_total", "Requests served, by profile, round trip filter and status code.", "profile", "filter", "code")
+	responseBytesTotal = metrics.NewCounterVec("goproxy_response_bytes_total", "Response body and tunnel bytes copied to clients, by profile and round trip filter.", "profile", "filter")
+	roundTripSeconds   = metrics.NewHistogramVec("goproxy_roundtrip_duration_seconds", "Time until a round trip filter returns the response header, by profile and round trip filter.", nil, "profile", "filter")
+)
+
+type Handler struct {
+	Listener    net.Listener
+	Profile     string
+	Branding    string
+	ConnTracker *helpers.ConnTracker
+	Conns       *ConnTable
+	Traces      *TraceLog
+	AccessLog   *AccessLogger
+	chain       atomic.Value
+}
+
+// NewHandler returns a Handler which serves the requests accepted by ln with
+// fc, e.g. for embedding goproxy into another program
+//
+//	f, err := direct.NewFilter(&direct.Config{...})
+//	...
+//	fc := &httpproxy.FilterChain{
+//		RoundTripFilters: []filters.RoundTripFilter{f.(filters.RoundTripFilter)},
+//	}
+//	s := httpproxy.NewHandlerServer(httpproxy.Config{}, httpproxy.NewHandler(ln, fc, "goproxy"))
+//	go s.Serve()
+//
+// The fields of fc left nil fall back to the defaults, the built-in error
+// pages and no limits.
+func NewHandler(ln net.Listener, fc *FilterChain, branding string) *Handler {
+	h := &Handler{
+		Listener:    ln,
+		Branding:    branding,
+		ConnTracker: helpers.NewConnTracker(),
+		Conns:       NewConnTable(),
+		Traces:      NewTraceLog(DefaultTraceLogSize),
+	}
+	h.SetFilterChain(fc)
+	return h
 }
 
-func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+func (h *Handler) FilterChain() *FilterChain {
+	fc, _ := h.chain.Load().(*FilterChain)
+	return fc
+}
+
+func (h *Handler) SetFilterChain(fc *FilterChain) {
+	h.chain.Store(fc)
+}
+
+func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	var err error
 
 	remoteAddr := req.RemoteAddr
+	fc := h.FilterChain()
+	atomic.AddInt64(&fc.inflight, 1)
+	defer atomic.AddInt64(&fc.inflight, -1)
+
+	// Requests redirected to a transparent listener are sent to the origin
+	if dst, ok := req.Context().Value(originalDstKey).(net.Addr); ok && req.Method != "CONNECT" && !req.URL.IsAbs() {
+		req.URL.Scheme = "http"
+		if req.Host != "" {
+			req.URL.Host = req.Host
+		} else {
+			req.URL.Host = dst.String()
+		}
+	}
+
+	// Account the request, code is "-" if the response is written by a filter
+	filterName, code, errMsg := "-", "-", ""
+	defer func() {
+		requestsTotal.Inc(h.Profile, filterName, code)
+	}()
+
+	// Track the request in the connection table, so that it could be listed
+	// and closed through the admin listener
+	start := time.Now()
+	target := req.URL.String()
+	if req.Method == "CONNECT" {
+		target = req.Host
+	}
 
-	// Prepare filter.Context
-	ctx := filters.NewContext(req.Context(), h, h.Listener, rw, h.Branding)
+	cw := &connWriter{ResponseWriter: rw}
+	rw = cw
+
+	var body *countingReadCloser
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &countingReadCloser{ReadCloser: req.Body}
+		req.Body = body
+	}
+
+	reqCtx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	// Prepare filter.Context, the round trips of the transports are traced
+	ctx := filters.NewContext(reqCtx, h, h.Listener, rw, h.Branding)
+	ctx = httptrace.WithClientTrace(ctx, filters.ClientTrace(ctx))
+	filters.SetConnTracker(ctx, h.ConnTracker)
+	filters.SetRelayOptions(ctx, fc.RelayOptions)
+	filters.SetForwardPolicy(ctx, fc.ForwardPolicy)
+	filters.SetRequestIDHeader(ctx, fc.RequestIDHeader)
+	filters.SetProfile(ctx, h.Profile)
+	if fc.TrafficMeter != nil && len(fc.Quotas) > 0 {
+		ip := clientIP(remoteAddr)
+		filters.SetQuotaCheck(ctx, func(name string) error {
+			return fc.checkQuota(filters.User(ctx), ip, name)
+		})
+	}
+	// The tunnels are counted once closed, under the filter serving the
+	// request then, e.g. the relays of stripssl outlive the handler
+	var serving atomic.Value
+	serving.Store("")
+	filters.SetRelayCounter(ctx, func(up, down int64) {
+		responseBytesTotal.Add(float64(down), h.Profile, serving.Load().(string))
+	})
 	req = req.WithContext(ctx)
 
+	conn, _ := req.Context().Value(connKey).(net.Conn)
+	filters.SetConn(ctx, conn)
+	entry := &connEntry{
+		ConnInfo: ConnInfo{
+			Profile: h.Profile,
+			Client:  remoteAddr,
+			Method:  req.Method,
+			Target:  target,
+			Start:   start,
+		},
+		w:      cw,
+		body:   body,
+		conn:   conn,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	h.Conns.add(entry)
+	defer h.Conns.remove(entry)
+
+	// Count the traffic as it goes, the tunnels may last for hours
+	if m := fc.TrafficMeter; m != nil {
+		m.track(entry.ID, func() { fc.countTraffic(entry) })
+		defer func() {
+			m.untrack(entry.ID)
+			fc.countTraffic(entry)
+		}()
+	}
+
+	// The request ID goes to the client, the log lines and the timeline
+	requestID := entry.RequestID
+	filters.SetRequestID(ctx, requestID)
+	rw.Header().Set("X-Request-Id", requestID)
+	filters.Trace(ctx, "request", "%s %s %s", req.Method, target, req.Proto)
+	defer func() {
+		status := cw.status
+		if status == 0 && cw.tunnel() != nil {
+			status = http.StatusOK
+		}
+		h.Traces.add(&RequestTrace{
+			ConnInfo: entry.info(),
+			Status:   status,
+			Done:     true,
+			Events:   filters.GetTrace(ctx),
+		})
+	}()
+
+	if h.AccessLog != nil {
+		record := &AccessRecord{
+			Time:      start,
+			RequestID: requestID,
+			Profile:   h.Profile,
+			Client:    remoteAddr,
+			Method:    req.Method,
+			URL:       target,
+			Proto:     req.Proto,
+			Referer:   req.Referer(),
+			Agent:     req.UserAgent(),
+		}
+
+		defer func() {
+			record.Filter = filterName
+			record.User = filters.User(ctx)
+			record.Status = cw.status
+			if record.Status == 0 && cw.tunnel() != nil {
+				record.Status = http.StatusOK
+			}
+			record.BytesIn, record.BytesOut = cw.bytes()
+			if body != nil {
+				record.BytesIn += atomic.LoadInt64(&body.n)
+			}
+			record.Duration = time.Since(start)
+			record.Error = errMsg
+			record.Fields = filters.GetLogFields(req.Context())
+			h.AccessLog.Log(record)
+		}()
+	}
+
+	// Errors are rendered by the error pages, unless the connection is hijacked
+	writeError := func(req *http.Request, filter string, err error) {
+		code, errMsg = "-", err.Error()
+		if cw.tunnel() != nil {
+			return
+		}
+		errorPages := fc.ErrorPages
+		if errorPages == nil {
+			errorPages = defaultErrorPages()
+		}
+		var quotaErr *QuotaError
+		if errors.As(err, &quotaErr) && quotaErr.Status == http.StatusTooManyRequests {
+			rw.Header().Set("Retry-After", strconv.Itoa(int(time.Until(quotaErr.Reset).Seconds())+1))
+		}
+		info := h.newErrorInfo(req, filter, requestID, err)
+		code = strconv.Itoa(errorPages.Write(rw, req, info))
+		filters.Trace(ctx, "error", "status=%s class=%s", code, info.Class)
+	}
+
 	// Enable transport http proxy
 	if req.Method != "CONNECT" && !req.URL.IsAbs() {
 		if req.URL.Scheme == "" {
@@ -64,14 +309,19 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	// Filter Request
-	for _, f := range h.RequestFilters {
+	for _, f := range fc.RequestFilters {
+		req0 := req
+		serving.Store(f.FilterName())
 		ctx, req, err = f.Request(ctx, req)
 		if req == filters.DummyRequest {
 			return
 		}
 		if err != nil {
 			if err != io.EOF {
-				glog.Errorf("%s Filter Request %T error: %+v", remoteAddr, f, err)
+				if !isRefused(err) {
+					glog.Errorf("%s Filter Request %T error: %+v", filters.LogPrefix(req0), f, err)
+				}
+				writeError(req0.WithContext(ctx), f.FilterName(), err)
 			}
 			return
 		}
@@ -85,16 +335,51 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
 	// Filter Request -> Response
 	var resp *http.Response
-	for _, f := range h.RoundTripFilters {
+	var skipped string
+	for _, f := range fc.RoundTripFilters {
+		// The filters out of the policy of the user are passed over
+		if !filters.AllowFilter(ctx, f.FilterName()) {
+			skipped = f.FilterName()
+			continue
+		}
+		// The traffic quota of the user for the filter refuses the request
+		if err = filters.CheckQuota(ctx, f.FilterName()); err != nil {
+			filterName = f.FilterName()
+			glog.V(1).Infof("%s Filter RoundTrip %T refused: %v", filters.LogPrefix(req), f, err)
+			writeError(req, filterName, err)
+			return
+		}
+		start := time.Now()
+		if f1 := filters.GetRoundTripFilter(ctx); f1 != nil {
+			serving.Store(f1.FilterName())
+		} else {
+			serving.Store(f.FilterName())
+		}
+		entry.setFilter(serving.Load().(string))
+		filters.Trace(ctx, "round_trip", "%s", f.FilterName())
 		ctx, resp, err = f.RoundTrip(ctx, req)
+		if resp != nil || err != nil {
+			// Attribute to the filter delegated to, e.g. by autoproxy
+			if f1 := filters.GetRoundTripFilter(ctx); f1 != nil {
+				filterName = f1.FilterName()
+			} else {
+				filterName = f.FilterName()
+			}
+			entry.setFilter(filterName)
+		}
 		if resp == filters.DummyResponse {
 			return
 		}
+		if resp != nil || err != nil {
+			roundTripSeconds.Observe(time.Since(start).Seconds(), h.Profile, filterName)
+		}
 		// Unexcepted errors
 		if err != nil {
 			filters.SetRoundTripFilter(ctx, f)
-			glog.Errorf("%s Filter RoundTrip %T error: %+v", remoteAddr, f, err)
-			http.Error(rw, h.FormatError(ctx, err), http.StatusBadGateway)
+			if !isRefused(err) {
+				glog.Errorf("%s Filter RoundTrip %T error: %+v", filters.LogPrefix(req), f, err)
+			}
+			writeError(req, filterName, err)
 			return
 		}
 		// Update context for request
@@ -108,26 +393,37 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	// Filter Response
-	for _, f := range h.ResponseFilters {
+	for _, f := range fc.ResponseFilters {
 		if resp == nil || resp == filters.DummyResponse {
 			return
 		}
 		ctx, resp, err = f.Response(ctx, resp)
 		if err != nil {
-			glog.Errorln("%s Filter %T Response error: %+v", remoteAddr, f, err)
-			http.Error(rw, h.FormatError(ctx, err), http.StatusBadGateway)
+			glog.Errorf("%s Filter %T Response error: %+v", filters.LogPrefix(req), f, err)
+			writeError(req, filterName, err)
 			return
 		}
 		// Update context for request
 		req = req.WithContext(ctx)
 	}
 
+	if resp == nil && skipped != "" {
+		writeError(req, skipped, fmt.Errorf("%w: %s is not allowed", filters.ErrBlocked, skipped))
+		return
+	}
+
 	if resp == nil {
-		glog.Errorln("%s Handler %#v Response empty response", remoteAddr, h)
-		http.Error(rw, h.FormatError(ctx, fmt.Errorf("empty response")), http.StatusBadGateway)
+		glog.Errorf("%s Handler %#v Response empty response", filters.LogPrefix(req), h)
+		writeError(req, filterName, fmt.Errorf("empty response"))
 		return
 	}
 
+	// The challenge of a 407 is meant for the client of this proxy
+	auth := resp.Header["Proxy-Authenticate"]
+	helpers.RemoveHopHeaders(resp.Header)
+	if resp.StatusCode == http.StatusProxyAuthRequired && len(auth) > 0 {
+		resp.Header["Proxy-Authenticate"] = auth
+	}
 	if resp.Header.Get("Content-Length") == "" && resp.ContentLength >= 0 {
 		resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
 	}
@@ -137,14 +433,26 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		}
 	}
 	rw.WriteHeader(resp.StatusCode)
+	code = strconv.Itoa(resp.StatusCode)
+	filters.Trace(ctx, "response_header", "status=%d", resp.StatusCode)
 	if resp.Body != nil {
 		defer resp.Body.Close()
-		n, err := helpers.IOCopy(rw, resp.Body)
+		var n int64
+		var err error
+		// Event streams and long-polls are flushed as they arrive
+		if flusher, ok := rw.(http.Flusher); ok && helpers.IsStreamingResponse(resp) {
+			n, err = helpers.IOCopyFlush(rw, flusher, resp.Body, fc.FlushInterval)
+		} else {
+			n, err = helpers.IOCopy(rw, resp.Body)
+		}
+		responseBytesTotal.Add(float64(n), h.Profile, filterName)
+		filters.Trace(ctx, "response_done", "bytes=%d err=%v", n, err)
 		if err != nil {
+			errMsg = err.Error()
 			if isClosedConnError(err) {
-				glog.Infof("IOCopy %#v return %#v %T(%v)", resp.Body, n, err, err)
+				glog.Infof("%s IOCopy %#v return %#v %T(%v)", filters.LogPrefix(req), resp.Body, n, err, err)
 			} else {
-				glog.Warningf("IOCopy %#v return %#v %T(%v)", resp.Body, n, err, err)
+				glog.Warningf("%s IOCopy %#v return %#v %T(%v)", filters.LogPrefix(req), resp.Body, n, err, err)
 			}
 			if oe, ok := resp.Body.(interface {
 				OnError(err error)
@@ -156,18 +464,47 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (h Handler) FormatError(ctx context.Context, err error) string {
-	return fmt.Sprintf(`{
-    "type": "localproxy",
-    "host": "%s",
-    "software": "%s (go/%s %s/%s)",
-    "filter": "%T",
-    "error": "%s"
+type contextKey int
+
+const (
+	originalDstKey contextKey = iota
+	connKey
+)
+
+// withConn saves the accepted connection, and the original destination of
+// the ones accepted by a transparent listener, to the context of their
+// requests.
+func withConn(ctx context.Context, c net.Conn) context.Context {
+	ctx = context.WithValue(ctx, connKey, c)
+	if dst, ok := helpers.OriginalDst(c); ok {
+		return context.WithValue(ctx, originalDstKey, dst)
+	}
+	return ctx
 }
-`, filters.GetListener(ctx).Addr().String(),
-		h.Branding, runtime.Version(), runtime.GOOS, runtime.GOARCH,
-		filters.GetRoundTripFilter(ctx),
-		err.Error())
+
+// isRefused reports whether err refuses a request on purpose, e.g. by the
+// policy or a traffic quota of the user, rather than fails it.
+func isRefused(err error) bool {
+	var quotaErr *QuotaError
+	return errors.Is(err, filters.ErrBlocked) || errors.As(err, &quotaErr)
+}
+
+// FormatError returns the JSON error page of err for the round trip filter
+// of ctx.
+//
+// Deprecated: the errors are written by the ErrorPages of the FilterChain of
+// h, use them instead.
+func (h *Handler) FormatError(ctx context.Context, err error) string {
+	filter := "-"
+	if f := filters.GetRoundTripFilter(ctx); f != nil {
+		filter = f.FilterName()
+	}
+	errorPages := defaultErrorPages()
+	if fc := h.FilterChain(); fc != nil && fc.ErrorPages != nil {
+		errorPages = fc.ErrorPages
+	}
+	_, b := errorPages.render("application/json", h.newErrorInfo(nil, filter, "", err))
+	return string(b)
 }
 
 func isClosedConnError(err error) bool {
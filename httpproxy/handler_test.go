@@ -0,0 +1,236 @@
+package httpproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xuiv/goproxy/httpproxy/filters"
+	"github.com/xuiv/goproxy/httpproxy/filters/auth"
+)
+
+// testRoundTripFilter answers every request with body, once hold is closed
+// if it is not nil.
+type testRoundTripFilter struct {
+	name string
+	body []byte
+	hold chan struct{}
+}
+
+func (f *testRoundTripFilter) FilterName() string {
+	return f.name
+}
+
+func (f *testRoundTripFilter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	if f.hold != nil {
+		<-f.hold
+	}
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{},
+		Request:       req,
+		Close:         true,
+		ContentLength: int64(len(f.body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(f.body)),
+	}
+	return ctx, resp, nil
+}
+
+// TestInstalledFilterChain builds a chain of an installed filter by name and
+// serves it on a listener of its own, the way goproxy is embedded.
+func TestInstalledFilterChain(t *testing.T) {
+	installTestFilter(t, &testRoundTripFilter{name: "test-embedded", body: []byte("embedded")})
+
+	fc, err := newFilterChain(Config{RoundTripFilters: []string{"test-embedded"}}, filters.GetFilter)
+	if err != nil {
+		t.Fatalf("newFilterChain error: %v", err)
+	}
+	if _, err := newFilterChain(Config{RoundTripFilters: []string{"test-missing"}}, filters.GetFilter); err == nil {
+		t.Errorf("newFilterChain of an unknown filter error is nil")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %v", err)
+	}
+	s := NewHandlerServer(Config{}, NewHandler(ln, fc, "goproxy"))
+	go s.Serve()
+	defer s.Shutdown(context.Background())
+
+	if body := proxyGet(t, ln.Addr().String()); body != "embedded" {
+		t.Errorf("GET = %#v, want \"embedded\"", body)
+	}
+}
+
+// TestFormatError renders an error of a round trip filter by the error pages
+// of the chain.
+func TestFormatError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %v", err)
+	}
+	defer ln.Close()
+
+	h := NewHandler(ln, &FilterChain{}, "goproxy")
+	ctx := filters.NewContext(context.Background(), h, ln, nil, "goproxy")
+	filters.SetRoundTripFilter(ctx, &testRoundTripFilter{name: "test-format"})
+
+	var info ErrorInfo
+	if err := json.Unmarshal([]byte(h.FormatError(ctx, filters.ErrBlocked)), &info); err != nil {
+		t.Fatalf("FormatError is not JSON: %v", err)
+	}
+	if info.Filter != "test-format" || info.Class != ErrorClassBlocked || info.Host != ln.Addr().String() {
+		t.Errorf("FormatError = %+v", info)
+	}
+}
+
+// newTestAuthFilter returns an auth filter of the user alice with the
+// password "secret".
+func newTestAuthFilter(t *testing.T) filters.RequestFilter {
+	config := &auth.Config{Realm: "goproxy", CacheSize: 16, CacheTTL: 60}
+	config.Basic = append(config.Basic, struct {
+		Username string
+		Password string
+	}{"alice", "secret"})
+
+	f, err := auth.NewFilter(config)
+	if err != nil {
+		t.Fatalf("auth.NewFilter error: %v", err)
+	}
+	return f.(filters.RequestFilter)
+}
+
+func basicAuth(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func TestAuthRequestFilterOnly(t *testing.T) {
+	fc := &FilterChain{
+		RequestFilters:   []filters.RequestFilter{newTestAuthFilter(t)},
+		RoundTripFilters: []filters.RoundTripFilter{&testRoundTripFilter{name: "direct", body: []byte("hello")}},
+	}
+	h := NewHandler(nil, fc, "goproxy")
+
+	for _, c := range []struct {
+		method        string
+		authorization string
+		status        int
+	}{
+		{http.MethodGet, "", http.StatusProxyAuthRequired},
+		{http.MethodGet, basicAuth("alice", "wrong"), http.StatusProxyAuthRequired},
+		{http.MethodPost, basicAuth("bob", "secret"), http.StatusProxyAuthRequired},
+		{http.MethodGet, basicAuth("alice", "secret"), http.StatusOK},
+	} {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(c.method, "http://example.com/", nil)
+		if c.authorization != "" {
+			req.Header.Set("Proxy-Authorization", c.authorization)
+		}
+		h.ServeHTTP(rw, req)
+
+		if rw.Code != c.status {
+			t.Errorf("%s with %#v = %d, want %d", c.method, c.authorization, rw.Code, c.status)
+		}
+		if c.status == http.StatusProxyAuthRequired {
+			if rw.Header().Get("Proxy-Authenticate") == "" {
+				t.Errorf("%s with %#v has no Proxy-Authenticate", c.method, c.authorization)
+			}
+			if rw.Body.String() == "hello" {
+				t.Errorf("%s with %#v is served by the RoundTripFilter", c.method, c.authorization)
+			}
+		}
+	}
+}
+
+// TestConnsUserRace lists the conns of the admin listener while the requests
+// are authenticated, the user is set and read by different goroutines.
+func TestConnsUserRace(t *testing.T) {
+	hold := make(chan struct{})
+	fc := &FilterChain{
+		RequestFilters:   []filters.RequestFilter{newTestAuthFilter(t)},
+		RoundTripFilters: []filters.RoundTripFilter{&testRoundTripFilter{name: "direct", hold: hold}},
+	}
+	h := NewHandler(nil, fc, "goproxy")
+	a := newTestAdmin(t, h)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.Header.Set("Proxy-Authorization", basicAuth("alice", "secret"))
+			h.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+
+	// the requests wait in RoundTrip until all of them are listed as alice
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var conns []ConnInfo
+		a.get(t, "/conns", &conns)
+
+		n := 0
+		for _, c := range conns {
+			if c.User == "alice" {
+				n++
+			}
+		}
+		if n == 8 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("/conns lists %d requests of alice, want 8: %+v", n, conns)
+		}
+	}
+
+	close(hold)
+	wg.Wait()
+}
+
+type testAdmin struct {
+	*Admin
+}
+
+// newTestAdmin returns an Admin of the profile "default" served by h.
+func newTestAdmin(t *testing.T, h *Handler) *testAdmin {
+	h.Profile = "default"
+	profiles := NewProfiles("goproxy")
+	profiles.servers["default"] = NewHandlerServer(Config{}, h)
+
+	a, err := NewAdmin(AdminConfig{Address: "127.0.0.1:0", Username: "admin", Password: "admin"}, profiles)
+	if err != nil {
+		t.Fatalf("NewAdmin error: %v", err)
+	}
+	a.Listener.Close()
+
+	return &testAdmin{a}
+}
+
+// do returns the answer of the request of method and path.
+func (a *testAdmin) do(method, path string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, nil)
+	req.SetBasicAuth(a.Config.Username, a.Config.Password)
+	a.ServeHTTP(rw, req)
+	return rw
+}
+
+// get decodes the JSON answer of the GET of path to v.
+func (a *testAdmin) get(t *testing.T, path string, v interface{}) {
+	rw := a.do(http.MethodGet, path)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d: %s", path, rw.Code, rw.Body.String())
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), v); err != nil {
+		t.Fatalf("GET %s json.Unmarshal error: %v", path, err)
+	}
+}
@@ -0,0 +1,96 @@
+package helpers
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+// KeyedCache is a lrucache.Cache which keeps track of its keys, so that the
+// entries could be listed, e.g. by an admin endpoint.
+type KeyedCache struct {
+	lrucache.Cache
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+// CacheEntry is an entry listed by KeyedCache.Entries.
+type CacheEntry struct {
+	Key   string
+	Value interface{}
+}
+
+func NewKeyedCache(c lrucache.Cache) *KeyedCache {
+	return &KeyedCache{
+		Cache: c,
+		keys:  make(map[string]struct{}),
+	}
+}
+
+func (c *KeyedCache) Set(key string, value interface{}, expire time.Time) {
+	c.Cache.Set(key, value, expire)
+	c.addKey(key)
+}
+
+func (c *KeyedCache) SetNow(key string, value interface{}, expire time.Time, now time.Time) {
+	c.Cache.SetNow(key, value, expire, now)
+	c.addKey(key)
+}
+
+func (c *KeyedCache) Del(key string) (interface{}, bool) {
+	c.mu.Lock()
+	delete(c.keys, key)
+	c.mu.Unlock()
+	return c.Cache.Del(key)
+}
+
+func (c *KeyedCache) Clear() int {
+	c.mu.Lock()
+	c.keys = make(map[string]struct{})
+	c.mu.Unlock()
+	return c.Cache.Clear()
+}
+
+func (c *KeyedCache) addKey(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys[key] = struct{}{}
+	// keys of evicted entries are not reported by lrucache, prune them once
+	// the set grows well past the capacity.
+	if len(c.keys) > 2*c.Cache.Capacity() {
+		c.prune()
+	}
+}
+
+func (c *KeyedCache) prune() {
+	for key := range c.keys {
+		if _, ok := c.Cache.GetQuiet(key); !ok {
+			delete(c.keys, key)
+		}
+	}
+}
+
+// Entries returns the entries of the cache sorted by key, possibly stale,
+// without touching their LRU scores.
+func (c *KeyedCache) Entries() []CacheEntry {
+	c.mu.Lock()
+	c.prune()
+	keys := make([]string, 0, len(c.keys))
+	for key := range c.keys {
+		keys = append(keys, key)
+	}
+	c.mu.Unlock()
+
+	sort.Strings(keys)
+
+	entries := make([]CacheEntry, 0, len(keys))
+	for _, key := range keys {
+		if value, ok := c.Cache.GetQuiet(key); ok {
+			entries = append(entries, CacheEntry{Key: key, Value: value})
+		}
+	}
+
+	return entries
+}
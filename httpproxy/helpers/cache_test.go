@@ -0,0 +1,34 @@
+package helpers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+func TestKeyedCacheEntries(t *testing.T) {
+	c := NewKeyedCache(lrucache.NewLRUCache(2))
+
+	c.Set("b", 2, time.Time{})
+	c.Set("a", 1, time.Time{})
+	c.Set("c", 3, time.Time{})
+
+	entries := c.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("len(c.Entries()) = %d, want 2", len(entries))
+	}
+	if entries[0].Key != "a" || entries[1].Key != "c" {
+		t.Errorf("c.Entries() = %#v, want keys a and c", entries)
+	}
+
+	c.Del("a")
+	if entries := c.Entries(); len(entries) != 1 || entries[0].Value != 3 {
+		t.Errorf("c.Entries() = %#v after Del, want c only", entries)
+	}
+
+	c.Clear()
+	if entries := c.Entries(); len(entries) != 0 {
+		t.Errorf("c.Entries() = %#v after Clear, want none", entries)
+	}
+}
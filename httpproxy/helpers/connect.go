@@ -0,0 +1,134 @@
+package helpers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	connectMaxResponseHeadSize = 64 << 10
+)
+
+// connectConn reads as a http CONNECT request followed by the client data.
+// The head of the http response written to it is not sent to the client but
+// passed to reply, and the connection is closed unless the status is 2xx.
+type connectConn struct {
+	net.Conn
+	req   *bytes.Buffer
+	br    *bufio.Reader
+	reply func(w io.Writer, status int) error
+
+	mu      sync.Mutex
+	head    []byte
+	replied bool
+	failed  bool
+}
+
+func (c *connectConn) Read(p []byte) (int, error) {
+	if c.req.Len() > 0 {
+		return c.req.Read(p)
+	}
+	if c.br.Buffered() == 0 {
+		return c.Conn.Read(p)
+	}
+	return c.br.Read(p)
+}
+
+func (c *connectConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.failed {
+		return 0, io.ErrClosedPipe
+	}
+
+	if c.replied {
+		return c.Conn.Write(p)
+	}
+
+	c.head = append(c.head, p...)
+	i := bytes.Index(c.head, []byte("\r\n\r\n"))
+	if i < 0 {
+		if len(c.head) > connectMaxResponseHeadSize {
+			c.fail(0)
+			return 0, fmt.Errorf("connect: response head too large")
+		}
+		return len(p), nil
+	}
+
+	status := parseStatusCode(c.head[:i])
+	rest := c.head[i+4:]
+	c.head = nil
+
+	if status < 200 || status > 299 {
+		c.fail(status)
+		return len(p), nil
+	}
+
+	if c.reply != nil {
+		if err := c.reply(c.Conn, status); err != nil {
+			return 0, err
+		}
+	}
+	c.replied = true
+
+	if len(rest) > 0 {
+		if _, err := c.Conn.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// NetConn returns the underlying connection.
+func (c *connectConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Buffered returns the bytes which are pending to be read or written through
+// c, they are not empty until the response head is written.
+func (c *connectConn) Buffered() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.req.Len() + c.br.Buffered()
+	if !c.replied {
+		n += 1 + len(c.head)
+	}
+	return n
+}
+
+// fail replies the failure status if possible and closes the connection.
+func (c *connectConn) fail(status int) {
+	if c.reply != nil {
+		c.reply(c.Conn, status)
+	}
+	c.failed = true
+	c.Conn.Close()
+}
+
+func parseStatusCode(head []byte) int {
+	line := head
+	if i := bytes.IndexByte(line, '\r'); i >= 0 {
+		line = line[:i]
+	}
+
+	parts := strings.SplitN(string(line), " ", 3)
+	if len(parts) < 2 {
+		return 0
+	}
+
+	code, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0
+	}
+
+	return code
+}
@@ -0,0 +1,20 @@
+package helpers
+
+import (
+	"context"
+	"time"
+)
+
+// SleepContext pauses for d like time.Sleep, it returns the error of ctx at
+// once if ctx is done before that.
+func SleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,24 @@
+package helpers
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSleepContext(t *testing.T) {
+	if err := SleepContext(context.Background(), time.Millisecond); err != nil {
+		t.Errorf("SleepContext() error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start := time.Now()
+	if err := SleepContext(ctx, time.Minute); err != context.Canceled {
+		t.Errorf("SleepContext() error = %v, want %v", err, context.Canceled)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("SleepContext() returned after %s", d)
+	}
+}
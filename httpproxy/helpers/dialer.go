@@ -1,8 +1,12 @@
 package helpers
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"net/http/httptrace"
+	"strings"
 
 	"github.com/phuslu/glog"
 )
@@ -17,30 +21,60 @@ type Dialer struct {
 }
 
 func (d *Dialer) Dial(network, address string) (conn net.Conn, err error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext is Dial reporting the dns lookup and the connect to the
+// httptrace.ClientTrace of ctx.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
 	glog.V(3).Infof("Dail(%#v, %#v)", network, address)
 
+	trace := httptrace.ContextClientTrace(ctx)
+
 	switch network {
 	case "tcp", "tcp4", "tcp6":
 		if d.Resolver != nil {
 			if host, port, err := net.SplitHostPort(address); err == nil {
-				if ips, err := d.Resolver.LookupIP(host); err == nil {
+				if trace != nil && trace.DNSStart != nil {
+					trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+				}
+				ips, err := d.Resolver.LookupIP(host)
+				if trace != nil && trace.DNSDone != nil {
+					addrs := make([]net.IPAddr, len(ips))
+					for i, ip := range ips {
+						addrs[i] = net.IPAddr{IP: ip}
+					}
+					trace.DNSDone(httptrace.DNSDoneInfo{Addrs: addrs, Err: err})
+				}
+				if err == nil {
 					if len(ips) == 0 {
 						return nil, net.InvalidAddrError(fmt.Sprintf("Invaid DNS Record: %s", address))
 					}
-					return d.dialMulti(network, address, ips, port)
+					return d.dialMulti(trace, network, address, ips, port)
 				}
 			}
 		}
 	}
 
-	return d.Dialer.Dial(network, address)
+	return d.dial(trace, network, address)
+}
+
+func (d *Dialer) dial(trace *httptrace.ClientTrace, network, address string) (net.Conn, error) {
+	if trace != nil && trace.ConnectStart != nil {
+		trace.ConnectStart(network, address)
+	}
+	conn, err := d.Dialer.Dial(network, address)
+	if trace != nil && trace.ConnectDone != nil {
+		trace.ConnectDone(network, address, err)
+	}
+	return conn, err
 }
 
-func (d *Dialer) dialMulti(network, address string, ips []net.IP, port string) (conn net.Conn, err error) {
+func (d *Dialer) dialMulti(trace *httptrace.ClientTrace, network, address string, ips []net.IP, port string) (conn net.Conn, err error) {
 	if d.Level <= 1 || len(ips) == 1 {
 		for i, ip := range ips {
 			addr := net.JoinHostPort(ip.String(), port)
-			conn, err := d.Dialer.Dial(network, addr)
+			conn, err := d.dial(trace, network, addr)
 			if err != nil {
 				if i < len(ips)-1 {
 					continue
@@ -62,18 +96,25 @@ func (d *Dialer) dialMulti(network, address string, ips []net.IP, port string) (
 			ips = ips[:level]
 		}
 
+		addrs := make([]string, level)
+		for i := range addrs {
+			addrs[i] = net.JoinHostPort(ips[i].String(), port)
+		}
+		traceRace(trace, network, addrs)
+
 		lane := make(chan racer, level)
 		for i := 0; i < level; i++ {
 			go func(addr string, c chan<- racer) {
 				conn, err := d.Dialer.Dial(network, addr)
 				lane <- racer{conn, err}
-			}(net.JoinHostPort(ips[i].String(), port), lane)
+			}(addrs[i], lane)
 		}
 
 		var r racer
 		for j := 0; j < level; j++ {
 			r = <-lane
 			if r.e == nil {
+				traceRaceWinner(trace, network, r.c)
 				go func(count int) {
 					var r1 racer
 					for ; count > 0; count-- {
@@ -90,3 +131,25 @@ func (d *Dialer) dialMulti(network, address string, ips []net.IP, port string) (
 
 	return nil, net.UnknownNetworkError("Unkown transport/direct error")
 }
+
+// traceRace reports the start of a dial race of addrs as one connect to the
+// comma separated addrs.
+func traceRace(trace *httptrace.ClientTrace, network string, addrs []string) {
+	if trace != nil && trace.ConnectStart != nil {
+		trace.ConnectStart(network, strings.Join(addrs, ","))
+	}
+}
+
+// traceRaceWinner reports the winner of a dial race as the connect done, and
+// the handshake of it if it is a tls connection.
+func traceRaceWinner(trace *httptrace.ClientTrace, network string, c net.Conn) {
+	if trace == nil {
+		return
+	}
+	if trace.ConnectDone != nil {
+		trace.ConnectDone(network, c.RemoteAddr().String(), nil)
+	}
+	if tc, ok := c.(*tls.Conn); ok && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(tc.ConnectionState(), nil)
+	}
+}
@@ -1,12 +1,13 @@
 package helpers
 
 import (
-	//"context"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"math/rand"
 	"net"
+	"net/http/httptrace"
 	"sort"
 	"strings"
 	"time"
@@ -14,6 +15,12 @@ import (
 	"github.com/cloudflare/golibs/lrucache"
 	"github.com/phuslu/glog"
 	quic "github.com/phuslu/quic-go"
+
+	"github.com/xuiv/goproxy/httpproxy/metrics"
+)
+
+var (
+	dialRacesTotal = metrics.NewCounterVec("goproxy_dialer_race_dials_total", "Dials raced by MultiDialer, by protocol and result of won, lost or failed.", "proto", "result")
 )
 
 type MultiDialer struct {
@@ -91,6 +98,16 @@ func (d *MultiDialer) DialTLS(network, address string) (net.Conn, error) {
 }
 
 func (d *MultiDialer) DialTLS2(network, address string, cfg *tls.Config) (net.Conn, error) {
+	return d.dialTLS(context.Background(), network, address, cfg)
+}
+
+// DialTLSContext is DialTLS reporting the race of the aliased hosts and its
+// winner to the httptrace.ClientTrace of ctx.
+func (d *MultiDialer) DialTLSContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.dialTLS(ctx, network, address, nil)
+}
+
+func (d *MultiDialer) dialTLS(ctx context.Context, network, address string, cfg *tls.Config) (net.Conn, error) {
 	if d.LogToStderr {
 		SetConsoleTextColorGreen()
 	}
@@ -132,7 +149,7 @@ func (d *MultiDialer) DialTLS2(network, address string, cfg *tls.Config) (net.Co
 					case d.Resolver.DisableIPv6:
 						network = "tcp4"
 					}
-					conn, err := d.dialMultiTLS(network, hosts, port, config)
+					conn, err := d.dialMultiTLS(ctx, network, hosts, port, config)
 					if err != nil {
 						return nil, err
 					}
@@ -171,10 +188,14 @@ func (d *MultiDialer) DialTLS2(network, address string, cfg *tls.Config) (net.Co
 		Timeout:   d.Timeout,
 		DualStack: d.DualStack,
 	}
-	return tls.DialWithDialer(dialer, network, address, d.TLSConfig)
+	tlsDialer := &tls.Dialer{
+		NetDialer: dialer,
+		Config:    d.TLSConfig,
+	}
+	return tlsDialer.DialContext(ctx, network, address)
 }
 
-func (d *MultiDialer) dialMultiTLS(network string, hosts []string, port string, config *tls.Config) (net.Conn, error) {
+func (d *MultiDialer) dialMultiTLS(ctx context.Context, network string, hosts []string, port string, config *tls.Config) (net.Conn, error) {
 	glog.V(3).Infof("dialMultiTLS(%v, %v, %#v)", network, hosts, config)
 	type connWithError struct {
 		c net.Conn
@@ -184,6 +205,13 @@ func (d *MultiDialer) dialMultiTLS(network string, hosts []string, port string,
 	hosts = d.pickupTLSHosts(hosts, d.Level)
 	lane := make(chan connWithError, len(hosts))
 
+	trace := httptrace.ContextClientTrace(ctx)
+	addrs := make([]string, len(hosts))
+	for i, host := range hosts {
+		addrs[i] = net.JoinHostPort(host, port)
+	}
+	traceRace(trace, network, addrs)
+
 	for _, host := range hosts {
 		go func(host string, c chan<- connWithError) {
 			// start := time.Now()
@@ -240,17 +268,23 @@ func (d *MultiDialer) dialMultiTLS(network string, hosts []string, port string,
 	for i := range hosts {
 		r = <-lane
 		if r.e == nil {
+			dialRacesTotal.Inc("tls", "won")
+			traceRaceWinner(trace, network, r.c)
 			go func(count int) {
 				var r1 connWithError
 				for ; count > 0; count-- {
 					r1 = <-lane
 					if r1.c != nil {
+						dialRacesTotal.Inc("tls", "lost")
 						r1.c.Close()
+					} else {
+						dialRacesTotal.Inc("tls", "failed")
 					}
 				}
 			}(len(hosts) - 1 - i)
 			return r.c, nil
 		}
+		dialRacesTotal.Inc("tls", "failed")
 	}
 	return nil, r.e
 }
@@ -356,17 +390,22 @@ func (d *MultiDialer) dialMultiQuic(hosts []string, port string, tlsConfig *tls.
 	for i := range hosts {
 		r = <-lane
 		if r.e == nil {
+			dialRacesTotal.Inc("quic", "won")
 			go func(count int) {
 				var r1 sessWithError
 				for ; count > 0; count-- {
 					r1 = <-lane
 					if r1.s != nil {
+						dialRacesTotal.Inc("quic", "lost")
 						r1.s.Close(nil)
+					} else {
+						dialRacesTotal.Inc("quic", "failed")
 					}
 				}
 			}(len(hosts) - 1 - i)
 			return r.s, nil
 		}
+		dialRacesTotal.Inc("quic", "failed")
 	}
 	return nil, r.e
 }
@@ -0,0 +1,72 @@
+package helpers
+
+import (
+	"context"
+	"net"
+	"net/http/httptrace"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+func TestDialerDialContextTrace(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error: %v", err)
+	}
+	defer ln.Close()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	r := &Resolver{LRUCache: lrucache.NewLRUCache(16)}
+	r.LRUCache.Set("example.test", []net.IP{net.ParseIP("127.0.0.1")}, time.Now().Add(time.Hour))
+
+	d := &Dialer{
+		Dialer:   &net.Dialer{Timeout: time.Second},
+		Resolver: r,
+		Level:    1,
+	}
+
+	var events []string
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			events = append(events, "dns_start "+info.Host)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			if info.Err != nil || len(info.Addrs) != 1 {
+				t.Fatalf("DNSDone(%+v), want 127.0.0.1", info)
+			}
+			events = append(events, "dns_done "+info.Addrs[0].String())
+		},
+		ConnectStart: func(network, addr string) {
+			events = append(events, "connect_start "+addr)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			events = append(events, "connect_done "+addr)
+		},
+	})
+
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort("example.test", port))
+	if err != nil {
+		t.Fatalf("DialContext() error: %v", err)
+	}
+	conn.Close()
+
+	addr := net.JoinHostPort("127.0.0.1", port)
+	want := []string{
+		"dns_start example.test",
+		"dns_done 127.0.0.1",
+		"connect_start " + addr,
+		"connect_done " + addr,
+	}
+	if len(events) != len(want) {
+		t.Fatalf("DialContext() traced %q, want %q", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("DialContext() traced %q, want %q", events, want)
+			break
+		}
+	}
+}
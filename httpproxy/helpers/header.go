@@ -0,0 +1,257 @@
+package helpers
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ForwardKeep passes a forwarding header from the client as is.
+	ForwardKeep = ""
+	// ForwardAdd appends the hop of the proxy to a forwarding header.
+	ForwardAdd = "add"
+	// ForwardStrip removes a forwarding header.
+	ForwardStrip = "strip"
+)
+
+var (
+	// HopHeaders are the hop-by-hop headers of RFC 7230 and the de-facto
+	// ones, they are meant for a single connection and never forwarded.
+	HopHeaders = []string{
+		"Connection",
+		"Proxy-Connection",
+		"Keep-Alive",
+		"Proxy-Authenticate",
+		"Proxy-Authorization",
+		"Te",
+		"Trailer",
+		"Transfer-Encoding",
+		"Upgrade",
+	}
+)
+
+// RemoveHopHeaders deletes the hop-by-hop headers from h, along with the
+// ones listed by its Connection header. "Te: trailers" is kept, gRPC needs
+// it to tell that the client understands trailers.
+func RemoveHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, key := range strings.Split(v, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				h.Del(key)
+			}
+		}
+	}
+
+	trailers := false
+	for _, v := range h["Te"] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), "trailers") {
+				trailers = true
+			}
+		}
+	}
+
+	for _, key := range HopHeaders {
+		h.Del(key)
+	}
+
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+}
+
+// ForwardPolicy decides how the Via, X-Forwarded-For and Forwarded headers
+// of a request are forwarded, each one is ForwardKeep, ForwardAdd or
+// ForwardStrip.
+type ForwardPolicy struct {
+	Via           string
+	XForwardedFor string
+	Forwarded     string
+}
+
+func (p *ForwardPolicy) Validate() error {
+	for name, mode := range map[string]string{
+		"Via":           p.Via,
+		"XForwardedFor": p.XForwardedFor,
+		"Forwarded":     p.Forwarded,
+	} {
+		switch mode {
+		case ForwardKeep, ForwardAdd, ForwardStrip:
+		default:
+			return fmt.Errorf("unknown %s forward policy %#v", name, mode)
+		}
+	}
+	return nil
+}
+
+// SanitizeRequestHeader removes the hop-by-hop headers of req and applies
+// policy to its forwarding headers, pseudonym names the proxy in Via. A nil
+// policy keeps the forwarding headers.
+func SanitizeRequestHeader(req *http.Request, policy *ForwardPolicy, pseudonym string) {
+	RemoveHopHeaders(req.Header)
+
+	if policy == nil {
+		return
+	}
+
+	client := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+
+	switch policy.Via {
+	case ForwardAdd:
+		hop := fmt.Sprintf("%d.%d %s", req.ProtoMajor, req.ProtoMinor, pseudonym)
+		if req.ProtoMajor == 0 {
+			hop = "1.1 " + pseudonym
+		}
+		appendHeader(req.Header, "Via", hop)
+	case ForwardStrip:
+		req.Header.Del("Via")
+	}
+
+	switch policy.XForwardedFor {
+	case ForwardAdd:
+		if client != "" {
+			appendHeader(req.Header, "X-Forwarded-For", client)
+		}
+	case ForwardStrip:
+		req.Header.Del("X-Forwarded-For")
+	}
+
+	switch policy.Forwarded {
+	case ForwardAdd:
+		node := client
+		if ip := net.ParseIP(client); ip != nil && ip.To4() == nil {
+			node = `"[` + client + `]"`
+		} else if node == "" {
+			node = "unknown"
+		}
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+		appendHeader(req.Header, "Forwarded", "for="+node+";proto="+proto)
+	case ForwardStrip:
+		req.Header.Del("Forwarded")
+	}
+}
+
+// appendHeader appends value to the comma separated list of h[key].
+func appendHeader(h http.Header, key, value string) {
+	if prior := h[key]; len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	h.Set(key, value)
+}
+
+// NegotiateContentType returns the one of offers preferred by the Accept
+// header accept, the earlier offers win the ties and the first one is
+// returned if none is acceptable.
+func NegotiateContentType(accept string, offers ...string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+
+	best, bestQ, bestSpec := offers[0], -1.0, -1
+	for _, offer := range offers {
+		q, spec := acceptQuality(accept, offer)
+		if q > bestQ || (q == bestQ && spec > bestSpec) {
+			best, bestQ, bestSpec = offer, q, spec
+		}
+	}
+
+	if bestQ <= 0 {
+		return offers[0]
+	}
+	return best
+}
+
+// acceptQuality returns the q value of the most specific media range of
+// accept which matches offer, and how specific the range is.
+func acceptQuality(accept, offer string) (float64, int) {
+	if strings.TrimSpace(accept) == "" {
+		return 1, 0
+	}
+
+	q, spec := 0.0, -1
+	for _, r := range strings.Split(accept, ",") {
+		mediatype, params, err := mime.ParseMediaType(strings.TrimSpace(r))
+		if err != nil {
+			continue
+		}
+
+		s := -1
+		switch {
+		case mediatype == offer:
+			s = 2
+		case strings.HasSuffix(mediatype, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mediatype, "*")):
+			s = 1
+		case mediatype == "*/*":
+			s = 0
+		}
+		if s <= spec {
+			continue
+		}
+
+		q1 := 1.0
+		if v, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q1 = f
+			}
+		}
+		q, spec = q1, s
+	}
+
+	return q, spec
+}
+
+// ParseAuthParams parses the comma separated auth-params of a challenge or
+// of credentials, e.g. `username="foo", qop=auth, nc=00000001` of Digest,
+// the names are lower cased and the quoted values unescaped.
+func ParseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params
+		}
+
+		i := strings.IndexByte(s, '=')
+		if i < 0 {
+			return params
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimLeft(s[i+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			j := 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			value = b.String()
+			if j < len(s) {
+				j++
+			}
+			s = s[j:]
+		} else {
+			j := strings.IndexByte(s, ',')
+			if j < 0 {
+				j = len(s)
+			}
+			value = strings.TrimSpace(s[:j])
+			s = s[j:]
+		}
+
+		params[name] = value
+	}
+}
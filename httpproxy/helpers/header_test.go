@@ -0,0 +1,144 @@
+package helpers
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{
+		"Connection":          {"close, X-Custom"},
+		"Proxy-Connection":    {"keep-alive"},
+		"Proxy-Authorization": {"Basic Zm9vOmJhcg=="},
+		"Te":                  {"trailers, deflate"},
+		"X-Custom":            {"1"},
+		"Accept":              {"*/*"},
+	}
+
+	RemoveHopHeaders(h)
+
+	want := http.Header{
+		"Te":     {"trailers"},
+		"Accept": {"*/*"},
+	}
+	if len(h) != len(want) || h.Get("Te") != "trailers" || h.Get("Accept") != "*/*" {
+		t.Errorf("RemoveHopHeaders() = %v, want %v", h, want)
+	}
+}
+
+func TestSanitizeRequestHeader(t *testing.T) {
+	cases := []struct {
+		policy     ForwardPolicy
+		remoteAddr string
+		header     http.Header
+		want       http.Header
+	}{
+		{
+			ForwardPolicy{},
+			"10.0.0.1:1234",
+			http.Header{"Via": {"1.1 a"}, "X-Forwarded-For": {"1.2.3.4"}},
+			http.Header{"Via": {"1.1 a"}, "X-Forwarded-For": {"1.2.3.4"}},
+		},
+		{
+			ForwardPolicy{Via: ForwardAdd, XForwardedFor: ForwardAdd, Forwarded: ForwardAdd},
+			"10.0.0.1:1234",
+			http.Header{"Via": {"1.1 a"}, "X-Forwarded-For": {"1.2.3.4"}},
+			http.Header{"Via": {"1.1 a, 1.1 goproxy"}, "X-Forwarded-For": {"1.2.3.4, 10.0.0.1"}, "Forwarded": {"for=10.0.0.1;proto=http"}},
+		},
+		{
+			ForwardPolicy{Forwarded: ForwardAdd},
+			"[2001:db8::1]:1234",
+			http.Header{},
+			http.Header{"Forwarded": {`for="[2001:db8::1]";proto=http`}},
+		},
+		{
+			ForwardPolicy{Via: ForwardStrip, XForwardedFor: ForwardStrip, Forwarded: ForwardStrip},
+			"10.0.0.1:1234",
+			http.Header{"Via": {"1.1 a"}, "X-Forwarded-For": {"1.2.3.4"}, "Forwarded": {"for=1.2.3.4"}},
+			http.Header{},
+		},
+	}
+
+	for _, c := range cases {
+		req := &http.Request{RemoteAddr: c.remoteAddr, Header: c.header, ProtoMajor: 1, ProtoMinor: 1}
+		SanitizeRequestHeader(req, &c.policy, "goproxy")
+
+		if len(req.Header) != len(c.want) {
+			t.Errorf("SanitizeRequestHeader(%+v) = %v, want %v", c.policy, req.Header, c.want)
+			continue
+		}
+		for key := range c.want {
+			if req.Header.Get(key) != c.want.Get(key) {
+				t.Errorf("SanitizeRequestHeader(%+v) %s = %q, want %q", c.policy, key, req.Header.Get(key), c.want.Get(key))
+			}
+		}
+	}
+}
+
+func TestForwardPolicyValidate(t *testing.T) {
+	if err := (&ForwardPolicy{Via: "add", XForwardedFor: "strip"}).Validate(); err != nil {
+		t.Errorf("Validate() error: %v", err)
+	}
+	if err := (&ForwardPolicy{Forwarded: "append"}).Validate(); err == nil {
+		t.Errorf("Validate() of an unknown mode returns nil")
+	}
+}
+
+func TestNegotiateContentType(t *testing.T) {
+	offers := []string{"application/json", "text/html"}
+	cases := []struct {
+		accept string
+		want   string
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "text/html"},
+		{"application/json, text/plain, */*", "application/json"},
+		{"text/*", "text/html"},
+		{"text/html;q=0.5, application/json;q=0.9", "application/json"},
+		{"image/png", "application/json"},
+	}
+
+	for _, c := range cases {
+		if got := NegotiateContentType(c.accept, offers...); got != c.want {
+			t.Errorf("NegotiateContentType(%#v) = %#v, want %#v", c.accept, got, c.want)
+		}
+	}
+}
+
+func TestParseAuthParams(t *testing.T) {
+	cases := []struct {
+		s    string
+		want map[string]string
+	}{
+		{
+			`username="foo", realm="a \"b\", c", qop=auth, nc=00000001`,
+			map[string]string{"username": "foo", "realm": `a "b", c`, "qop": "auth", "nc": "00000001"},
+		},
+		{
+			`Realm=x,,URI="/a?b=1"`,
+			map[string]string{"realm": "x", "uri": "/a?b=1"},
+		},
+		{
+			`response="unterminated`,
+			map[string]string{"response": "unterminated"},
+		},
+		{
+			``,
+			map[string]string{},
+		},
+	}
+
+	for _, c := range cases {
+		got := ParseAuthParams(c.s)
+		if len(got) != len(c.want) {
+			t.Errorf("ParseAuthParams(%#v) = %#v, want %#v", c.s, got, c.want)
+			continue
+		}
+		for k, v := range c.want {
+			if got[k] != v {
+				t.Errorf("ParseAuthParams(%#v)[%#v] = %#v, want %#v", c.s, k, got[k], v)
+			}
+		}
+	}
+}
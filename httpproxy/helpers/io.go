@@ -2,7 +2,9 @@ package helpers
 
 import (
 	"io"
+	"net/http"
 	"sync"
+	"time"
 	// "github.com/cloudflare/golibs/bytepool"
 )
 
@@ -24,3 +26,68 @@ func IOCopy(dst io.Writer, src io.Reader) (written int64, err error) {
 	bufpool.Put(buf)
 	return written, err
 }
+
+// IOCopyFlush copies src to dst like IOCopy and flushes dst after the data of
+// each read, so that a stream reaches the client as soon as it arrives. The
+// data written within window of the first unflushed write are coalesced into
+// one flush, a window <= 0 flushes every write at once.
+func IOCopyFlush(dst io.Writer, flusher http.Flusher, src io.Reader, window time.Duration) (written int64, err error) {
+	buf := bufpool.Get().([]byte)
+	defer bufpool.Put(buf)
+
+	var mu sync.Mutex
+	var timer *time.Timer
+	pending := false
+	flush := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if pending {
+			flusher.Flush()
+			pending = false
+		}
+	}
+
+	// the header goes first, the first data may take a while
+	flusher.Flush()
+
+	for {
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			mu.Lock()
+			m, werr := dst.Write(buf[:n])
+			written += int64(m)
+			if werr == nil && m < n {
+				werr = io.ErrShortWrite
+			}
+			switch {
+			case window <= 0:
+				flusher.Flush()
+			case !pending:
+				pending = true
+				if timer == nil {
+					timer = time.AfterFunc(window, flush)
+				} else {
+					timer.Reset(window)
+				}
+			}
+			mu.Unlock()
+			if werr != nil {
+				err = werr
+				break
+			}
+		}
+		if rerr != nil {
+			if rerr != io.EOF {
+				err = rerr
+			}
+			break
+		}
+	}
+
+	if timer != nil {
+		timer.Stop()
+	}
+	flush()
+
+	return written, err
+}
@@ -0,0 +1,73 @@
+package helpers
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flushRecorder records the data written before each flush.
+type flushRecorder struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	flushes []string
+}
+
+func (w *flushRecorder) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *flushRecorder) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flushes = append(w.flushes, w.buf.String())
+}
+
+// slowEvents writes events to w with a pause after each one.
+func slowEvents(w io.WriteCloser, events []string, pause time.Duration) {
+	for _, e := range events {
+		w.Write([]byte(e))
+		time.Sleep(pause)
+	}
+	w.Close()
+}
+
+func TestIOCopyFlush(t *testing.T) {
+	pr, pw := io.Pipe()
+	go slowEvents(pw, []string{"data: 1\n\n", "data: 2\n\n"}, 20*time.Millisecond)
+
+	w := &flushRecorder{}
+	n, err := IOCopyFlush(w, w, pr, 0)
+	if err != nil || n != 18 {
+		t.Fatalf("IOCopyFlush() = %d, %v, want 18, nil", n, err)
+	}
+
+	want := []string{"", "data: 1\n\n", "data: 1\n\ndata: 2\n\n"}
+	if len(w.flushes) != len(want) {
+		t.Fatalf("IOCopyFlush() flushed %q, want %q", w.flushes, want)
+	}
+	for i := range want {
+		if w.flushes[i] != want[i] {
+			t.Errorf("IOCopyFlush() flush #%d = %q, want %q", i, w.flushes[i], want[i])
+		}
+	}
+}
+
+func TestIOCopyFlushWindow(t *testing.T) {
+	pr, pw := io.Pipe()
+	go slowEvents(pw, []string{"a", "b", "c", "d"}, 5*time.Millisecond)
+
+	w := &flushRecorder{}
+	if _, err := IOCopyFlush(w, w, pr, time.Second); err != nil {
+		t.Fatalf("IOCopyFlush() error: %v", err)
+	}
+
+	// the header flush and the final one, the writes in between are coalesced
+	if len(w.flushes) != 2 || w.flushes[1] != "abcd" {
+		t.Errorf("IOCopyFlush() flushed %q, want [\"\" \"abcd\"]", w.flushes)
+	}
+}
@@ -0,0 +1,168 @@
+package helpers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// ipKey is an ip of 16 bytes as a number, the IPv4 addresses are the
+// IPv4-mapped IPv6 ones, so that "10.0.0.1" and "::ffff:10.0.0.1" are the
+// same.
+type ipKey struct {
+	hi, lo uint64
+}
+
+func newIPKey(ip net.IP) (ipKey, bool) {
+	ip = ip.To16()
+	if ip == nil {
+		return ipKey{}, false
+	}
+	return ipKey{binary.BigEndian.Uint64(ip[:8]), binary.BigEndian.Uint64(ip[8:])}, true
+}
+
+func (k ipKey) less(k1 ipKey) bool {
+	return k.hi < k1.hi || (k.hi == k1.hi && k.lo < k1.lo)
+}
+
+// next returns k+1, ok is false if k is the last ip.
+func (k ipKey) next() (ipKey, bool) {
+	if k.lo++; k.lo == 0 {
+		if k.hi++; k.hi == 0 {
+			return k, false
+		}
+	}
+	return k, true
+}
+
+type ipRange struct {
+	first, last ipKey
+}
+
+// IPMatcher matches the ips against a list of ips, CIDRs like "10.0.0.0/8"
+// or "fd00::/8", ranges like "10.0.0.1-10.0.0.50" and the IPv4 patterns of
+// HostMatcher like "192.168.*.*", "*" matches all. The list is merged into
+// sorted ranges, a lookup is a binary search.
+type IPMatcher struct {
+	ranges []ipRange
+}
+
+func NewIPMatcher(patterns []string) (*IPMatcher, error) {
+	m := &IPMatcher{}
+
+	for _, s := range patterns {
+		r, err := parseIPRange(s)
+		if err != nil {
+			return nil, err
+		}
+		m.ranges = append(m.ranges, r)
+	}
+
+	sort.Slice(m.ranges, func(i, j int) bool {
+		return m.ranges[i].first.less(m.ranges[j].first)
+	})
+
+	// merge the overlapping and the adjacent ranges
+	merged := m.ranges[:0]
+	for _, r := range m.ranges {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			next, ok := last.last.next()
+			if !ok || !next.less(r.first) {
+				if last.last.less(r.last) {
+					last.last = r.last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	m.ranges = merged
+
+	return m, nil
+}
+
+func parseIPRange(s string) (ipRange, error) {
+	s = strings.TrimSpace(s)
+
+	switch {
+	case s == "*":
+		return ipRange{ipKey{0, 0}, ipKey{^uint64(0), ^uint64(0)}}, nil
+	case strings.Contains(s, "/"):
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return ipRange{}, err
+		}
+		ones, bits := ipnet.Mask.Size()
+		if bits == 8*net.IPv4len {
+			ones += 8 * (net.IPv6len - net.IPv4len)
+		}
+		first := ipnet.IP.To16()
+		last := make(net.IP, net.IPv6len)
+		mask := net.CIDRMask(ones, 8*net.IPv6len)
+		for i := range last {
+			last[i] = first[i] | ^mask[i]
+		}
+		k1, _ := newIPKey(first)
+		k2, _ := newIPKey(last)
+		return ipRange{k1, k2}, nil
+	case strings.Contains(s, "-"):
+		i := strings.IndexByte(s, '-')
+		k1, ok1 := newIPKey(net.ParseIP(strings.TrimSpace(s[:i])))
+		k2, ok2 := newIPKey(net.ParseIP(strings.TrimSpace(s[i+1:])))
+		if !ok1 || !ok2 || k2.less(k1) {
+			return ipRange{}, fmt.Errorf("invalid ip range %#v", s)
+		}
+		return ipRange{k1, k2}, nil
+	case strings.Contains(s, "*"):
+		// the trailing "*" of an IPv4 pattern, "192.168.*.*" is 192.168.0.0/16
+		parts := strings.Split(s, ".")
+		n := 0
+		for n < len(parts) && parts[n] != "*" {
+			n++
+		}
+		for i := n; i < len(parts); i++ {
+			if parts[i] != "*" {
+				return ipRange{}, fmt.Errorf("invalid ip pattern %#v", s)
+			}
+		}
+		if len(parts) != net.IPv4len || n == 0 {
+			return ipRange{}, fmt.Errorf("invalid ip pattern %#v", s)
+		}
+		for i := n; i < len(parts); i++ {
+			parts[i] = "0"
+		}
+		return parseIPRange(fmt.Sprintf("%s/%d", strings.Join(parts, "."), 8*n))
+	default:
+		k, ok := newIPKey(net.ParseIP(s))
+		if !ok {
+			return ipRange{}, fmt.Errorf("invalid ip address %#v", s)
+		}
+		return ipRange{k, k}, nil
+	}
+}
+
+// Match reports whether ip is in the list.
+func (m *IPMatcher) Match(ip net.IP) bool {
+	k, ok := newIPKey(ip)
+	if !ok || m == nil {
+		return false
+	}
+
+	// the first range which ends at or after ip
+	i := sort.Search(len(m.ranges), func(i int) bool {
+		return !m.ranges[i].last.less(k)
+	})
+
+	return i < len(m.ranges) && !k.less(m.ranges[i].first)
+}
+
+// MatchString is Match of an ip string, the zone of an IPv6 one is ignored.
+func (m *IPMatcher) MatchString(s string) bool {
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s = s[:i]
+	}
+	return m.Match(net.ParseIP(s))
+}
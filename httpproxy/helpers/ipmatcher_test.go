@@ -0,0 +1,105 @@
+package helpers
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestIPMatcher(t *testing.T) {
+	m, err := NewIPMatcher([]string{
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.*.*",
+		"100.64.0.1-100.64.0.50",
+		"100.64.0.51-100.64.0.60",
+		"127.0.0.1",
+		"fd00::/8",
+		"2001:db8::1",
+	})
+	if err != nil {
+		t.Fatalf("NewIPMatcher() error: %v", err)
+	}
+
+	for ip, want := range map[string]bool{
+		"10.1.2.3":        true,
+		"::ffff:10.1.2.3": true,
+		"11.0.0.0":        false,
+		"172.31.255.255":  true,
+		"172.32.0.0":      false,
+		"192.168.7.8":     true,
+		"192.169.0.1":     false,
+		"100.64.0.1":      true,
+		"100.64.0.55":     true,
+		"100.64.0.60":     true,
+		"100.64.0.61":     false,
+		"127.0.0.1":       true,
+		"127.0.0.2":       false,
+		"fd12:3456::1":    true,
+		"fe80::1%eth0":    false,
+		"2001:db8::1":     true,
+		"2001:db8::2":     false,
+		"::1":             false,
+		"not an ip":       false,
+		"":                false,
+	} {
+		if got := m.MatchString(ip); got != want {
+			t.Errorf("MatchString(%#v) = %v, want %v", ip, got, want)
+		}
+	}
+
+	// the adjacent ranges are merged
+	if n := len(m.ranges); n != 7 {
+		t.Errorf("len(ranges) = %d, want 7", n)
+	}
+}
+
+func TestIPMatcherAll(t *testing.T) {
+	m, err := NewIPMatcher([]string{"*"})
+	if err != nil {
+		t.Fatalf("NewIPMatcher() error: %v", err)
+	}
+
+	for _, ip := range []string{"0.0.0.0", "255.255.255.255", "::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"} {
+		if !m.MatchString(ip) {
+			t.Errorf("MatchString(%#v) = false, want true", ip)
+		}
+	}
+
+	var empty *IPMatcher
+	if empty.MatchString("127.0.0.1") {
+		t.Errorf("nil IPMatcher should match nothing")
+	}
+}
+
+func TestIPMatcherInvalid(t *testing.T) {
+	for _, s := range []string{
+		"10.0.0.300",
+		"10.0.0.0/33",
+		"10.0.0.9-10.0.0.1",
+		"10.*.0.1",
+		"*.*.*.*",
+		"192.168.*",
+		"example.com",
+	} {
+		if _, err := NewIPMatcher([]string{s}); err == nil {
+			t.Errorf("NewIPMatcher(%#v) should return an error", s)
+		}
+	}
+}
+
+func BenchmarkIPMatcher(b *testing.B) {
+	patterns := []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}
+	for i := 0; i < 4096; i++ {
+		patterns = append(patterns, fmt.Sprintf("100.%d.%d.0/24", 64+i/256, i%256))
+	}
+
+	m, err := NewIPMatcher(patterns)
+	if err != nil {
+		b.Fatalf("NewIPMatcher() error: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.MatchString("100.70.3.4")
+	}
+}
@@ -1,8 +1,11 @@
 package helpers
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -14,6 +17,10 @@ const (
 	backlog = 1024
 )
 
+var (
+	ErrListenerClosed = errors.New("httpproxy.Listener: use of closed network connection")
+)
+
 type Listener interface {
 	net.Listener
 
@@ -28,9 +35,15 @@ type connRacer struct {
 type listener struct {
 	ln              net.Listener
 	lane            chan connRacer
+	done            chan struct{}
 	keepAlivePeriod time.Duration
 	readBufferSize  int
 	writeBufferSize int
+	tlsConfig       *tls.Config
+	socks           bool
+	socksAuth       SocksAuthFunc
+	proxyProtocol   []*net.IPNet
+	transparent     string
 	stopped         bool
 	once            sync.Once
 	mu              sync.Mutex
@@ -41,6 +54,21 @@ type ListenOptions struct {
 	KeepAlivePeriod time.Duration
 	ReadBufferSize  int
 	WriteBufferSize int
+	// Socks enables SOCKS4/4a/5 clients alongside http on the listener, their
+	// sessions are accepted as connections sending a http CONNECT request.
+	// It should not be used with TLSConfig.
+	Socks bool
+	// SocksAuth checks the username/password of the SOCKS5 clients during
+	// the handshake, the clients failing it are closed. All are accepted if
+	// it is nil.
+	SocksAuth SocksAuthFunc
+	// ProxyProtocol enables PROXY protocol v1/v2 headers from the sources in
+	// it, the connections take the client address in the header as their
+	// remote address.
+	ProxyProtocol []*net.IPNet
+	// Transparent accepts the connections redirected by iptables, either
+	// TransparentRedirect or TransparentTProxy, it is linux only.
+	Transparent string
 }
 
 func ListenTCP(network, addr string, opts *ListenOptions) (Listener, error) {
@@ -49,21 +77,30 @@ func ListenTCP(network, addr string, opts *ListenOptions) (Listener, error) {
 		return nil, err
 	}
 
-	ln0, err := net.ListenTCP(network, laddr)
-	if err != nil {
-		return nil, err
-	}
-
 	var ln net.Listener
-	if opts != nil && opts.TLSConfig != nil {
-		ln = tls.NewListener(ln0, opts.TLSConfig)
+	if opts != nil && opts.Transparent == TransparentTProxy {
+		lc := &net.ListenConfig{Control: transparentControl}
+		ln, err = lc.Listen(context.Background(), network, laddr.String())
 	} else {
-		ln = ln0
+		ln, err = net.ListenTCP(network, laddr)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	var keepAlivePeriod time.Duration
 	var readBufferSize, writeBufferSize int
+	var tlsConfig *tls.Config
+	var socks bool
+	var socksAuth SocksAuthFunc
+	var proxyProtocol []*net.IPNet
+	var transparent string
 	if opts != nil {
+		transparent = opts.Transparent
+		tlsConfig = opts.TLSConfig
+		socks = opts.Socks
+		socksAuth = opts.SocksAuth
+		proxyProtocol = opts.ProxyProtocol
 		if opts.KeepAlivePeriod > 0 {
 			keepAlivePeriod = opts.KeepAlivePeriod
 		}
@@ -78,10 +115,16 @@ func ListenTCP(network, addr string, opts *ListenOptions) (Listener, error) {
 	l := &listener{
 		ln:              ln,
 		lane:            make(chan connRacer, backlog),
+		done:            make(chan struct{}),
 		stopped:         false,
 		keepAlivePeriod: keepAlivePeriod,
 		readBufferSize:  readBufferSize,
 		writeBufferSize: writeBufferSize,
+		tlsConfig:       tlsConfig,
+		socks:           socks,
+		socksAuth:       socksAuth,
+		proxyProtocol:   proxyProtocol,
+		transparent:     transparent,
 	}
 
 	return l, nil
@@ -94,7 +137,24 @@ func (l *listener) Accept() (c net.Conn, err error) {
 			var tempDelay time.Duration
 			for {
 				conn, err := l.ln.Accept()
-				l.lane <- connRacer{conn, err}
+				if err == nil {
+					l.setOptions(conn)
+					if l.socks || l.proxyProtocol != nil || l.transparent != "" {
+						go l.prepare(conn)
+						continue
+					}
+					if l.tlsConfig != nil {
+						conn = tls.Server(conn, l.tlsConfig)
+					}
+				}
+				select {
+				case l.lane <- connRacer{conn, err}:
+				case <-l.done:
+					if conn != nil {
+						conn.Close()
+					}
+					return
+				}
 				if err != nil {
 					if ne, ok := err.(net.Error); ok && ne.Temporary() {
 						if tempDelay == 0 {
@@ -115,13 +175,22 @@ func (l *listener) Accept() (c net.Conn, err error) {
 		}()
 	})
 
-	r := <-l.lane
+	var r connRacer
+	select {
+	case r = <-l.lane:
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
 	if r.err != nil {
 		return r.conn, r.err
 	}
 
+	return r.conn, nil
+}
+
+func (l *listener) setOptions(conn net.Conn) {
 	if l.keepAlivePeriod > 0 || l.readBufferSize > 0 || l.writeBufferSize > 0 {
-		if tc, ok := r.conn.(*net.TCPConn); ok {
+		if tc, ok := conn.(*net.TCPConn); ok {
 			if l.keepAlivePeriod > 0 {
 				tc.SetKeepAlive(true)
 				tc.SetKeepAlivePeriod(l.keepAlivePeriod)
@@ -134,8 +203,53 @@ func (l *listener) Accept() (c net.Conn, err error) {
 			}
 		}
 	}
+}
+
+// prepare reads the PROXY protocol header and serves the SOCKS handshake of
+// conn if any, and queues it to Accept.
+func (l *listener) prepare(conn net.Conn) {
+	c := conn
+
+	var err error
+	if l.proxyProtocol != nil && containsIP(l.proxyProtocol, conn.RemoteAddr()) {
+		if c, err = readProxyProto(c); err != nil {
+			if err != io.EOF {
+				glog.Warningf("httpproxy.Listener: read PROXY protocol header from %s error: %v", conn.RemoteAddr(), err)
+			}
+			conn.Close()
+			return
+		}
+	}
 
-	return r.conn, nil
+	if l.transparent != "" {
+		if c, err = acceptTransparent(c, l.transparent); err != nil {
+			if err != io.EOF {
+				glog.Warningf("httpproxy.Listener: accept transparent %s error: %v", conn.RemoteAddr(), err)
+			}
+			conn.Close()
+			return
+		}
+	}
+
+	if l.tlsConfig != nil {
+		c = tls.Server(c, l.tlsConfig)
+	}
+
+	if l.socks {
+		if c, err = sniffConn(c, l.socksAuth); err != nil {
+			if err != io.EOF {
+				glog.V(2).Infof("httpproxy.Listener: sniff %s error: %v", conn.RemoteAddr(), err)
+			}
+			conn.Close()
+			return
+		}
+	}
+
+	select {
+	case l.lane <- connRacer{c, nil}:
+	case <-l.done:
+		conn.Close()
+	}
 }
 
 func (l *listener) Close() error {
@@ -145,7 +259,7 @@ func (l *listener) Close() error {
 		return nil
 	}
 	l.stopped = true
-	close(l.lane)
+	close(l.done)
 	return l.ln.Close()
 }
 
@@ -155,13 +269,18 @@ func (l *listener) Addr() net.Addr {
 
 func (l *listener) Add(conn net.Conn) error {
 	l.mu.Lock()
-	defer l.mu.Unlock()
+	stopped := l.stopped
+	l.mu.Unlock()
 
-	if l.stopped {
+	if stopped {
 		return fmt.Errorf("%#v already closed", l)
 	}
 
-	l.lane <- connRacer{conn, nil}
+	select {
+	case l.lane <- connRacer{conn, nil}:
+	case <-l.done:
+		return fmt.Errorf("%#v already closed", l)
+	}
 
 	return nil
 }
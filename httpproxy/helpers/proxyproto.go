@@ -0,0 +1,230 @@
+package helpers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	proxyProtoTimeout   = 10 * time.Second
+	proxyProtoV1MaxLine = 107
+)
+
+var (
+	proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ParseIPNets parses CIDRs, a bare IP is taken as a single address network.
+func ParseIPNets(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %#v", s)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+
+	if ip == nil {
+		return false
+	}
+
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtoConn is a net.Conn whose RemoteAddr is given by a PROXY protocol
+// header, the bytes read ahead to detect a header are replayed by Read.
+type proxyProtoConn struct {
+	net.Conn
+	remoteAddr net.Addr
+	prefix     []byte
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// NetConn returns the underlying connection.
+func (c *proxyProtoConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Buffered returns the bytes read ahead to detect the header.
+func (c *proxyProtoConn) Buffered() int {
+	return len(c.prefix)
+}
+
+// readProxyProto reads a PROXY protocol v1 or v2 header from conn, the
+// connections without a header are returned with their own address. It does
+// not read beyond the header, so nothing is buffered once it is found.
+func readProxyProto(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyProtoTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	c := &proxyProtoConn{Conn: conn}
+
+	var b [16]byte
+	if _, err := io.ReadFull(conn, b[:1]); err != nil {
+		return nil, err
+	}
+
+	var err error
+	switch b[0] {
+	case 'P':
+		if _, err = io.ReadFull(conn, b[1:6]); err != nil {
+			return nil, err
+		}
+		if string(b[:6]) != "PROXY " {
+			c.prefix = append(c.prefix, b[:6]...)
+			return c, nil
+		}
+		c.remoteAddr, err = readProxyProtoV1(conn)
+	case proxyProtoV2Sig[0]:
+		if _, err = io.ReadFull(conn, b[1:12]); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(b[:12], proxyProtoV2Sig) {
+			c.prefix = append(c.prefix, b[:12]...)
+			return c, nil
+		}
+		c.remoteAddr, err = readProxyProtoV2(conn)
+	default:
+		c.prefix = append(c.prefix, b[0])
+		return c, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// readProxyProtoV1 reads the rest of "PROXY TCP4 src dst sport dport\r\n".
+func readProxyProtoV1(r io.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyProtoV1MaxLine)
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+		if len(line) > proxyProtoV1MaxLine {
+			return nil, fmt.Errorf("proxyproto: v1 header too long")
+		}
+	}
+
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r"))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("proxyproto: invalid v1 header %#v", string(line))
+	}
+
+	switch fields[0] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("proxyproto: invalid v1 header %#v", string(line))
+		}
+		ip := net.ParseIP(fields[1])
+		if ip == nil {
+			return nil, fmt.Errorf("proxyproto: invalid source address %#v", fields[1])
+		}
+		port, err := strconv.ParseUint(fields[3], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("proxyproto: invalid source port %#v", fields[3])
+		}
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	default:
+		return nil, fmt.Errorf("proxyproto: unknown v1 protocol %#v", fields[0])
+	}
+}
+
+// readProxyProtoV2 reads the rest of a v2 header after the signature.
+func readProxyProtoV2(r io.Reader) (net.Addr, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	if hdr[0]>>4 != 2 {
+		return nil, fmt.Errorf("proxyproto: invalid v2 version %#x", hdr[0])
+	}
+
+	data := make([]byte, binary.BigEndian.Uint16(hdr[2:4]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	// LOCAL command, e.g. health checks of the balancer
+	if hdr[0]&0x0f == 0x00 {
+		return nil, nil
+	}
+
+	switch hdr[1] {
+	case 0x11: // TCP over IPv4
+		if len(data) < 12 {
+			return nil, fmt.Errorf("proxyproto: short v2 IPv4 address")
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:4]), Port: int(binary.BigEndian.Uint16(data[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(data) < 36 {
+			return nil, fmt.Errorf("proxyproto: short v2 IPv6 address")
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:16]), Port: int(binary.BigEndian.Uint16(data[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,73 @@
+package helpers
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestReadProxyProto(t *testing.T) {
+	v2 := append([]byte{}, proxyProtoV2Sig...)
+	v2 = append(v2, 0x21, 0x11, 0, 12, 10, 1, 2, 3, 192, 168, 0, 1, 0, 0, 1, 187)
+	binary.BigEndian.PutUint16(v2[24:26], 50000)
+
+	cases := []struct {
+		Header     string
+		RemoteAddr string
+	}{
+		{"PROXY TCP4 10.1.2.3 192.168.0.1 50000 443\r\n", "10.1.2.3:50000"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 50000 443\r\n", "[2001:db8::1]:50000"},
+		{"PROXY UNKNOWN\r\n", "pipe"},
+		{string(v2), "10.1.2.3:50000"},
+		{"", "pipe"},
+	}
+
+	for _, c := range cases {
+		client, server := net.Pipe()
+
+		go func() {
+			io.WriteString(client, c.Header+"POST / HTTP/1.1\r\n\r\n")
+			client.Close()
+		}()
+
+		conn, err := readProxyProto(server)
+		if err != nil {
+			t.Errorf("readProxyProto(%#v) error: %v", c.Header, err)
+			continue
+		}
+
+		if addr := conn.RemoteAddr().String(); addr != c.RemoteAddr {
+			t.Errorf("readProxyProto(%#v).RemoteAddr() = %#v, want %#v", c.Header, addr, c.RemoteAddr)
+		}
+
+		if data, _ := ioutil.ReadAll(conn); string(data) != "POST / HTTP/1.1\r\n\r\n" {
+			t.Errorf("readProxyProto(%#v) data = %#v", c.Header, string(data))
+		}
+	}
+}
+
+func TestParseIPNets(t *testing.T) {
+	nets, err := ParseIPNets([]string{"10.0.0.0/8", "127.0.0.1", "::1"})
+	if err != nil {
+		t.Fatalf("ParseIPNets() error: %v", err)
+	}
+
+	for addr, want := range map[string]bool{
+		"10.2.3.4:80":   true,
+		"127.0.0.1:80":  true,
+		"127.0.0.2:80":  false,
+		"[::1]:80":      true,
+		"192.168.1.1:1": false,
+	} {
+		tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+		if got := containsIP(nets, tcpAddr); got != want {
+			t.Errorf("containsIP(%s) = %v, want %v", addr, got, want)
+		}
+	}
+
+	if _, err := ParseIPNets([]string{"10.0.0.300"}); err == nil {
+		t.Errorf("ParseIPNets(10.0.0.300) should return an error")
+	}
+}
@@ -0,0 +1,300 @@
+package helpers
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// CountingConn counts the bytes read from and written to a connection, the
+// bytes spliced by Relay are counted as well.
+type CountingConn struct {
+	net.Conn
+	read    int64
+	written int64
+}
+
+func NewCountingConn(conn net.Conn) *CountingConn {
+	return &CountingConn{Conn: conn}
+}
+
+func (c *CountingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *CountingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// NetConn returns the underlying connection.
+func (c *CountingConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *CountingConn) Buffered() int {
+	return 0
+}
+
+func (c *CountingConn) ReadBytes() int64 {
+	return atomic.LoadInt64(&c.read)
+}
+
+func (c *CountingConn) WrittenBytes() int64 {
+	return atomic.LoadInt64(&c.written)
+}
+
+// RelayOptions limits the tunnels of Relay, the zero value has no limits.
+type RelayOptions struct {
+	// IdleTimeout closes the tunnel when neither side sends anything for
+	// that long.
+	IdleTimeout time.Duration
+	// MaxLifetime closes the tunnel that long after it is started, even if
+	// it is still active.
+	MaxLifetime time.Duration
+}
+
+// RelayTimeoutError is returned by Relay when a tunnel is closed by its
+// RelayOptions.
+type RelayTimeoutError struct {
+	// Lifetime is true if MaxLifetime is reached, otherwise the tunnel is
+	// idle.
+	Lifetime bool
+	// Side is "client" for the first connection passed to Relay and
+	// "remote" for the second one, it is the side which has been quiet
+	// for longer.
+	Side string
+	// Idle is how long Side has sent nothing.
+	Idle time.Duration
+}
+
+func (e *RelayTimeoutError) Error() string {
+	if e.Lifetime {
+		return fmt.Sprintf("relay: max lifetime reached, %s idle for %s", e.Side, e.Idle)
+	}
+	return fmt.Sprintf("relay: %s idle for %s", e.Side, e.Idle)
+}
+
+func (e *RelayTimeoutError) Timeout() bool {
+	return true
+}
+
+// Relay copies data between a and b in both directions until both of them
+// are done, a direction which ends with EOF half-closes its destination so
+// that the other one keeps going. It returns the bytes copied from a to b and
+// from b to a, and the first error other than EOF.
+//
+// The data is spliced between the sockets if both a and b are plain TCP
+// connections on linux, otherwise it is copied through a pooled buffer.
+func Relay(a, b net.Conn) (int64, int64, error) {
+	return RelayWithOptions(a, b, nil)
+}
+
+// RelayWithOptions is Relay with the limits of opts, a is taken as the client
+// side and b as the remote side of the tunnel. Both connections are closed
+// once a limit is reached and a *RelayTimeoutError is returned.
+func RelayWithOptions(a, b net.Conn, opts *RelayOptions) (int64, int64, error) {
+	type result struct {
+		n   int64
+		err error
+	}
+
+	start := time.Now().UnixNano()
+	last := [2]int64{start, start}
+	progress := func(i int) func(int64) {
+		if opts == nil {
+			return nil
+		}
+		return func(int64) { atomic.StoreInt64(&last[i], time.Now().UnixNano()) }
+	}
+
+	var timeout chan error
+	done := make(chan struct{})
+	if opts != nil && (opts.IdleTimeout > 0 || opts.MaxLifetime > 0) {
+		timeout = make(chan error, 1)
+		go func() {
+			timeout <- relayWatch(a, b, opts, &last, done)
+		}()
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		n, err := relayCopy(b, a, progress(0))
+		ch <- result{n, err}
+	}()
+
+	n2, err2 := relayCopy(a, b, progress(1))
+	r := <-ch
+	close(done)
+
+	err := r.err
+	if err == nil {
+		err = err2
+	}
+
+	if timeout != nil {
+		if terr := <-timeout; terr != nil {
+			err = terr
+		}
+	}
+
+	return r.n, n2, err
+}
+
+// relayWatch closes a and b when one of the limits of opts is reached before
+// done, last holds the time of the latest data read from a and b.
+func relayWatch(a, b net.Conn, opts *RelayOptions, last *[2]int64, done <-chan struct{}) error {
+	var lifetime <-chan time.Time
+	if opts.MaxLifetime > 0 {
+		timer := time.NewTimer(opts.MaxLifetime)
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if opts.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(opts.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	quiet := func(now time.Time) (string, time.Duration) {
+		la, lb := atomic.LoadInt64(&last[0]), atomic.LoadInt64(&last[1])
+		if la <= lb {
+			return "client", now.Sub(time.Unix(0, la))
+		}
+		return "remote", now.Sub(time.Unix(0, lb))
+	}
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case now := <-lifetime:
+			side, d := quiet(now)
+			a.Close()
+			b.Close()
+			return &RelayTimeoutError{Lifetime: true, Side: side, Idle: d}
+		case now := <-idle:
+			la, lb := atomic.LoadInt64(&last[0]), atomic.LoadInt64(&last[1])
+			if lb > la {
+				la = lb
+			}
+			if d := opts.IdleTimeout - now.Sub(time.Unix(0, la)); d > 0 {
+				idleTimer.Reset(d)
+				continue
+			}
+			side, d := quiet(now)
+			a.Close()
+			b.Close()
+			return &RelayTimeoutError{Side: side, Idle: d}
+		}
+	}
+}
+
+// relayCopy copies src to dst, then half-closes dst, or closes both of them
+// on errors to unblock the other direction. progress, if not nil, is called
+// whenever data of src is copied.
+func relayCopy(dst, src net.Conn, progress func(int64)) (int64, error) {
+	var n int64
+	var err error
+
+	spliced := false
+	tdst, cdst, ok1 := unwrapTCPConn(dst)
+	tsrc, csrc, ok2 := unwrapTCPConn(src)
+	if ok1 && ok2 {
+		n, spliced, err = splice(tdst, tsrc, func(n int64) {
+			for _, c := range csrc {
+				atomic.AddInt64(&c.read, n)
+			}
+			for _, c := range cdst {
+				atomic.AddInt64(&c.written, n)
+			}
+			if progress != nil {
+				progress(n)
+			}
+		})
+	}
+	if !spliced {
+		var r io.Reader = src
+		if progress != nil {
+			r = &progressReader{src, progress}
+		}
+		n, err = IOCopy(dst, r)
+	}
+
+	if err != nil && err != io.EOF {
+		dst.Close()
+		src.Close()
+		return n, err
+	}
+
+	if err := closeWrite(dst); err != nil {
+		dst.Close()
+	}
+
+	return n, nil
+}
+
+type progressReader struct {
+	r        io.Reader
+	progress func(int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.progress(int64(n))
+	}
+	return n, err
+}
+
+// unwrapTCPConn returns the *net.TCPConn under the wrappers of c and the
+// CountingConns among them, if none of the wrappers holds buffered data.
+func unwrapTCPConn(c net.Conn) (*net.TCPConn, []*CountingConn, bool) {
+	var counters []*CountingConn
+	for {
+		switch cc := c.(type) {
+		case *net.TCPConn:
+			return cc, counters, true
+		case *CountingConn:
+			counters = append(counters, cc)
+			c = cc.Conn
+		case interface {
+			NetConn() net.Conn
+			Buffered() int
+		}:
+			if cc.Buffered() > 0 {
+				return nil, nil, false
+			}
+			c = cc.NetConn()
+		default:
+			return nil, nil, false
+		}
+	}
+}
+
+// closeWrite shuts down the writing side of c, tls connections send a
+// close_notify alert, and connections without half-close are closed.
+func closeWrite(c net.Conn) error {
+	for {
+		switch cc := c.(type) {
+		case interface {
+			CloseWrite() error
+		}:
+			return cc.CloseWrite()
+		case interface {
+			NetConn() net.Conn
+		}:
+			c = cc.NetConn()
+		default:
+			return c.Close()
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package helpers
+
+import (
+	"io"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// maxSpliceSize is the bytes moved by a splice call, it is the default
+	// capacity of a pipe.
+	maxSpliceSize = 64 << 10
+)
+
+// splice moves the data of src to dst through a pipe without copying it to
+// userspace, progress is called with the bytes written to dst. It returns
+// false if the pipe could not be created.
+func splice(dst, src *net.TCPConn, progress func(int64)) (int64, bool, error) {
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return 0, false, nil
+	}
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+
+	rsrc, err := src.SyscallConn()
+	if err != nil {
+		return 0, true, err
+	}
+	rdst, err := dst.SyscallConn()
+	if err != nil {
+		return 0, true, err
+	}
+
+	var written, inPipe int64
+	for {
+		var n int64
+		var serr error
+		err = rsrc.Read(func(fd uintptr) bool {
+			n, serr = unix.Splice(int(fd), nil, p[1], nil, maxSpliceSize, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+			return serr != unix.EAGAIN
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			break
+		}
+		if n == 0 {
+			err = io.EOF
+			break
+		}
+
+		inPipe = n
+		for inPipe > 0 {
+			var m int64
+			err = rdst.Write(func(fd uintptr) bool {
+				m, serr = unix.Splice(p[0], nil, int(fd), nil, int(inPipe), unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+				return serr != unix.EAGAIN
+			})
+			if err == nil {
+				err = serr
+			}
+			if err != nil {
+				break
+			}
+			inPipe -= m
+			written += m
+			progress(m)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	return written, true, err
+}
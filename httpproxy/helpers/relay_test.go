@@ -0,0 +1,176 @@
+package helpers
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error: %v", err)
+	}
+	defer ln.Close()
+
+	ch := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		ch <- c
+	}()
+
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() error: %v", err)
+	}
+	c2 := <-ch
+	if c2 == nil {
+		t.Fatalf("ln.Accept() failed")
+	}
+
+	return c1.(*net.TCPConn), c2.(*net.TCPConn)
+}
+
+func testRelay(t *testing.T, client, a, b, server net.Conn, counter *CountingConn) {
+	up := bytes.Repeat([]byte("u"), 300<<10)
+	down := bytes.Repeat([]byte("d"), 200<<10)
+
+	type result struct {
+		up, down int64
+		err      error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		n1, n2, err := Relay(a, b)
+		ch <- result{n1, n2, err}
+	}()
+
+	// the client half-closes after sending, the server still answers
+	go func() {
+		client.Write(up)
+		closeWrite(client)
+	}()
+
+	got, err := ioutil.ReadAll(server)
+	if err != nil || !bytes.Equal(got, up) {
+		t.Fatalf("server read %d bytes, err=%v, want %d", len(got), err, len(up))
+	}
+
+	go func() {
+		server.Write(down)
+		closeWrite(server)
+	}()
+
+	got, err = ioutil.ReadAll(client)
+	if err != nil || !bytes.Equal(got, down) {
+		t.Fatalf("client read %d bytes, err=%v, want %d", len(got), err, len(down))
+	}
+
+	r := <-ch
+	if r.err != nil || r.up != int64(len(up)) || r.down != int64(len(down)) {
+		t.Errorf("Relay() = %d, %d, %v, want %d, %d, nil", r.up, r.down, r.err, len(up), len(down))
+	}
+
+	if counter != nil {
+		if counter.ReadBytes() != int64(len(up)) || counter.WrittenBytes() != int64(len(down)) {
+			t.Errorf("CountingConn read %d written %d, want %d, %d", counter.ReadBytes(), counter.WrittenBytes(), len(up), len(down))
+		}
+	}
+}
+
+func TestRelayTCP(t *testing.T) {
+	client, a := tcpPair(t)
+	b, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	counter := NewCountingConn(a)
+	testRelay(t, client, counter, b, server, counter)
+}
+
+func TestRelayPipe(t *testing.T) {
+	client, a := tcpPair(t)
+	defer client.Close()
+
+	b, server := net.Pipe()
+	defer server.Close()
+
+	// net.Pipe has no half-close, so the server end is closed instead
+	go func() {
+		io.Copy(ioutil.Discard, client)
+		client.Close()
+	}()
+
+	ch := make(chan error, 1)
+	go func() {
+		_, _, err := Relay(a, b)
+		ch <- err
+	}()
+
+	server.Write([]byte("hello"))
+	server.Close()
+
+	if err := <-ch; err != nil {
+		t.Errorf("Relay() error: %v", err)
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	client, a := tcpPair(t)
+	b, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	// the client keeps talking for a while, then both sides go quiet
+	go func() {
+		for i := 0; i < 4; i++ {
+			client.Write([]byte("ping"))
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+	go io.Copy(ioutil.Discard, server)
+
+	start := time.Now()
+	_, _, err := RelayWithOptions(a, b, &RelayOptions{IdleTimeout: 100 * time.Millisecond})
+
+	terr, ok := err.(*RelayTimeoutError)
+	if !ok || terr.Lifetime || terr.Side != "remote" {
+		t.Fatalf("RelayWithOptions() error = %#v, want a remote idle timeout", err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("RelayWithOptions() returned after %s, the idle timer is not reset", d)
+	}
+}
+
+func TestRelayMaxLifetime(t *testing.T) {
+	client, a := tcpPair(t)
+	b, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			server.Write([]byte("pong"))
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	go io.Copy(ioutil.Discard, client)
+
+	_, _, err := RelayWithOptions(a, b, &RelayOptions{IdleTimeout: time.Second, MaxLifetime: 100 * time.Millisecond})
+
+	terr, ok := err.(*RelayTimeoutError)
+	if !ok || !terr.Lifetime || terr.Side != "client" {
+		t.Fatalf("RelayWithOptions() error = %#v, want a client max lifetime timeout", err)
+	}
+}
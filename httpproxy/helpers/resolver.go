@@ -9,6 +9,12 @@ import (
 	"github.com/cloudflare/golibs/lrucache"
 	"github.com/miekg/dns"
 	"github.com/phuslu/glog"
+
+	"github.com/xuiv/goproxy/httpproxy/metrics"
+)
+
+var (
+	dnsCacheTotal = metrics.NewCounterVec("goproxy_dns_cache_lookups_total", "Resolver lookups with a dns cache, by result of hit or miss.", "result")
 )
 
 const (
@@ -41,6 +47,7 @@ func (r *Resolver) LookupHost(name string) ([]string, error) {
 func (r *Resolver) LookupIP(name string) ([]net.IP, error) {
 	if r.LRUCache != nil {
 		if v, ok := r.LRUCache.GetNotStale(name); ok {
+			dnsCacheTotal.Inc("hit")
 			switch v.(type) {
 			case []net.IP:
 				return v.([]net.IP), nil
@@ -56,6 +63,10 @@ func (r *Resolver) LookupIP(name string) ([]net.IP, error) {
 		return []net.IP{ip}, nil
 	}
 
+	if r.LRUCache != nil {
+		dnsCacheTotal.Inc("miss")
+	}
+
 	lookupIP := r.lookupIP1
 	if r.DNSServer != nil {
 		lookupIP = r.lookupIP2
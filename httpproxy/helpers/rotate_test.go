@@ -0,0 +1,48 @@
+package helpers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "access.log")
+	f := &RotatingFile{
+		Filename:   filename,
+		MaxSize:    10,
+		MaxBackups: 2,
+	}
+	defer f.Close()
+
+	for _, s := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatalf("f.Write(%#v) error: %v", s, err)
+		}
+	}
+
+	for name, want := range map[string]string{
+		filename:        "dddddddd\n",
+		filename + ".1": "cccccccc\n",
+		filename + ".2": "bbbbbbbb\n",
+	} {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("ioutil.ReadFile(%#v) error: %v", name, err)
+		}
+		if string(data) != want {
+			t.Errorf("%s = %#v, want %#v", name, string(data), want)
+		}
+	}
+
+	if _, err := os.Stat(filename + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 should not exist, err=%v", filename, err)
+	}
+}
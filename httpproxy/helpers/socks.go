@@ -0,0 +1,348 @@
+package helpers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	socks4Version = 0x04
+	socks5Version = 0x05
+
+	socksCmdConnect = 0x01
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xff
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5Succeeded         = 0x00
+	socks5GeneralFailure    = 0x01
+	socks5NotAllowed        = 0x02
+	socks5HostUnreachable   = 0x04
+	socks5ConnectionRefused = 0x05
+	socks5CmdNotSupported   = 0x07
+	socks5AddrNotSupported  = 0x08
+
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+
+	socksHandshakeTimeout = 30 * time.Second
+)
+
+var (
+	ErrSocksCommandNotSupported = errors.New("socks: command not supported")
+	ErrSocksAuthFailed          = errors.New("socks: username/password authentication failed")
+)
+
+// SocksAuthFunc checks the username and password a SOCKS5 client sends
+// before its request, addr is the address of the client.
+type SocksAuthFunc func(addr net.Addr, username, password string) bool
+
+// sniffConn peeks the first byte of conn, SOCKS4 and SOCKS5 handshakes are
+// served and turned into a connection which reads as a http CONNECT request,
+// other connections are returned as is. The SOCKS5 credentials are checked by
+// auth if it is not nil.
+func sniffConn(conn net.Conn, auth SocksAuthFunc) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(socksHandshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReader(conn)
+	b, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch b[0] {
+	case socks4Version, socks5Version:
+		return socksHandshake(conn, br, auth)
+	default:
+		return &peekedConn{Conn: conn, r: br}, nil
+	}
+}
+
+// peekedConn is a net.Conn whose first bytes are already buffered in r.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	if c.r.Buffered() == 0 {
+		return c.Conn.Read(p)
+	}
+	return c.r.Read(p)
+}
+
+// NetConn returns the underlying connection.
+func (c *peekedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Buffered returns the bytes read ahead from the underlying connection.
+func (c *peekedConn) Buffered() int {
+	return c.r.Buffered()
+}
+
+func socksHandshake(conn net.Conn, br *bufio.Reader, auth SocksAuthFunc) (net.Conn, error) {
+	version, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	var host, username, password string
+	switch version {
+	case socks4Version:
+		host, username, err = socks4Handshake(conn, br)
+	case socks5Version:
+		host, username, password, err = socks5Handshake(conn, br, auth)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", host, host)
+	if username != "" {
+		fmt.Fprintf(&b, "Proxy-Authorization: Basic %s\r\n", base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+	}
+	b.WriteString("\r\n")
+
+	return &connectConn{
+		Conn:  conn,
+		req:   &b,
+		br:    br,
+		reply: socksReply(version),
+	}, nil
+}
+
+// socks4Handshake reads a SOCKS4 or SOCKS4a request after the version byte.
+func socks4Handshake(conn net.Conn, br *bufio.Reader) (host, username string, err error) {
+	var hdr [7]byte
+	if _, err = io.ReadFull(br, hdr[:]); err != nil {
+		return
+	}
+
+	if username, err = readCString(br); err != nil {
+		return
+	}
+
+	port := binary.BigEndian.Uint16(hdr[1:3])
+	ip := net.IP(hdr[3:7])
+
+	// SOCKS4a, 0.0.0.x with a non-zero x is followed by the domain name
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		var domain string
+		if domain, err = readCString(br); err != nil {
+			return
+		}
+		host = net.JoinHostPort(domain, strconv.Itoa(int(port)))
+	} else {
+		host = net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+	}
+
+	if hdr[0] != socksCmdConnect {
+		conn.Write([]byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0})
+		err = ErrSocksCommandNotSupported
+		return
+	}
+
+	if !isValidSocksHost(host) {
+		conn.Write([]byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0})
+		err = fmt.Errorf("socks: invalid host %#v", host)
+	}
+
+	return
+}
+
+// socks5Handshake negotiates the auth method, reads and checks the
+// username/password if any, and reads the request.
+func socks5Handshake(conn net.Conn, br *bufio.Reader, auth SocksAuthFunc) (host, username, password string, err error) {
+	var n byte
+	if n, err = br.ReadByte(); err != nil {
+		return
+	}
+
+	methods := make([]byte, n)
+	if _, err = io.ReadFull(br, methods); err != nil {
+		return
+	}
+
+	method := byte(socks5AuthNoAccept)
+	for _, m := range methods {
+		if m == socks5AuthPassword {
+			method = m
+			break
+		}
+		if m == socks5AuthNone {
+			method = m
+		}
+	}
+
+	if _, err = conn.Write([]byte{socks5Version, method}); err != nil {
+		return
+	}
+
+	switch method {
+	case socks5AuthNoAccept:
+		err = fmt.Errorf("socks: no acceptable auth methods in %v", methods)
+		return
+	case socks5AuthPassword:
+		if username, password, err = readSocks5UserPass(br); err != nil {
+			return
+		}
+		// The credentials are passed to the filters too, e.g. auth
+		if auth != nil && !auth(conn.RemoteAddr(), username, password) {
+			conn.Write([]byte{0x01, 0x01})
+			err = ErrSocksAuthFailed
+			return
+		}
+		if _, err = conn.Write([]byte{0x01, 0x00}); err != nil {
+			return
+		}
+	}
+
+	var hdr [4]byte
+	if _, err = io.ReadFull(br, hdr[:]); err != nil {
+		return
+	}
+
+	if hdr[0] != socks5Version {
+		err = fmt.Errorf("socks: invalid version %#x", hdr[0])
+		return
+	}
+
+	var domain string
+	switch hdr[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if hdr[3] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err = io.ReadFull(br, ip); err != nil {
+			return
+		}
+		domain = ip.String()
+	case socks5AddrDomain:
+		var l byte
+		if l, err = br.ReadByte(); err != nil {
+			return
+		}
+		b := make([]byte, l)
+		if _, err = io.ReadFull(br, b); err != nil {
+			return
+		}
+		domain = string(b)
+	default:
+		writeSocks5Reply(conn, socks5AddrNotSupported)
+		err = fmt.Errorf("socks: address type %#x not supported", hdr[3])
+		return
+	}
+
+	var port [2]byte
+	if _, err = io.ReadFull(br, port[:]); err != nil {
+		return
+	}
+	host = net.JoinHostPort(domain, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+
+	if hdr[1] != socksCmdConnect {
+		writeSocks5Reply(conn, socks5CmdNotSupported)
+		err = ErrSocksCommandNotSupported
+		return
+	}
+
+	if !isValidSocksHost(host) {
+		writeSocks5Reply(conn, socks5GeneralFailure)
+		err = fmt.Errorf("socks: invalid host %#v", host)
+	}
+
+	return
+}
+
+func readSocks5UserPass(br *bufio.Reader) (username, password string, err error) {
+	var version, l byte
+	if version, err = br.ReadByte(); err != nil {
+		return
+	}
+	if version != 0x01 {
+		err = fmt.Errorf("socks: invalid auth version %#x", version)
+		return
+	}
+
+	for _, s := range []*string{&username, &password} {
+		if l, err = br.ReadByte(); err != nil {
+			return
+		}
+		b := make([]byte, l)
+		if _, err = io.ReadFull(br, b); err != nil {
+			return
+		}
+		*s = string(b)
+	}
+
+	return
+}
+
+func readCString(br *bufio.Reader) (string, error) {
+	// stop at 256 bytes, a client could send no NUL at all
+	b := make([]byte, 0, 64)
+	for len(b) < 256 {
+		c, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0 {
+			return string(b), nil
+		}
+		b = append(b, c)
+	}
+	return "", fmt.Errorf("socks: string too long")
+}
+
+// isValidSocksHost reports whether host could be put in a request line.
+func isValidSocksHost(host string) bool {
+	return host != "" && !strings.ContainsAny(host, " \t\r\n\x00")
+}
+
+func writeSocks5Reply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{socks5Version, rep, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socksReply returns the func which translates the http status of the
+// CONNECT request into a SOCKS reply.
+func socksReply(version byte) func(w io.Writer, status int) error {
+	return func(w io.Writer, status int) error {
+		var rep5, rep4 byte
+		switch {
+		case status >= 200 && status <= 299:
+			rep5, rep4 = socks5Succeeded, socks4Granted
+		case status == 401 || status == 403 || status == 407:
+			rep5, rep4 = socks5NotAllowed, socks4Rejected
+		case status == 502:
+			rep5, rep4 = socks5ConnectionRefused, socks4Rejected
+		case status == 504:
+			rep5, rep4 = socks5HostUnreachable, socks4Rejected
+		default:
+			rep5, rep4 = socks5GeneralFailure, socks4Rejected
+		}
+
+		if version == socks4Version {
+			_, err := w.Write([]byte{0, rep4, 0, 0, 0, 0, 0, 0})
+			return err
+		}
+		return writeSocks5Reply(w, rep5)
+	}
+}
@@ -0,0 +1,188 @@
+package helpers
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSniffConnSocks5(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan net.Conn)
+	go func() {
+		c, err := sniffConn(server, nil)
+		if err != nil {
+			t.Errorf("sniffConn() error: %v", err)
+		}
+		done <- c
+	}()
+
+	// greeting with username/password, then the credentials
+	client.Write([]byte{5, 2, 0, 2})
+	if reply := readN(t, client, 2); !bytes.Equal(reply, []byte{5, 2}) {
+		t.Fatalf("method reply = %v", reply)
+	}
+	client.Write([]byte{1, 4, 'u', 's', 'e', 'r', 2, 'p', 'w'})
+	if reply := readN(t, client, 2); !bytes.Equal(reply, []byte{1, 0}) {
+		t.Fatalf("auth reply = %v", reply)
+	}
+	client.Write(append([]byte{5, 1, 0, 3, 11}, "example.org\x01\xbb"...))
+
+	c := <-done
+	if c == nil {
+		return
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(c))
+	if err != nil {
+		t.Fatalf("http.ReadRequest() error: %v", err)
+	}
+	if req.Method != "CONNECT" || req.Host != "example.org:443" {
+		t.Errorf("request = %s %s, want CONNECT example.org:443", req.Method, req.Host)
+	}
+	if auth := req.Header.Get("Proxy-Authorization"); auth != "Basic dXNlcjpwdw==" {
+		t.Errorf("Proxy-Authorization = %#v", auth)
+	}
+
+	go func() {
+		io.WriteString(c, "HTTP/1.1 200 OK\r\nDate: now\r\n\r\nhello")
+	}()
+
+	if reply := readN(t, client, 10); reply[1] != socks5Succeeded {
+		t.Errorf("connect reply = %v", reply)
+	}
+	if data := readN(t, client, 5); string(data) != "hello" {
+		t.Errorf("tunnel data = %#v, want hello", string(data))
+	}
+}
+
+func TestSniffConnSocks5AuthFailed(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	auth := func(addr net.Addr, username, password string) bool {
+		return username == "user" && password == "secret"
+	}
+
+	done := make(chan error)
+	go func() {
+		c, err := sniffConn(server, auth)
+		if c != nil {
+			t.Errorf("sniffConn() = %v, want nil", c)
+		}
+		server.Close()
+		done <- err
+	}()
+
+	client.Write([]byte{5, 1, 2})
+	if reply := readN(t, client, 2); !bytes.Equal(reply, []byte{5, 2}) {
+		t.Fatalf("method reply = %v", reply)
+	}
+	client.Write([]byte{1, 4, 'u', 's', 'e', 'r', 2, 'p', 'w'})
+	if reply := readN(t, client, 2); !bytes.Equal(reply, []byte{1, 1}) {
+		t.Fatalf("auth reply = %v, want [1 1]", reply)
+	}
+
+	if err := <-done; err != ErrSocksAuthFailed {
+		t.Errorf("sniffConn() error = %v, want %v", err, ErrSocksAuthFailed)
+	}
+	if data, _ := ioutil.ReadAll(client); len(data) != 0 {
+		t.Errorf("unexpected data after the auth failure: %#v", string(data))
+	}
+}
+
+func TestSniffConnSocks4a(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan net.Conn)
+	go func() {
+		c, _ := sniffConn(server, nil)
+		done <- c
+	}()
+
+	client.Write(append([]byte{4, 1, 0, 80, 0, 0, 0, 1}, "bob\x00example.org\x00"...))
+
+	c := <-done
+	if c == nil {
+		t.Fatalf("sniffConn() returns nil")
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(c))
+	if err != nil {
+		t.Fatalf("http.ReadRequest() error: %v", err)
+	}
+	if req.Host != "example.org:80" {
+		t.Errorf("req.Host = %#v, want example.org:80", req.Host)
+	}
+
+	go func() {
+		io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+	}()
+
+	if reply := readN(t, client, 8); reply[1] != socks4Rejected {
+		t.Errorf("connect reply = %v", reply)
+	}
+	if data, _ := ioutil.ReadAll(client); len(data) != 0 {
+		t.Errorf("unexpected data after rejection: %#v", string(data))
+	}
+}
+
+func TestSniffConnSocks4LongUsername(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// the username never ends, sniffConn gives up without waiting for more
+	go client.Write(append([]byte{4, 1, 0, 80, 0, 0, 0, 1}, bytes.Repeat([]byte("a"), 300)...))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := sniffConn(server, nil)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("sniffConn() of a username of 300 bytes error is nil")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("sniffConn() waits for the end of a username of 300 bytes")
+	}
+}
+
+func TestSniffConnHTTP(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go io.WriteString(client, "GET http://example.org/ HTTP/1.1\r\nHost: example.org\r\n\r\n")
+
+	c, err := sniffConn(server, nil)
+	if err != nil {
+		t.Fatalf("sniffConn() error: %v", err)
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(c))
+	if err != nil {
+		t.Fatalf("http.ReadRequest() error: %v", err)
+	}
+	if req.Method != "GET" || req.URL.String() != "http://example.org/" {
+		t.Errorf("request = %s %s", req.Method, req.URL)
+	}
+}
+
+func readN(t *testing.T, r io.Reader, n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatalf("io.ReadFull(%d) error: %v", n, err)
+	}
+	return b
+}
@@ -0,0 +1,75 @@
+package helpers
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	trackerPollInterval = 500 * time.Millisecond
+)
+
+// ConnTracker keeps account of connections which are hijacked from a
+// http.Server, so that they could be drained on shutdown.
+type ConnTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+func (t *ConnTracker) Add(conns ...net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, c := range conns {
+		if c != nil {
+			t.conns[c] = struct{}{}
+		}
+	}
+}
+
+func (t *ConnTracker) Remove(conns ...net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, c := range conns {
+		delete(t.conns, c)
+	}
+}
+
+func (t *ConnTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// Wait blocks until all tracked connections are removed or ctx is done.
+func (t *ConnTracker) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(trackerPollInterval)
+	defer ticker.Stop()
+	for {
+		if t.Len() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// CloseAll closes all tracked connections.
+func (t *ConnTracker) CloseAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for c := range t.conns {
+		c.Close()
+		delete(t.conns, c)
+	}
+}
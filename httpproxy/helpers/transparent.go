@@ -0,0 +1,198 @@
+package helpers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	TransparentRedirect = "redirect"
+	TransparentTProxy   = "tproxy"
+
+	transparentPeekTimeout = 30 * time.Second
+	tlsRecordHeaderLen     = 5
+	tlsMaxRecordLen        = 16384
+)
+
+var (
+	ErrNoServerName = errors.New("transparent: no server_name in ClientHello")
+)
+
+// OriginalDst returns the original destination of a connection accepted by
+// a transparent listener.
+func OriginalDst(conn net.Conn) (net.Addr, bool) {
+	if c, ok := conn.(interface {
+		OriginalDst() net.Addr
+	}); ok {
+		return c.OriginalDst(), true
+	}
+	return nil, false
+}
+
+// transparentConn is a connection redirected to a transparent listener.
+type transparentConn struct {
+	net.Conn
+	dst net.Addr
+}
+
+func (c *transparentConn) OriginalDst() net.Addr {
+	return c.dst
+}
+
+// NetConn returns the underlying connection.
+func (c *transparentConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *transparentConn) Buffered() int {
+	return 0
+}
+
+// acceptTransparent looks up the original destination of conn, tls clients
+// are turned into a connection which reads as a CONNECT request to the SNI
+// hostname, plain http are left to be fixed up by the handler.
+func acceptTransparent(conn net.Conn, mode string) (net.Conn, error) {
+	var dst net.Addr
+	var err error
+	switch mode {
+	case TransparentRedirect:
+		dst, err = originalDst(conn)
+	case TransparentTProxy:
+		dst = conn.LocalAddr()
+	default:
+		err = fmt.Errorf("transparent: unknown mode %#v", mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(transparentPeekTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReaderSize(conn, tlsRecordHeaderLen+tlsMaxRecordLen)
+	b, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if b[0] != 0x16 {
+		return &transparentConn{
+			Conn: &peekedConn{Conn: conn, r: br},
+			dst:  dst,
+		}, nil
+	}
+
+	host, port, err := net.SplitHostPort(dst.String())
+	if err != nil {
+		return nil, err
+	}
+	if name, err := peekServerName(br); err == nil && isValidSocksHost(name) {
+		host = name
+	}
+
+	hostport := net.JoinHostPort(host, port)
+
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", hostport, hostport)
+
+	return &transparentConn{
+		Conn: &connectConn{Conn: conn, req: &req, br: br},
+		dst:  dst,
+	}, nil
+}
+
+// peekServerName peeks the server_name extension of the TLS ClientHello in
+// the first record of br.
+func peekServerName(br *bufio.Reader) (string, error) {
+	hdr, err := br.Peek(tlsRecordHeaderLen)
+	if err != nil {
+		return "", err
+	}
+
+	n := int(binary.BigEndian.Uint16(hdr[3:5]))
+	if n > tlsMaxRecordLen {
+		return "", fmt.Errorf("transparent: TLS record too large: %d", n)
+	}
+
+	b, err := br.Peek(tlsRecordHeaderLen + n)
+	if err != nil {
+		return "", err
+	}
+
+	return parseServerName(b[tlsRecordHeaderLen:])
+}
+
+// parseServerName parses the server_name of a ClientHello handshake message.
+func parseServerName(b []byte) (string, error) {
+	// handshake type, length, client version and random
+	if len(b) < 38 || b[0] != 0x01 {
+		return "", ErrNoServerName
+	}
+	b = b[38:]
+
+	skip := func(lenBytes int) bool {
+		if len(b) < lenBytes {
+			return false
+		}
+		var n int
+		for _, c := range b[:lenBytes] {
+			n = n<<8 | int(c)
+		}
+		if len(b) < lenBytes+n {
+			return false
+		}
+		b = b[lenBytes+n:]
+		return true
+	}
+
+	// session id, cipher suites, compression methods
+	if !skip(1) || !skip(2) || !skip(1) {
+		return "", ErrNoServerName
+	}
+
+	if len(b) < 2 {
+		return "", ErrNoServerName
+	}
+	exts := b[2:]
+	if n := int(binary.BigEndian.Uint16(b[:2])); n < len(exts) {
+		exts = exts[:n]
+	}
+
+	for len(exts) >= 4 {
+		typ := binary.BigEndian.Uint16(exts[0:2])
+		n := int(binary.BigEndian.Uint16(exts[2:4]))
+		if len(exts) < 4+n {
+			break
+		}
+		data := exts[4 : 4+n]
+		exts = exts[4+n:]
+
+		if typ != 0x0000 {
+			continue
+		}
+
+		// server_name_list
+		if len(data) < 2 {
+			break
+		}
+		data = data[2:]
+		for len(data) >= 3 {
+			nameType := data[0]
+			l := int(binary.BigEndian.Uint16(data[1:3]))
+			if len(data) < 3+l {
+				break
+			}
+			if nameType == 0 && l > 0 {
+				return string(data[3 : 3+l]), nil
+			}
+			data = data[3+l:]
+		}
+	}
+
+	return "", ErrNoServerName
+}
@@ -0,0 +1,90 @@
+package helpers
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	soOriginalDst = 80 // SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST
+)
+
+// originalDst returns the destination of a connection before it is
+// redirected by iptables REDIRECT or DNAT.
+func originalDst(conn net.Conn) (net.Addr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("transparent: %T is not a *net.TCPConn", conn)
+	}
+
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if laddr, ok := tc.LocalAddr().(*net.TCPAddr); ok && laddr.IP.To4() == nil {
+			var sa unix.RawSockaddrInet6
+			size := uint32(unsafe.Sizeof(sa))
+			serr = getsockopt(fd, unix.SOL_IPV6, soOriginalDst, unsafe.Pointer(&sa), &size)
+			if serr == nil {
+				addr = &net.TCPAddr{IP: net.IP(sa.Addr[:]), Port: int(ntohs(sa.Port))}
+			}
+			return
+		}
+
+		var sa unix.RawSockaddrInet4
+		size := uint32(unsafe.Sizeof(sa))
+		serr = getsockopt(fd, unix.SOL_IP, soOriginalDst, unsafe.Pointer(&sa), &size)
+		if serr == nil {
+			addr = &net.TCPAddr{IP: net.IP(sa.Addr[:]), Port: int(ntohs(sa.Port))}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, fmt.Errorf("transparent: getsockopt(SO_ORIGINAL_DST) error: %v", serr)
+	}
+
+	return addr, nil
+}
+
+func getsockopt(fd uintptr, level, name int, val unsafe.Pointer, size *uint32) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, uintptr(level), uintptr(name), uintptr(val), uintptr(unsafe.Pointer(size)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// ntohs converts the port of a raw sockaddr to the host byte order.
+func ntohs(port uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+// transparentControl sets IP_TRANSPARENT on the listening socket, so that it
+// accepts the connections routed to it by iptables TPROXY.
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		if network != "tcp4" {
+			// dual stack sockets take either of them
+			if err := unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1); err == nil {
+				serr = nil
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
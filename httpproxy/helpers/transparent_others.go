@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package helpers
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var (
+	ErrTransparentNotSupported = errors.New("transparent: only supported on linux")
+)
+
+func originalDst(conn net.Conn) (net.Addr, error) {
+	return nil, ErrTransparentNotSupported
+}
+
+func transparentControl(network, address string, c syscall.RawConn) error {
+	return ErrTransparentNotSupported
+}
@@ -0,0 +1,34 @@
+package helpers
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func TestPeekServerName(t *testing.T) {
+	for _, serverName := range []string{"www.example.org", ""} {
+		client, server := net.Pipe()
+
+		go func() {
+			tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		}()
+
+		br := bufio.NewReaderSize(server, tlsRecordHeaderLen+tlsMaxRecordLen)
+		name, err := peekServerName(br)
+		switch {
+		case serverName == "" && err != ErrNoServerName:
+			t.Errorf("peekServerName() = %#v, %v, want ErrNoServerName", name, err)
+		case serverName != "" && name != serverName:
+			t.Errorf("peekServerName() = %#v, %v, want %#v", name, err, serverName)
+		}
+
+		if b, _ := br.Peek(1); len(b) != 1 || b[0] != 0x16 {
+			t.Errorf("peekServerName() should not consume the ClientHello")
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
@@ -1,6 +1,7 @@
 package helpers
 
 import (
+	"mime"
 	"net"
 	"net/http"
 	"path"
@@ -13,19 +14,21 @@ import (
 )
 
 var (
+	// ReqWriteExcludeHeader are the headers left out by the filters which
+	// encode requests for their servers, the hop-by-hop ones included.
 	ReqWriteExcludeHeader = map[string]bool{
 		"Vary":                true,
-		"Via":                 true,
-		"X-Forwarded-For":     true,
-		"Proxy-Authorization": true,
-		"Proxy-Connection":    true,
-		"Upgrade":             true,
 		"X-Chrome-Variations": true,
-		"Connection":          true,
 		"Cache-Control":       true,
 	}
 )
 
+func init() {
+	for _, key := range HopHeaders {
+		ReqWriteExcludeHeader[key] = true
+	}
+}
+
 func CloseConnections(tr http.RoundTripper) {
 	f := func(_ net.Addr) bool { return true }
 
@@ -106,6 +109,22 @@ func GetHostName(req *http.Request) string {
 	}
 }
 
+// IsStreamingResponse reports whether the body of resp should be flushed to
+// the client as soon as it arrives, that is a server-sent event stream, a
+// chunked body of unknown length, e.g. long-poll or gRPC-web, or one which
+// asks for no buffering by "X-Accel-Buffering: no".
+func IsStreamingResponse(resp *http.Response) bool {
+	if strings.EqualFold(resp.Header.Get("X-Accel-Buffering"), "no") {
+		return true
+	}
+
+	if mediatype, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && mediatype == "text/event-stream" {
+		return true
+	}
+
+	return resp.ContentLength < 0 && len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked"
+}
+
 func IsStaticRequest(req *http.Request) bool {
 	switch path.Ext(req.URL.Path) {
 	case "bmp", "gif", "ico", "jpeg", "jpg", "png", "tif", "tiff",
@@ -28,3 +28,26 @@ func TestCloseConnections(t *testing.T) {
 		CloseConnections(tr)
 	}
 }
+
+func TestIsStreamingResponse(t *testing.T) {
+	cases := []struct {
+		header           http.Header
+		contentLength    int64
+		transferEncoding []string
+		streaming        bool
+	}{
+		{http.Header{"Content-Type": {"text/event-stream; charset=utf-8"}}, -1, nil, true},
+		{http.Header{"Content-Type": {"text/html"}}, -1, []string{"chunked"}, true},
+		{http.Header{"Content-Type": {"text/html"}}, 1024, nil, false},
+		{http.Header{"X-Accel-Buffering": {"no"}}, 1024, nil, true},
+		{http.Header{"X-Accel-Buffering": {"yes"}}, 1024, nil, false},
+		{http.Header{}, -1, nil, false},
+	}
+
+	for _, c := range cases {
+		resp := &http.Response{Header: c.header, ContentLength: c.contentLength, TransferEncoding: c.transferEncoding}
+		if got := IsStreamingResponse(resp); got != c.streaming {
+			t.Errorf("IsStreamingResponse(%v, %d, %v) = %v, want %v", c.header, c.contentLength, c.transferEncoding, got, c.streaming)
+		}
+	}
+}
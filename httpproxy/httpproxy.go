@@ -1,13 +1,19 @@
 package httpproxy
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"net/http"
+	"reflect"
+	"strings"
 	"time"
 
 	"github.com/phuslu/glog"
 
 	"github.com/xuiv/goproxy/httpproxy/filters"
 	"github.com/xuiv/goproxy/httpproxy/helpers"
+	"github.com/xuiv/goproxy/httpproxy/storage"
 
 	_ "github.com/xuiv/goproxy/httpproxy/filters/auth"
 	_ "github.com/xuiv/goproxy/httpproxy/filters/autoproxy"
@@ -22,66 +28,251 @@ import (
 )
 
 type Config struct {
-	Enabled          bool
-	Address          string
-	KeepAlivePeriod  int
-	ReadTimeout      int
-	WriteTimeout     int
-	RequestFilters   []string
-	RoundTripFilters []string
-	ResponseFilters  []string
+	Enabled           bool
+	Address           string
+	Socks             bool
+	ProxyProtocol     bool
+	TrustedProxies    []string
+	Transparent       string
+	KeepAlivePeriod   int
+	ReadTimeout       int
+	WriteTimeout      int
+	ShutdownTimeout   int // seconds, 30 by default
+	TunnelIdleTimeout int
+	TunnelMaxLifetime int
+	FlushInterval     int // milliseconds
+	ForwardPolicy     helpers.ForwardPolicy
+	RequestIDHeader   string
+	RequestFilters    []string
+	RoundTripFilters  []string
+	ResponseFilters   []string
+	TLS               TLSConfig
+	AccessLog         AccessLogConfig
+	Traffic           TrafficConfig
+}
+
+type Server struct {
+	*http.Server
+	Config   Config
+	Handler  *Handler
+	Listener net.Listener
 }
 
 func ServeProfile(config Config, branding string) error {
+	s, err := NewServer(config, branding)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve()
+}
+
+func NewServer(config Config, branding string) (_ *Server, err error) {
+	if errs := config.Validate(); len(errs) > 0 {
+		return nil, fmt.Errorf("%v on %s", errs[0], config.Address)
+	}
 
-	listenOpts := &helpers.ListenOptions{TLSConfig: nil}
+	fc, err := NewFilterChain(config)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			fc.close()
+		}
+	}()
+
+	var h *Handler
+	listenOpts := &helpers.ListenOptions{TLSConfig: nil, Socks: config.Socks}
+	if config.Socks {
+		// the chain may be replaced by a reload, the current one checks
+		listenOpts.SocksAuth = func(addr net.Addr, username, password string) bool {
+			return h.FilterChain().checkPassword(addr.String(), username, password)
+		}
+	}
+	if config.ProxyProtocol {
+		if listenOpts.ProxyProtocol, err = helpers.ParseIPNets(config.TrustedProxies); err != nil {
+			return nil, fmt.Errorf("TrustedProxies %v error: %v", config.TrustedProxies, err)
+		}
+	}
+	listenOpts.Transparent = config.Transparent
+	if config.TLS.Enabled {
+		if listenOpts.TLSConfig, err = NewTLSConfig(config.TLS, config.Address); err != nil {
+			return nil, fmt.Errorf("NewTLSConfig(%#v) error: %v", config.TLS, err)
+		}
+	}
 
 	ln, err := helpers.ListenTCP("tcp", config.Address, listenOpts)
 	if err != nil {
-		glog.Fatalf("ListenTCP(%s, %#v) error: %s", config.Address, listenOpts, err)
+		return nil, fmt.Errorf("ListenTCP(%s, %#v) error: %s", config.Address, listenOpts, err)
+	}
+
+	h = NewHandler(ln, fc, branding)
+	if config.AccessLog.Enabled {
+		if h.AccessLog, err = NewAccessLogger(config.AccessLog); err != nil {
+			ln.Close()
+			return nil, err
+		}
 	}
 
-	h := Handler{
-		Listener:         ln,
+	return NewHandlerServer(config, h), nil
+}
+
+// NewHandlerServer returns a Server which serves h on its Listener with the
+// timeouts of config, the listener and filter settings of config are not
+// used.
+func NewHandlerServer(config Config, h *Handler) *Server {
+	return &Server{
+		Server: &http.Server{
+			Handler:        h,
+			ReadTimeout:    time.Duration(config.ReadTimeout) * time.Second,
+			WriteTimeout:   time.Duration(config.WriteTimeout) * time.Second,
+			MaxHeaderBytes: 1 << 20,
+			ConnContext:    withConn,
+		},
+		Config:   config,
+		Handler:  h,
+		Listener: h.Listener,
+	}
+}
+
+func NewFilterChain(config Config) (*FilterChain, error) {
+	return newFilterChain(config, filters.GetFilter)
+}
+
+// newFilterChain builds the FilterChain of config with the filters of
+// getFilter, e.g. the ones staged by a reload.
+func newFilterChain(config Config, getFilter func(name string) (filters.Filter, error)) (_ *FilterChain, err error) {
+	fc := &FilterChain{
 		RequestFilters:   []filters.RequestFilter{},
 		RoundTripFilters: []filters.RoundTripFilter{},
 		ResponseFilters:  []filters.ResponseFilter{},
-		Branding:         branding,
+		RelayOptions: &helpers.RelayOptions{
+			IdleTimeout: time.Duration(config.TunnelIdleTimeout) * time.Second,
+			MaxLifetime: time.Duration(config.TunnelMaxLifetime) * time.Second,
+		},
+		FlushInterval:   time.Duration(config.FlushInterval) * time.Millisecond,
+		ForwardPolicy:   &config.ForwardPolicy,
+		RequestIDHeader: config.RequestIDHeader,
+	}
+
+	if err := fc.ForwardPolicy.Validate(); err != nil {
+		return nil, err
+	}
+
+	if strings.ContainsAny(fc.RequestIDHeader, " \t\r\n:") {
+		return nil, fmt.Errorf("invalid RequestIDHeader %#v", fc.RequestIDHeader)
+	}
+
+	errorPages, err := NewErrorPages(storage.LookupStoreByFilterName("httpproxy"))
+	if err != nil {
+		return nil, fmt.Errorf("NewErrorPages() error: %v", err)
+	}
+	fc.ErrorPages = errorPages
+
+	if config.Traffic.Enabled {
+		if fc.TrafficMeter, err = NewTrafficMeter(config.Traffic); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				fc.close()
+			}
+		}()
+		for i, c := range config.Traffic.Quotas {
+			q, err := NewQuota(c)
+			if err != nil {
+				return nil, fmt.Errorf("Traffic.Quotas[%d]: %v", i, err)
+			}
+			fc.Quotas = append(fc.Quotas, q)
+		}
 	}
 
 	for _, name := range config.RequestFilters {
-		f, err := filters.GetFilter(name)
+		f, err := getFilter(name)
 		f1, ok := f.(filters.RequestFilter)
 		if !ok {
-			glog.Fatalf("%#v is not a RequestFilter, err=%+v", f, err)
+			return nil, fmt.Errorf("%#v is not a RequestFilter, err=%+v", name, err)
 		}
-		h.RequestFilters = append(h.RequestFilters, f1)
+		fc.RequestFilters = append(fc.RequestFilters, f1)
 	}
 
 	for _, name := range config.RoundTripFilters {
-		f, err := filters.GetFilter(name)
+		f, err := getFilter(name)
 		f1, ok := f.(filters.RoundTripFilter)
 		if !ok {
-			glog.Fatalf("%#v is not a RoundTripFilter, err=%+v", f, err)
+			return nil, fmt.Errorf("%#v is not a RoundTripFilter, err=%+v", name, err)
 		}
-		h.RoundTripFilters = append(h.RoundTripFilters, f1)
+		fc.RoundTripFilters = append(fc.RoundTripFilters, f1)
 	}
 
 	for _, name := range config.ResponseFilters {
-		f, err := filters.GetFilter(name)
+		f, err := getFilter(name)
 		f1, ok := f.(filters.ResponseFilter)
 		if !ok {
-			glog.Fatalf("%#v is not a ResponseFilter, err=%+v", f, err)
+			return nil, fmt.Errorf("%#v is not a ResponseFilter, err=%+v", name, err)
+		}
+		fc.ResponseFilters = append(fc.ResponseFilters, f1)
+	}
+
+	return fc, nil
+}
+
+// checkPassword checks the SOCKS5 credentials with the first filter of fc
+// which is a filters.PasswordChecker, e.g. auth, all are accepted without
+// one.
+func (fc *FilterChain) checkPassword(addr, username, password string) bool {
+	for _, f := range fc.RequestFilters {
+		if c, ok := f.(filters.PasswordChecker); ok {
+			return c.CheckPassword(addr, username, password)
+		}
+	}
+	for _, f := range fc.RoundTripFilters {
+		if c, ok := f.(filters.PasswordChecker); ok {
+			return c.CheckPassword(addr, username, password)
 		}
-		h.ResponseFilters = append(h.ResponseFilters, f1)
+	}
+	return true
+}
+
+func (s *Server) Serve() error {
+	return s.Server.Serve(s.Listener)
+}
+
+// NeedsRestart reports whether config changes the listener, the timeouts
+// of http.Server or the access log, which could not be applied to a running
+// server.
+func (s *Server) NeedsRestart(config Config) bool {
+	return s.Config.Address != config.Address ||
+		s.Config.Socks != config.Socks ||
+		s.Config.ProxyProtocol != config.ProxyProtocol ||
+		s.Config.Transparent != config.Transparent ||
+		!reflect.DeepEqual(s.Config.TrustedProxies, config.TrustedProxies) ||
+		s.Config.TLS != config.TLS ||
+		s.Config.KeepAlivePeriod != config.KeepAlivePeriod ||
+		s.Config.ReadTimeout != config.ReadTimeout ||
+		s.Config.WriteTimeout != config.WriteTimeout ||
+		s.Config.AccessLog != config.AccessLog
+}
+
+// Shutdown stops accepting new connections and waits for in-flight requests
+// and hijacked tunnels to finish, those left are closed once ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Server.Shutdown(ctx)
+	if err == nil {
+		err = s.Handler.ConnTracker.Wait(ctx)
+	}
+
+	if err != nil {
+		glog.Warningf("%T.Shutdown(%#v) error: %v, close %d tunnels", s, s.Config.Address, err, s.Handler.ConnTracker.Len())
+		s.Server.Close()
+		s.Handler.ConnTracker.CloseAll()
 	}
 
-	s := &http.Server{
-		Handler:        h,
-		ReadTimeout:    time.Duration(config.ReadTimeout) * time.Second,
-		WriteTimeout:   time.Duration(config.WriteTimeout) * time.Second,
-		MaxHeaderBytes: 1 << 20,
+	// closing the meter flushes it
+	if fc := s.Handler.FilterChain(); fc != nil {
+		fc.close()
 	}
 
-	return s.Serve(h.Listener)
+	return err
 }
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("test_requests_total", "Test requests.", "code")
+
+	c.Inc("200")
+	c.Add(2, "200")
+	c.Inc(`5"0\2`)
+
+	if v := c.Value("200"); v != 3 {
+		t.Errorf("c.Value(200) = %v, want 3", v)
+	}
+
+	var b bytes.Buffer
+	c.write(&b)
+
+	want := `# HELP test_requests_total Test requests.
+# TYPE test_requests_total counter
+test_requests_total{code="200"} 3
+test_requests_total{code="5\"0\\2"} 1
+`
+	if b.String() != want {
+		t.Errorf("c.write() = %q, want %q", b.String(), want)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := NewHistogramVec("test_latency_seconds", "Test latency.", []float64{0.1, 1}, "filter")
+
+	h.Observe(0.05, "direct")
+	h.Observe(0.5, "direct")
+	h.Observe(5, "direct")
+
+	var b bytes.Buffer
+	h.write(&b)
+
+	for _, line := range []string{
+		`test_latency_seconds_bucket{filter="direct",le="0.1"} 1`,
+		`test_latency_seconds_bucket{filter="direct",le="1"} 2`,
+		`test_latency_seconds_bucket{filter="direct",le="+Inf"} 3`,
+		`test_latency_seconds_sum{filter="direct"} 5.55`,
+		`test_latency_seconds_count{filter="direct"} 3`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("h.write() = %q, want line %q", b.String(), line)
+		}
+	}
+}
+
+func TestWriteToSorted(t *testing.T) {
+	NewCounterVec("test_zz_total", "Last.")
+	NewCounterVec("test_aa_total", "First.")
+
+	var b bytes.Buffer
+	if err := WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo() error: %v", err)
+	}
+
+	s := b.String()
+	if strings.Index(s, "test_aa_total") > strings.Index(s, "test_zz_total") {
+		t.Errorf("WriteTo() is not sorted by name: %q", s)
+	}
+}
@@ -0,0 +1,114 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xuiv/goproxy/httpproxy/filters"
+	"github.com/xuiv/goproxy/httpproxy/metrics"
+)
+
+// testMetricsFilter serves "hello", fails the requests of /error and relays
+// the CONNECT tunnels to an echo.
+type testMetricsFilter struct{}
+
+func (f *testMetricsFilter) FilterName() string {
+	return "test-metrics"
+}
+
+func (f *testMetricsFilter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	switch {
+	case req.Method == http.MethodConnect:
+		return (&testTunnelFilter{}).RoundTrip(ctx, req)
+	case req.URL.Path == "/error":
+		return ctx, nil, errors.New("test error")
+	default:
+		return (&testRoundTripFilter{body: []byte("hello")}).RoundTrip(ctx, req)
+	}
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %v", err)
+	}
+	fc := &FilterChain{
+		RequestFilters:   []filters.RequestFilter{newTestAuthFilter(t)},
+		RoundTripFilters: []filters.RoundTripFilter{&testMetricsFilter{}},
+	}
+	h := NewHandler(ln, fc, "goproxy")
+	// the counters live as long as the process, a profile of its own each run
+	h.Profile = fmt.Sprintf("test-metrics-%d", time.Now().UnixNano())
+	s := NewHandlerServer(Config{}, h)
+	go s.Serve()
+	defer s.Shutdown(context.Background())
+
+	auth := "Proxy-Authorization: " + basicAuth("alice", "secret") + "\r\n"
+	for _, c := range []struct {
+		name    string
+		request string
+		tunnel  bool
+		filter  string
+		code    string
+		bytes   float64
+	}{
+		{"served", "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n" + auth + "\r\n", false, "test-metrics", "200", 5},
+		{"failed", "GET http://example.com/error HTTP/1.1\r\nHost: example.com\r\n" + auth + "\r\n", false, "test-metrics", "502", 0},
+		{"unauthenticated", "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n", false, "-", "-", 0},
+		{"tunnel", "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n" + auth + "\r\n", true, "test-metrics", "-", 6},
+	} {
+		requests := requestsTotal.Value(h.Profile, c.filter, c.code)
+		bytes := responseBytesTotal.Value(h.Profile, c.filter)
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("net.Dial error: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, c.request)
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("%s: http.ReadResponse error: %v", c.name, err)
+		}
+		if c.tunnel {
+			io.WriteString(conn, "hello\n")
+			r.ReadString('\n')
+		} else {
+			ioutil.ReadAll(resp.Body)
+		}
+		conn.Close()
+
+		// the request is counted once the handler returns
+		deadline := time.Now().Add(5 * time.Second)
+		for requestsTotal.Value(h.Profile, c.filter, c.code) == requests && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := requestsTotal.Value(h.Profile, c.filter, c.code) - requests; n != 1 {
+			t.Errorf("%s: goproxy_requests_total of %#v and %#v counts %v, want 1", c.name, c.filter, c.code, n)
+		}
+		if n := responseBytesTotal.Value(h.Profile, c.filter) - bytes; n != c.bytes {
+			t.Errorf("%s: goproxy_response_bytes_total of %#v counts %v, want %v", c.name, c.filter, n, c.bytes)
+		}
+	}
+
+	// the round trips which return a response or an error are timed
+	var b bytes.Buffer
+	if err := metrics.WriteTo(&b); err != nil {
+		t.Fatalf("metrics.WriteTo error: %v", err)
+	}
+	line := fmt.Sprintf("goproxy_roundtrip_duration_seconds_count{profile=%q,filter=\"test-metrics\"} 2\n", h.Profile)
+	if !strings.Contains(b.String(), line) {
+		t.Errorf("metrics.WriteTo has no %#v", line)
+	}
+}
@@ -0,0 +1,250 @@
+package httpproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"github.com/xuiv/goproxy/httpproxy/filters"
+	"github.com/xuiv/goproxy/httpproxy/helpers"
+)
+
+// Profiles runs the enabled profiles of httpproxy.json and applies the
+// changes of it on reload.
+type Profiles struct {
+	Branding string
+
+	mu      sync.Mutex
+	servers map[string]*Server
+	wg      sync.WaitGroup
+}
+
+func NewProfiles(branding string) *Profiles {
+	return &Profiles{
+		Branding: branding,
+		servers:  make(map[string]*Server),
+	}
+}
+
+// Start starts serving profile with config.
+func (p *Profiles) Start(profile string, config Config) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.start(profile, config)
+}
+
+func (p *Profiles) start(profile string, config Config) error {
+	s, err := p.serve(profile, config)
+	if err != nil {
+		return err
+	}
+
+	p.servers[profile] = s
+
+	return nil
+}
+
+// serve starts a server of profile with config without adding it to p.
+func (p *Profiles) serve(profile string, config Config) (*Server, error) {
+	s, err := NewServer(config, p.Branding)
+	if err != nil {
+		return nil, err
+	}
+	s.Handler.Profile = profile
+
+	go func() {
+		err := s.Serve()
+		if err != nil && err != http.ErrServerClosed && err != helpers.ErrListenerClosed {
+			glog.Errorf("GoProxy Profile %#v Serve error: %+v", profile, err)
+		}
+	}()
+
+	return s, nil
+}
+
+// Servers returns a snapshot of the running servers keyed by profile.
+func (p *Profiles) Servers() map[string]*Server {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	servers := make(map[string]*Server, len(p.servers))
+	for profile, s := range p.servers {
+		servers[profile] = s
+	}
+
+	return servers
+}
+
+// Configs returns the configs of the running servers keyed by profile.
+func (p *Profiles) Configs() map[string]Config {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	configs := make(map[string]Config, len(p.servers))
+	for profile, s := range p.servers {
+		configs[profile] = s.Config
+	}
+
+	return configs
+}
+
+// Reload applies config to the running profiles along with the filters of
+// staged. The filter chains of the profiles are swapped in place, the
+// profiles whose listener settings are changed are restarted, the new
+// profiles are started and the disabled or removed ones are shut down
+// gracefully. A profile which fails to restart keeps serving, or is reopened,
+// with its old listener settings. Nothing is changed and staged is discarded
+// if one of the filter chains fails to build, otherwise staged is committed
+// and the filters it replaces are closed once the requests of the old chains
+// are done.
+func (p *Profiles) Reload(config map[string]Config, staged *filters.Staged) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fcs := make(map[string]*FilterChain)
+	for profile, c := range config {
+		if !c.Enabled {
+			continue
+		}
+		fc, err := newFilterChain(c, staged.GetFilter)
+		if err != nil {
+			for _, fc := range fcs {
+				fc.close()
+			}
+			staged.Discard()
+			return fmt.Errorf("profile %#v: %+v", profile, err)
+		}
+		fcs[profile] = fc
+	}
+
+	old := make([]*FilterChain, 0, len(p.servers))
+	for _, s := range p.servers {
+		old = append(old, s.Handler.FilterChain())
+	}
+	staged.Commit(func() {
+		for _, fc := range old {
+			fc.drain()
+		}
+	})
+
+	// the old chains are closed even if no filter is replaced, Shutdown
+	// waits for them
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for _, fc := range old {
+			fc.drain()
+			fc.close()
+		}
+	}()
+
+	for profile, s := range p.servers {
+		if _, ok := fcs[profile]; !ok {
+			glog.Infof("GoProxy Profile %#v is removed, shutting down %#v", profile, s.Config.Address)
+			p.retire(profile, s)
+		}
+	}
+
+	// the restarted and added profiles build their own chains, the chains
+	// which are not swapped in are closed
+	used := make(map[*FilterChain]bool)
+	errs := make([]string, 0)
+	for profile, fc := range fcs {
+		c := config[profile]
+		s, ok := p.servers[profile]
+		switch {
+		case ok && !s.NeedsRestart(c):
+			s.Handler.SetFilterChain(fc)
+			used[fc] = true
+			s.Config = c
+			continue
+		case ok && s.Config.Address != c.Address:
+			glog.Infof("GoProxy Profile %#v listener is changed, restarting on %#v", profile, c.Address)
+			s1, err := p.serve(profile, c)
+			if err != nil {
+				// the old server is kept, with the filters of the reload
+				s.Handler.SetFilterChain(fc)
+				used[fc] = true
+				errs = append(errs, fmt.Sprintf("profile %#v: %+v, still serving on %#v", profile, err, s.Config.Address))
+				continue
+			}
+			p.retire(profile, s)
+			p.servers[profile] = s1
+		case ok:
+			// the address is taken by the old server until it is retired
+			glog.Infof("GoProxy Profile %#v listener is changed, restarting on %#v", profile, c.Address)
+			p.retire(profile, s)
+			if err := p.start(profile, c); err != nil {
+				errs = append(errs, fmt.Sprintf("profile %#v: %+v", profile, err))
+				if err := p.start(profile, s.Config); err != nil {
+					errs = append(errs, fmt.Sprintf("profile %#v: reopen %#v: %+v", profile, s.Config.Address, err))
+				} else {
+					h := p.servers[profile].Handler
+					h.FilterChain().close()
+					h.SetFilterChain(fc)
+					used[fc] = true
+				}
+			}
+		default:
+			glog.Infof("GoProxy Profile %#v is added, starting on %#v", profile, c.Address)
+			if err := p.start(profile, c); err != nil {
+				errs = append(errs, fmt.Sprintf("profile %#v: %+v", profile, err))
+			}
+		}
+	}
+
+	for _, fc := range fcs {
+		if !used[fc] {
+			fc.close()
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// defaultShutdownTimeout is the time the requests and the tunnels of a
+// profile are waited for after it stops listening, if ShutdownTimeout is 0.
+const defaultShutdownTimeout = 30 * time.Second
+
+// retire stops the listener of s at once, so that its address could be
+// reused, and shuts it down in background.
+func (p *Profiles) retire(profile string, s *Server) {
+	delete(p.servers, profile)
+	s.Listener.Close()
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		timeout := time.Duration(s.Config.ShutdownTimeout) * time.Second
+		if timeout == 0 {
+			timeout = defaultShutdownTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		s.Shutdown(ctx)
+	}()
+}
+
+// Shutdown shuts down all profiles in parallel, including the ones retired
+// by Reload, and waits for them.
+func (p *Profiles) Shutdown() {
+	p.mu.Lock()
+	for profile, s := range p.servers {
+		p.retire(profile, s)
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
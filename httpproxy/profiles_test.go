@@ -0,0 +1,387 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xuiv/goproxy/httpproxy/filters"
+	"github.com/xuiv/goproxy/httpproxy/storage"
+)
+
+// installTestFilter installs f as the filter of its name once per process,
+// the tests may be run more than once.
+func installTestFilter(t *testing.T, f filters.Filter) {
+	if _, ok := filters.LookupFilter(f.FilterName()); ok {
+		return
+	}
+	if err := filters.Install(f.FilterName(), f); err != nil {
+		t.Fatalf("filters.Install(%#v) error: %v", f.FilterName(), err)
+	}
+}
+
+// freeAddr returns a local address which is not listened on.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// proxyGet returns the body of a GET of http://example.com/ through the
+// proxy addr.
+func proxyGet(t *testing.T, addr string) string {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:             http.ProxyURL(&url.URL{Scheme: "http", Host: addr}),
+			DisableKeepAlives: true,
+		},
+	}
+
+	resp, err := client.Get("http://example.com/")
+	if err != nil {
+		t.Fatalf("GET through %s error: %v", addr, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("GET through %s read error: %v", addr, err)
+	}
+	return string(body)
+}
+
+// tempWorkDir changes the working directory, where the filter configs are
+// looked up, to a new temporary one until the test ends.
+func tempWorkDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "httpproxy")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() error: %v", err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("os.Getwd() error: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("os.Chdir(%#v) error: %v", dir, err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func reloadProfiles(t *testing.T, p *Profiles, config map[string]Config) error {
+	staged, err := filters.Stage()
+	if err != nil {
+		t.Fatalf("filters.Stage error: %v", err)
+	}
+	return p.Reload(config, staged)
+}
+
+func TestReloadStartFails(t *testing.T) {
+	installTestFilter(t, &testRoundTripFilter{name: "test-one", body: []byte("one")})
+	installTestFilter(t, &testRoundTripFilter{name: "test-two", body: []byte("two")})
+
+	for _, c := range []struct {
+		name   string
+		change func(c *Config)
+	}{
+		{"the address is taken", func(c *Config) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("net.Listen error: %v", err)
+			}
+			t.Cleanup(func() { ln.Close() })
+			c.Address = ln.Addr().String()
+		}},
+		{"the cert of the same address is bad", func(c *Config) {
+			c.TLS = TLSConfig{Enabled: true, CertFile: "missing.crt", KeyFile: "missing.key"}
+		}},
+	} {
+		p := NewProfiles("goproxy")
+
+		old := Config{Enabled: true, Address: freeAddr(t), ShutdownTimeout: 1, RoundTripFilters: []string{"test-one"}}
+		if err := p.Start("default", old); err != nil {
+			t.Fatalf("%s: Start error: %v", c.name, err)
+		}
+		if body := proxyGet(t, old.Address); body != "one" {
+			t.Fatalf("%s: GET = %#v, want \"one\"", c.name, body)
+		}
+
+		config := old
+		config.RoundTripFilters = []string{"test-two"}
+		c.change(&config)
+
+		if err := reloadProfiles(t, p, map[string]Config{"default": config}); err == nil {
+			t.Errorf("%s: Reload error is nil", c.name)
+		}
+
+		s, ok := p.Servers()["default"]
+		if !ok {
+			t.Fatalf("%s: the profile is gone after the failed restart", c.name)
+		}
+		if s.Config.Address != old.Address || s.Config.TLS.Enabled {
+			t.Errorf("%s: the profile is on %#v, want the old config", c.name, s.Config.Address)
+		}
+		// the old listener serves the new filters
+		if body := proxyGet(t, old.Address); body != "two" {
+			t.Errorf("%s: GET after the reload = %#v, want \"two\"", c.name, body)
+		}
+
+		p.Shutdown()
+	}
+}
+
+// testTunnelFilter hijacks the CONNECT requests and relays the tunnels to an
+// echo until the clients close them.
+type testTunnelFilter struct {
+	name string
+}
+
+func (f *testTunnelFilter) FilterName() string {
+	return f.name
+}
+
+func (f *testTunnelFilter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	rw := filters.GetResponseWriter(ctx)
+	rw.WriteHeader(http.StatusOK)
+	rw.(http.Flusher).Flush()
+
+	lconn, _, err := rw.(http.Hijacker).Hijack()
+	if err != nil {
+		return ctx, nil, err
+	}
+	defer lconn.Close()
+
+	rconn, echo := net.Pipe()
+	defer rconn.Close()
+	go func() {
+		io.Copy(echo, echo)
+		echo.Close()
+	}()
+	defer filters.TrackConn(ctx, lconn, rconn)()
+
+	filters.Relay(ctx, lconn, rconn)
+	return ctx, filters.DummyResponse, nil
+}
+
+// TestShutdownTunnel shuts down a profile of the default ShutdownTimeout
+// while a hijacked tunnel is open, the tunnel keeps working until it is
+// closed by the client.
+func TestShutdownTunnel(t *testing.T) {
+	installTestFilter(t, &testTunnelFilter{name: "test-tunnel"})
+
+	p := NewProfiles("goproxy")
+	config := Config{Enabled: true, Address: freeAddr(t), RoundTripFilters: []string{"test-tunnel"}}
+	if err := p.Start("default", config); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", config.Address)
+	if err != nil {
+		t.Fatalf("net.Dial error: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT = %v, %v, want 200", resp, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.Shutdown()
+		close(done)
+	}()
+
+	echo := func(line string) error {
+		conn.SetDeadline(time.Now().Add(time.Second))
+		if _, err := io.WriteString(conn, line); err != nil {
+			return err
+		}
+		got, err := r.ReadString('\n')
+		if err == nil && got != line {
+			err = fmt.Errorf("echoed %#v, want %#v", got, line)
+		}
+		return err
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatalf("Shutdown returns while the tunnel is open")
+	default:
+	}
+	if err := echo("hello\n"); err != nil {
+		t.Fatalf("the tunnel during Shutdown: %v", err)
+	}
+
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Shutdown does not return after the tunnel is closed")
+	}
+}
+
+// testReloadFilter answers every request with the Body of its json config,
+// the config with Fail set fails to build.
+type testReloadFilter struct {
+	name   string
+	body   []byte
+	closed int32
+}
+
+var testReloadInstances int32
+
+func init() {
+	filters.Register("test-reload", func(name string) (filters.Filter, error) {
+		var config struct {
+			Body string
+			Fail bool
+		}
+		if err := storage.LookupStoreByFilterName("test-reload").UnmarshallJson(name+".json", &config); err != nil {
+			return nil, err
+		}
+		if config.Fail {
+			return nil, fmt.Errorf("%#v fails", name)
+		}
+		return &testReloadFilter{name: name, body: []byte(config.Body)}, nil
+	})
+}
+
+func (f *testReloadFilter) FilterName() string {
+	return f.name
+}
+
+func (f *testReloadFilter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	return (&testRoundTripFilter{body: f.body}).RoundTrip(ctx, req)
+}
+
+func (f *testReloadFilter) Close() error {
+	atomic.StoreInt32(&f.closed, 1)
+	return nil
+}
+
+func (f *testReloadFilter) isClosed() bool {
+	return atomic.LoadInt32(&f.closed) == 1
+}
+
+func TestReloadFilters(t *testing.T) {
+	dir := tempWorkDir(t)
+
+	// a new instance each run, the created filters live as long as the
+	// process
+	name := fmt.Sprintf("test-reload@%d", atomic.AddInt32(&testReloadInstances, 1))
+	write := func(config string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".json"), []byte(config), 0644); err != nil {
+			t.Fatalf("ioutil.WriteFile error: %v", err)
+		}
+	}
+	lookup := func() *testReloadFilter {
+		f, _ := filters.LookupFilter(name)
+		return f.(*testReloadFilter)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "test-reload.json"), []byte(`{}`), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile error: %v", err)
+	}
+	write(`{"Body": "one"}`)
+	p := NewProfiles("goproxy")
+	defer p.Shutdown()
+	config := Config{Enabled: true, Address: freeAddr(t), ShutdownTimeout: 1, RoundTripFilters: []string{name}}
+	if err := p.Start("default", config); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	one := lookup()
+
+	// an unchanged filter is kept
+	if err := reloadProfiles(t, p, map[string]Config{"default": config}); err != nil {
+		t.Fatalf("Reload error: %v", err)
+	}
+	if f := lookup(); f != one || f.isClosed() {
+		t.Errorf("the unchanged filter is replaced or closed by Reload")
+	}
+	if body := proxyGet(t, config.Address); body != "one" {
+		t.Errorf("GET after an unchanged Reload = %#v, want \"one\"", body)
+	}
+
+	// a changed filter is swapped in, the old one is closed once drained
+	write(`{"Body": "two"}`)
+	if err := reloadProfiles(t, p, map[string]Config{"default": config}); err != nil {
+		t.Fatalf("Reload error: %v", err)
+	}
+	two := lookup()
+	if two == one {
+		t.Fatalf("the changed filter is not replaced by Reload")
+	}
+	if body := proxyGet(t, config.Address); body != "two" {
+		t.Errorf("GET after Reload = %#v, want \"two\"", body)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !one.isClosed(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the replaced filter is not closed")
+		}
+	}
+
+	// a chain which fails to build discards the staged filter
+	write(`{"Body": "three"}`)
+	staged, err := filters.Stage()
+	if err != nil {
+		t.Fatalf("filters.Stage error: %v", err)
+	}
+	three, err := staged.GetFilter(name)
+	if err != nil {
+		t.Fatalf("Staged.GetFilter error: %v", err)
+	}
+	bad := config
+	bad.RoundTripFilters = []string{name, "test-missing"}
+	if err := p.Reload(map[string]Config{"default": bad}, staged); err == nil {
+		t.Errorf("Reload of an unknown filter error is nil")
+	}
+	if !three.(*testReloadFilter).isClosed() {
+		t.Errorf("the staged filter of the failed Reload is not closed")
+	}
+	if f := lookup(); f != two || f.isClosed() {
+		t.Errorf("the running filter is replaced or closed by the failed Reload")
+	}
+
+	// a filter which fails to build is not staged, and not retried until
+	// its config is changed again
+	write(`{"Fail": true}`)
+	if staged, err := filters.Stage(); err == nil {
+		staged.Discard()
+		t.Errorf("filters.Stage of a failing filter error is nil")
+	}
+	if err := reloadProfiles(t, p, map[string]Config{"default": config}); err != nil {
+		t.Errorf("Reload after the failed Stage error: %v", err)
+	}
+	if body := proxyGet(t, config.Address); body != "two" {
+		t.Errorf("GET after the failed Stage = %#v, want \"two\"", body)
+	}
+
+	// the fixed config is staged again, so the instance is left alone by
+	// the later runs once its config is gone
+	write(`{"Body": "four"}`)
+	if err := reloadProfiles(t, p, map[string]Config{"default": config}); err != nil {
+		t.Fatalf("Reload error: %v", err)
+	}
+	if body := proxyGet(t, config.Address); body != "four" {
+		t.Errorf("GET after the fixed Reload = %#v, want \"four\"", body)
+	}
+}
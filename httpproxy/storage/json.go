@@ -2,24 +2,99 @@ package storage
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"path"
+	"reflect"
+	"sort"
 	"strings"
 )
 
-func readJsonConfig(store Store, filename string, config interface{}) error {
+const (
+	// InstanceSep separates the filter name and the instance name of a json
+	// config, e.g. "direct@corp.json" is the "corp" instance of "direct".
+	InstanceSep = "@"
+)
+
+// jsonConfigFilenames returns the files which make up the json config, each
+// one overlays the former. "direct.json" is made up of direct.json and
+// direct.user.json, and "direct@corp.json" of direct.json, direct.user.json,
+// direct@corp.json and direct@corp.user.json.
+func jsonConfigFilenames(filename string) []string {
 	fileext := path.Ext(filename)
-	filename1 := strings.TrimSuffix(filename, fileext) + ".user" + fileext
+	basename := strings.TrimSuffix(filename, fileext)
+
+	filenames := make([]string, 0, 4)
+	if i := strings.Index(basename, InstanceSep); i > 0 {
+		filenames = append(filenames, basename[:i]+fileext, basename[:i]+".user"+fileext)
+	}
+
+	return append(filenames, filename, basename+".user"+fileext)
+}
+
+// isUserJsonConfig reports whether filename is a ".user" overlay, which is
+// optional.
+func isUserJsonConfig(filename string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(filename, path.Ext(filename)), ".user")
+}
+
+// JsonConfigDigest returns a digest of the files which make up the json
+// config, it changes whenever one of them is edited, created or removed.
+func JsonConfigDigest(store Store, filename string) (string, error) {
+	h := sha1.New()
+	for _, name := range jsonConfigFilenames(filename) {
+		resp, err := store.Get(name)
+		if err != nil {
+			if !isUserJsonConfig(name) {
+				return "", err
+			} else {
+				continue
+			}
+		}
+
+		fmt.Fprintf(h, "%s\n", name)
+		if resp.Body != nil {
+			_, err = io.Copy(h, resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return "", err
+			}
+		}
+	}
 
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func readJsonConfig(store Store, filename string, config interface{}) error {
+	cm, err := readJsonConfigMap(store, filename)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(cm)
+	if err != nil {
+		return err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+
+	return d.Decode(config)
+}
+
+// readJsonConfigMap reads the files which make up the json config and merges
+// them into a map.
+func readJsonConfigMap(store Store, filename string) (map[string]interface{}, error) {
 	cm := make(map[string]interface{})
-	for i, name := range []string{filename, filename1} {
+	for _, name := range jsonConfigFilenames(filename) {
 		resp, err := store.Get(name)
 		if err != nil {
-			if i == 0 {
-				return err
+			if !isUserJsonConfig(name) {
+				return nil, err
 			} else {
 				continue
 			}
@@ -30,7 +105,7 @@ func readJsonConfig(store Store, filename string, config interface{}) error {
 
 			data, err := readJson(resp.Body)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
@@ -41,24 +116,142 @@ func readJsonConfig(store Store, filename string, config interface{}) error {
 			d.UseNumber()
 
 			if err = d.Decode(&cm1); err != nil {
-				return err
+				return nil, fmt.Errorf("%s: %v", name, err)
 			}
 
 			if err = mergeMap(cm, cm1); err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
 
-	data, err := json.Marshal(cm)
+	return cm, nil
+}
+
+// ConfigError is a problem of a json config, Key is the path of the key in
+// it, e.g. "TLSConfig.Ciphers[1]", or empty for the whole file.
+type ConfigError struct {
+	Filename string
+	Key      string
+	Err      error
+}
+
+func (e *ConfigError) Error() string {
+	s := e.Filename
+	if e.Key != "" {
+		if s != "" {
+			s += ": "
+		}
+		s += e.Key
+	}
+	if s == "" {
+		return e.Err.Error()
+	}
+	return s + ": " + e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// UnknownJsonKeys returns the paths of the keys of the json config which do
+// not match a field of config, they are silently ignored by UnmarshallJson.
+func UnknownJsonKeys(store Store, filename string, config interface{}) ([]string, error) {
+	cm, err := readJsonConfigMap(store, filename)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	d := json.NewDecoder(bytes.NewReader(data))
-	d.UseNumber()
+	keys := make([]string, 0)
+	unknownJsonKeys(reflect.TypeOf(config), cm, "", &keys)
+	sort.Strings(keys)
 
-	return d.Decode(config)
+	return keys, nil
+}
+
+func unknownJsonKeys(t reflect.Type, v interface{}, prefix string, keys *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return
+		}
+		fields := jsonFields(t)
+		for key, value := range m {
+			ft, ok := fields[key]
+			if !ok {
+				for name, ft1 := range fields {
+					if strings.EqualFold(name, key) {
+						ft, ok = ft1, true
+						break
+					}
+				}
+			}
+			if !ok {
+				*keys = append(*keys, prefix+key)
+				continue
+			}
+			unknownJsonKeys(ft, value, prefix+key+".", keys)
+		}
+	case reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for key, value := range m {
+			unknownJsonKeys(t.Elem(), value, prefix+key+".", keys)
+		}
+	case reflect.Slice, reflect.Array:
+		a, ok := v.([]interface{})
+		if !ok {
+			return
+		}
+		prefix = strings.TrimSuffix(prefix, ".")
+		for i, value := range a {
+			unknownJsonKeys(t.Elem(), value, fmt.Sprintf("%s[%d].", prefix, i), keys)
+		}
+	}
+}
+
+// jsonFields returns the types of the fields of the struct type t by their
+// json names, the fields of the embedded structs included.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Name
+		if tag := f.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if tagName := strings.Split(tag, ",")[0]; tagName != "" {
+				name = tagName
+			}
+		}
+		if f.Anonymous && f.Tag.Get("json") == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for name1, ft1 := range jsonFields(ft) {
+					if _, ok := fields[name1]; !ok {
+						fields[name1] = ft1
+					}
+				}
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		fields[name] = f.Type
+	}
+	return fields
 }
 
 func readJson(r io.Reader) ([]byte, error) {
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type testJsonConfig struct {
+	testJsonEmbedded
+	Name  string
+	Tag   string `json:"tag_name"`
+	Skip  string `json:"-"`
+	Inner struct {
+		Size int
+	}
+	Rules []struct {
+		Host string
+	}
+	Sites map[string]struct {
+		Filter string
+	}
+	Extra interface{}
+}
+
+type testJsonEmbedded struct {
+	Embedded bool
+}
+
+func TestUnknownJsonKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		json string
+		keys []string
+	}{
+		{`{"Name": "a", "tag_name": "b", "Embedded": true, "Extra": {"Any": 1}}`, []string{}},
+		{`{"name": "a", "INNER": {"size": 1}}`, []string{}},
+		{`{"Nmae": "a", "Tag": "b", "Skip": "c"}`, []string{"Nmae", "Skip", "Tag"}},
+		{`{"Inner": {"Size": 1, "Sise": 2}}`, []string{"Inner.Sise"}},
+		{`{"Rules": [{"Host": "a"}, {"Hots": "b"}]}`, []string{"Rules[1].Hots"}},
+		{`{"Sites": {"example.com": {"Filter": "direct", "Filtre": "gae"}}}`, []string{"Sites.example.com.Filtre"}},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "test.json"), []byte(c.json), 0644); err != nil {
+			t.Fatalf("ioutil.WriteFile error: %v", err)
+		}
+
+		keys, err := UnknownJsonKeys(&FileStore{Dirname: dir}, "test.json", new(testJsonConfig))
+		if err != nil {
+			t.Fatalf("UnknownJsonKeys(%s) error: %v", c.json, err)
+		}
+		if !reflect.DeepEqual(keys, c.keys) {
+			t.Errorf("UnknownJsonKeys(%s) = %#v, want %#v", c.json, keys, c.keys)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package httpproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"github.com/xuiv/goproxy/httpproxy/filters"
+	"github.com/xuiv/goproxy/httpproxy/helpers"
+)
+
+type TLSConfig struct {
+	Enabled  bool
+	CertFile string
+	KeyFile  string
+	// RootCA names a stripssl filter whose RootCA issues the certificates,
+	// it is used if CertFile is empty.
+	RootCA string
+	// ClientCAFile enables client certificates verification against the CA
+	// bundle in it.
+	ClientCAFile string
+	TLSVersion   string
+}
+
+// NewTLSConfig creates the tls.Config of a profile listening on address.
+func NewTLSConfig(config TLSConfig, address string) (*tls.Config, error) {
+	c := &tls.Config{
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: true,
+	}
+
+	if v := helpers.TLSVersion(config.TLSVersion); v != 0 {
+		c.MinVersion = v
+	}
+
+	switch {
+	case config.CertFile != "":
+		kp := &keyPair{CertFile: config.CertFile, KeyFile: config.KeyFile}
+		if _, err := kp.GetCertificate(nil); err != nil {
+			return nil, err
+		}
+		c.GetCertificate = kp.GetCertificate
+	case config.RootCA != "":
+		f, err := filters.GetFilter(config.RootCA)
+		if err != nil {
+			return nil, err
+		}
+		issuer, ok := f.(interface {
+			IssueCertificate(host string, ecc bool) (*tls.Certificate, error)
+		})
+		if !ok {
+			return nil, fmt.Errorf("%#v could not issue certificates", config.RootCA)
+		}
+		defaultHost, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		c.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			host := hello.ServerName
+			if host == "" {
+				host = defaultHost
+			}
+			return issuer.IssueCertificate(host, helpers.HasECCCiphers(hello.CipherSuites))
+		}
+	default:
+		return nil, fmt.Errorf("neither CertFile nor RootCA is set")
+	}
+
+	if config.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %#v", config.ClientCAFile)
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return c, nil
+}
+
+// keyPair loads a certificate from CertFile and KeyFile, and reloads it once
+// they are modified, so that renewed certificates are served without restart.
+type keyPair struct {
+	CertFile string
+	KeyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func (kp *keyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+
+	now := time.Now()
+	if kp.cert != nil && now.Sub(kp.checked) < time.Minute {
+		return kp.cert, nil
+	}
+	kp.checked = now
+
+	var modTime time.Time
+	for _, filename := range []string{kp.CertFile, kp.KeyFile} {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			if kp.cert != nil {
+				return kp.cert, nil
+			}
+			return nil, err
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+
+	if kp.cert != nil && !modTime.After(kp.modTime) {
+		return kp.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(kp.CertFile, kp.KeyFile)
+	if err != nil {
+		if kp.cert != nil {
+			glog.Warningf("tls.LoadX509KeyPair(%#v, %#v) error: %v, keep the loaded certificate", kp.CertFile, kp.KeyFile, err)
+			return kp.cert, nil
+		}
+		return nil, err
+	}
+
+	kp.cert = &cert
+	kp.modTime = modTime
+
+	return kp.cert, nil
+}
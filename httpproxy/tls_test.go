@@ -0,0 +1,199 @@
+package httpproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate signed by parent, or self-signed if parent is
+// nil, in PEM and loaded.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+	pair    tls.Certificate
+}
+
+func newTestCert(t *testing.T, name string, isCA bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey error: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate error: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("x509.MarshalECPrivateKey error: %v", err)
+	}
+
+	c := &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+	if c.pair, err = tls.X509KeyPair(c.certPEM, c.keyPEM); err != nil {
+		t.Fatalf("tls.X509KeyPair error: %v", err)
+	}
+	return c
+}
+
+func TestNewTLSConfigCertFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", true, nil)
+	server := newTestCert(t, "server", false, ca)
+	other := newTestCert(t, "other", false, ca)
+
+	files := map[string][]byte{
+		"ca.crt":     ca.certPEM,
+		"server.crt": server.certPEM,
+		"server.key": server.keyPEM,
+		"other.key":  other.keyPEM,
+		"empty.crt":  []byte("no certificates\n"),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatalf("ioutil.WriteFile error: %v", err)
+		}
+	}
+	path := func(name string) string {
+		if name == "" {
+			return ""
+		}
+		return filepath.Join(dir, name)
+	}
+
+	for _, c := range []struct {
+		name     string
+		cert     string
+		key      string
+		clientCA string
+		ok       bool
+	}{
+		{"the key pair", "server.crt", "server.key", "", true},
+		{"the key pair with a client CA", "server.crt", "server.key", "ca.crt", true},
+		{"the key of another cert", "server.crt", "other.key", "", false},
+		{"a missing key", "server.crt", "missing.key", "", false},
+		{"the key as the cert", "server.key", "server.key", "", false},
+		{"neither CertFile nor RootCA", "", "", "", false},
+		{"a client CA of no certificates", "server.crt", "server.key", "empty.crt", false},
+		{"a missing client CA", "server.crt", "server.key", "missing.crt", false},
+	} {
+		config := TLSConfig{Enabled: true, CertFile: path(c.cert), KeyFile: path(c.key), ClientCAFile: path(c.clientCA)}
+		if _, err := NewTLSConfig(config, "127.0.0.1:8443"); (err == nil) != c.ok {
+			t.Errorf("NewTLSConfig of %s error = %v, want ok=%v", c.name, err, c.ok)
+		}
+	}
+}
+
+func TestNewTLSConfigClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", true, nil)
+	server := newTestCert(t, "127.0.0.1", false, ca)
+	client := newTestCert(t, "alice", false, ca)
+	stranger := newTestCert(t, "mallory", false, newTestCert(t, "other ca", true, nil))
+
+	for name, data := range map[string][]byte{"ca.crt": ca.certPEM, "server.crt": server.certPEM, "server.key": server.keyPEM} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatalf("ioutil.WriteFile error: %v", err)
+		}
+	}
+
+	config, err := NewTLSConfig(TLSConfig{
+		Enabled:      true,
+		CertFile:     filepath.Join(dir, "server.crt"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	}, "127.0.0.1:8443")
+	if err != nil {
+		t.Fatalf("NewTLSConfig error: %v", err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("tls.Listen error: %v", err)
+	}
+	defer ln.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	for _, c := range []struct {
+		name  string
+		certs []tls.Certificate
+		ok    bool
+	}{
+		{"a client cert of the CA", []tls.Certificate{client.pair}, true},
+		{"no client cert", nil, false},
+		{"a client cert of another CA", []tls.Certificate{stranger.pair}, false},
+	} {
+		// the server tells whether the client is verified, a TLS 1.3 client
+		// finishes its handshake before that
+		errc := make(chan error, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				errc <- err
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			errc <- conn.(*tls.Conn).Handshake()
+		}()
+
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "127.0.0.1", Certificates: c.certs})
+		if err == nil {
+			conn.Close()
+		}
+		if err := <-errc; (err == nil) != c.ok {
+			t.Errorf("the handshake of %s error = %v, want ok=%v", c.name, err, c.ok)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package httpproxy
+
+import (
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+
+	"github.com/xuiv/goproxy/httpproxy/filters"
+)
+
+const (
+	DefaultTraceLogSize = 1024
+)
+
+// RequestTrace is the timeline of a request recorded by filters.Trace and
+// the httptrace hooks, along with the snapshot of its entry of the
+// ConnTable.
+type RequestTrace struct {
+	ConnInfo
+	Status int  `json:",omitempty"`
+	Done   bool // false for the requests in flight
+	Events []filters.TraceEvent
+}
+
+// TraceLog keeps the timelines of the latest finished requests of a Handler
+// by request ID.
+type TraceLog struct {
+	cache lrucache.Cache
+}
+
+func NewTraceLog(size uint) *TraceLog {
+	return &TraceLog{
+		cache: lrucache.NewLRUCache(size),
+	}
+}
+
+func (l *TraceLog) add(t *RequestTrace) {
+	l.cache.Set(t.RequestID, t, time.Time{})
+}
+
+// Get returns the timeline of the finished request requestID.
+func (l *TraceLog) Get(requestID string) (*RequestTrace, bool) {
+	v, ok := l.cache.GetQuiet(requestID)
+	if !ok {
+		return nil, false
+	}
+	return v.(*RequestTrace), true
+}
+
+// Trace returns the timeline of the request requestID of h, in flight or
+// finished lately.
+func (h *Handler) Trace(requestID string) (*RequestTrace, bool) {
+	if t, ok := h.Conns.Trace(requestID); ok {
+		return t, true
+	}
+	return h.Traces.Get(requestID)
+}
@@ -0,0 +1,582 @@
+package httpproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"github.com/xuiv/goproxy/httpproxy/filters"
+	"github.com/xuiv/goproxy/httpproxy/helpers"
+	"github.com/xuiv/goproxy/httpproxy/storage"
+)
+
+const (
+	TrafficFilename = "traffic.json"
+
+	defaultTrafficFlushInterval = time.Minute
+	defaultTrafficKeepDays      = 62
+
+	// trafficCollectInterval is how often the bytes of the requests and the
+	// tunnels in flight are counted, so that a long tunnel is not counted
+	// only once it is closed.
+	trafficCollectInterval = 10 * time.Second
+
+	trafficDayFormat   = "2006-01-02"
+	trafficMonthFormat = "2006-01"
+)
+
+// TrafficConfig enables the counting of the traffic of a profile by day,
+// user, or client ip of the requests without one, and RoundTripFilter, and
+// the quotas of it.
+type TrafficConfig struct {
+	Enabled       bool
+	Filename      string // in the store of httpproxy.json, "traffic.json" by default
+	FlushInterval int    // seconds
+	KeepDays      int    // at least 31 with a Monthly quota, 62 by default
+	Quotas        []QuotaConfig
+}
+
+// QuotaConfig limits the traffic of the users and the client ips listed in
+// it, "*" matches all the users. Only the traffic through Filters counts, all
+// the RoundTripFilters if empty, "direct" covers all the instances of it and
+// "direct@corp" only that one. Every quota matching a request applies.
+type QuotaConfig struct {
+	Users   []string
+	IPs     []string // ips, CIDRs and ranges, for the requests without a user
+	Filters []string
+	Daily   int64 // megabytes, 0 is no limit
+	Monthly int64 // megabytes, 0 is no limit
+	Status  int   // of the refused requests, 429 by default or 403
+}
+
+// withDefaults returns c with the default Filename, FlushInterval and
+// KeepDays filled in.
+func (c TrafficConfig) withDefaults() TrafficConfig {
+	if c.Filename == "" {
+		c.Filename = TrafficFilename
+	}
+	if c.FlushInterval == 0 {
+		c.FlushInterval = int(defaultTrafficFlushInterval / time.Second)
+	}
+	if c.KeepDays == 0 {
+		c.KeepDays = defaultTrafficKeepDays
+	}
+	return c
+}
+
+func (c *TrafficConfig) validate() []error {
+	errs := make([]error, 0)
+	add := func(key string, format string, a ...interface{}) {
+		errs = append(errs, &storage.ConfigError{Key: "Traffic." + key, Err: fmt.Errorf(format, a...)})
+	}
+
+	if c.FlushInterval < 0 {
+		add("FlushInterval", "invalid FlushInterval %d", c.FlushInterval)
+	}
+	if c.KeepDays < 0 {
+		add("KeepDays", "invalid KeepDays %d", c.KeepDays)
+	}
+
+	for i, q := range c.Quotas {
+		prefix := fmt.Sprintf("Quotas[%d]", i)
+		for j, ip := range q.IPs {
+			if _, err := helpers.NewIPMatcher([]string{ip}); err != nil {
+				add(fmt.Sprintf("%s.IPs[%d]", prefix, j), "%v", err)
+			}
+		}
+		for j, name := range q.Filters {
+			if schema, ok := filters.LookupSchema(name); !ok {
+				add(fmt.Sprintf("%s.Filters[%d]", prefix, j), "unknown filter %#v", name)
+			} else if _, ok := schema.Prototype.(filters.RoundTripFilter); !ok {
+				add(fmt.Sprintf("%s.Filters[%d]", prefix, j), "%#v is not a RoundTripFilter", name)
+			}
+		}
+		if q.Daily < 0 || q.Monthly < 0 {
+			add(prefix, "invalid Daily %d or Monthly %d", q.Daily, q.Monthly)
+		}
+		switch q.Status {
+		case 0, http.StatusTooManyRequests, http.StatusForbidden:
+		default:
+			add(prefix+".Status", "invalid Status %d, use 429 or 403", q.Status)
+		}
+	}
+
+	// a monthly quota needs the counts of a whole month
+	for i, q := range c.Quotas {
+		if q.Monthly > 0 && c.KeepDays > 0 && c.KeepDays < 31 {
+			add("KeepDays", "KeepDays %d is less than the 31 days of the Monthly of Quotas[%d]", c.KeepDays, i)
+			break
+		}
+	}
+
+	return errs
+}
+
+// TrafficCount is the bytes a user or a client ip sent and received through
+// a RoundTripFilter.
+type TrafficCount struct {
+	BytesIn  int64
+	BytesOut int64
+}
+
+// TrafficMeter counts the traffic by day, user or client ip and
+// RoundTripFilter. The counts are saved to Filename of Store every
+// FlushInterval and kept for KeepDays, so that they survive the restarts.
+// FlushInterval and KeepDays are guarded by mu once the meter is running.
+type TrafficMeter struct {
+	Filename      string
+	Store         storage.Store
+	FlushInterval time.Duration
+	KeepDays      int
+
+	mu      sync.Mutex
+	days    map[string]map[string]map[string]*TrafficCount
+	dirty   bool
+	flushed time.Time
+	live    map[uint64]func()
+
+	// the filter chains using the meter, guarded by trafficMu
+	refs int
+	done chan struct{}
+}
+
+var (
+	trafficMu     sync.Mutex
+	trafficMeters = make(map[string]*TrafficMeter)
+)
+
+// NewTrafficMeter returns the TrafficMeter of config, the profiles counting to
+// the same Filename share one meter and the settings of the latest one, e.g.
+// of a reload. The meter must be closed by each of them.
+func NewTrafficMeter(config TrafficConfig) (*TrafficMeter, error) {
+	config = config.withDefaults()
+	flushInterval := time.Duration(config.FlushInterval) * time.Second
+	keepDays := config.KeepDays
+
+	trafficMu.Lock()
+	defer trafficMu.Unlock()
+
+	if m, ok := trafficMeters[config.Filename]; ok {
+		m.mu.Lock()
+		if m.FlushInterval != flushInterval || m.KeepDays != keepDays {
+			glog.Infof("TrafficMeter %#v FlushInterval %v and KeepDays %d are changed to %v and %d", m.Filename, m.FlushInterval, m.KeepDays, flushInterval, keepDays)
+			m.FlushInterval, m.KeepDays = flushInterval, keepDays
+		}
+		m.mu.Unlock()
+		m.refs++
+		return m, nil
+	}
+
+	m := &TrafficMeter{
+		Filename:      config.Filename,
+		Store:         storage.LookupStoreByFilterName("httpproxy"),
+		FlushInterval: flushInterval,
+		KeepDays:      keepDays,
+		days:          make(map[string]map[string]map[string]*TrafficCount),
+		flushed:       time.Now(),
+		live:          make(map[uint64]func()),
+		refs:          1,
+		done:          make(chan struct{}),
+	}
+
+	if err := m.load(); err != nil {
+		return nil, fmt.Errorf("TrafficMeter load %#v error: %v", m.Filename, err)
+	}
+
+	trafficMeters[config.Filename] = m
+	go m.loop()
+
+	return m, nil
+}
+
+// Close releases the meter, the last one of its filter chains stops the loop
+// and saves the counts.
+func (m *TrafficMeter) Close() error {
+	trafficMu.Lock()
+	if m.refs--; m.refs > 0 {
+		trafficMu.Unlock()
+		return nil
+	}
+	if trafficMeters[m.Filename] == m {
+		delete(trafficMeters, m.Filename)
+	}
+	close(m.done)
+	trafficMu.Unlock()
+
+	return m.Flush()
+}
+
+func (m *TrafficMeter) load() error {
+	resp, err := m.Store.Get(m.Filename)
+	if storage.IsNotExist(resp, err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(data, &m.days); err != nil {
+		return err
+	}
+	if m.days == nil {
+		m.days = make(map[string]map[string]map[string]*TrafficCount)
+	}
+
+	return nil
+}
+
+// loop counts the requests and the tunnels in flight and saves the counts
+// until the meter is closed.
+func (m *TrafficMeter) loop() {
+	ticker := time.NewTicker(trafficCollectInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.done:
+			return
+		}
+
+		m.mu.Lock()
+		live := make([]func(), 0, len(m.live))
+		for _, f := range m.live {
+			live = append(live, f)
+		}
+		due := time.Since(m.flushed) >= m.FlushInterval
+		m.mu.Unlock()
+
+		for _, f := range live {
+			f()
+		}
+
+		if due {
+			if err := m.Flush(); err != nil {
+				glog.Warningf("TrafficMeter flush %#v error: %v", m.Filename, err)
+			}
+		}
+	}
+}
+
+// track registers count of the request id in flight, which loop calls until
+// untrack.
+func (m *TrafficMeter) track(id uint64, count func()) {
+	m.mu.Lock()
+	m.live[id] = count
+	m.mu.Unlock()
+}
+
+func (m *TrafficMeter) untrack(id uint64) {
+	m.mu.Lock()
+	delete(m.live, id)
+	m.mu.Unlock()
+}
+
+// Add counts the bytes of key, a user or a client ip, through filter today.
+func (m *TrafficMeter) Add(key, filter string, in, out int64) {
+	day := time.Now().Format(trafficDayFormat)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys, ok := m.days[day]
+	if !ok {
+		keys = make(map[string]map[string]*TrafficCount)
+		m.days[day] = keys
+	}
+	counts, ok := keys[key]
+	if !ok {
+		counts = make(map[string]*TrafficCount)
+		keys[key] = counts
+	}
+	c, ok := counts[filter]
+	if !ok {
+		c = &TrafficCount{}
+		counts[filter] = c
+	}
+
+	c.BytesIn += in
+	c.BytesOut += out
+	m.dirty = true
+}
+
+// usage returns the bytes of key through the filters counted by covers in the
+// days starting with prefix, e.g. a day or a month.
+func (m *TrafficMeter) usage(key, prefix string, covers func(filter string) bool) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	for day, keys := range m.days {
+		if !strings.HasPrefix(day, prefix) {
+			continue
+		}
+		for filter, c := range keys[key] {
+			if covers(filter) {
+				n += c.BytesIn + c.BytesOut
+			}
+		}
+	}
+
+	return n
+}
+
+// Counts returns the counts of the days starting with prefix summed by user
+// or client ip and filter.
+func (m *TrafficMeter) Counts(prefix string) map[string]map[string]TrafficCount {
+	counts := make(map[string]map[string]TrafficCount)
+	m.sumCounts(counts, prefix)
+	return counts
+}
+
+// sumCounts adds the counts of the days starting with prefix to counts.
+func (m *TrafficMeter) sumCounts(counts map[string]map[string]TrafficCount, prefix string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for day, keys := range m.days {
+		if !strings.HasPrefix(day, prefix) {
+			continue
+		}
+		for key, byFilter := range keys {
+			if counts[key] == nil {
+				counts[key] = make(map[string]TrafficCount)
+			}
+			for filter, c := range byFilter {
+				c1 := counts[key][filter]
+				c1.BytesIn += c.BytesIn
+				c1.BytesOut += c.BytesOut
+				counts[key][filter] = c1
+			}
+		}
+	}
+}
+
+// Flush drops the days older than KeepDays and saves the counts if they are
+// changed.
+func (m *TrafficMeter) Flush() error {
+	m.mu.Lock()
+	oldest := time.Now().AddDate(0, 0, -m.KeepDays).Format(trafficDayFormat)
+	m.flushed = time.Now()
+	for day := range m.days {
+		if day < oldest {
+			delete(m.days, day)
+			m.dirty = true
+		}
+	}
+	if !m.dirty {
+		m.mu.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(m.days, "", "\t")
+	m.dirty = false
+	m.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = m.Store.Put(m.Filename, http.Header{}, ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+		m.mu.Lock()
+		m.dirty = true
+		m.mu.Unlock()
+	}
+
+	return err
+}
+
+// Quota is a traffic quota of the users and the client ips.
+type Quota struct {
+	QuotaConfig
+
+	users   map[string]struct{}
+	ips     *helpers.IPMatcher
+	filters map[string]struct{}
+}
+
+func NewQuota(config QuotaConfig) (*Quota, error) {
+	ips, err := helpers.NewIPMatcher(config.IPs)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Quota{
+		QuotaConfig: config,
+		users:       make(map[string]struct{}),
+		ips:         ips,
+		filters:     make(map[string]struct{}),
+	}
+
+	if q.Status == 0 {
+		q.Status = http.StatusTooManyRequests
+	}
+	for _, user := range config.Users {
+		q.users[user] = struct{}{}
+	}
+	for _, name := range config.Filters {
+		q.filters[name] = struct{}{}
+	}
+
+	return q, nil
+}
+
+func (q *Quota) match(user, ip string) bool {
+	if user != "" {
+		_, ok := q.users[user]
+		_, all := q.users["*"]
+		return ok || all
+	}
+	return q.ips.MatchString(ip)
+}
+
+func (q *Quota) covers(filter string) bool {
+	if len(q.filters) == 0 {
+		return true
+	}
+	return filters.MatchName(q.filters, filter)
+}
+
+// QuotaError is the error of the requests refused by a used up Quota, it
+// wraps filters.ErrOverQuota.
+type QuotaError struct {
+	Key    string // the user or the client ip
+	Period string // "daily" or "monthly"
+	Used   int64  // bytes
+	Limit  int64  // bytes
+	Reset  time.Time
+	Status int
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s traffic quota of %s is used up, %s of %s, it resets at %s",
+		e.Period, e.Key, formatBytes(e.Used), formatBytes(e.Limit), e.Reset.Format("2006-01-02 15:04 MST"))
+}
+
+func (e *QuotaError) Unwrap() error {
+	return filters.ErrOverQuota
+}
+
+func formatBytes(n int64) string {
+	const unit = 1 << 10
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTP"[exp])
+}
+
+// checkQuota returns a *QuotaError if the user, or the client ip of the
+// requests without one, used up a quota covering filter.
+func (fc *FilterChain) checkQuota(user, ip, filter string) error {
+	m := fc.TrafficMeter
+	if m == nil {
+		return nil
+	}
+
+	key := user
+	if key == "" {
+		key = ip
+	}
+
+	now := time.Now()
+	for _, q := range fc.Quotas {
+		if !q.match(user, ip) || !q.covers(filter) {
+			continue
+		}
+		if q.Daily > 0 {
+			if used := m.usage(key, now.Format(trafficDayFormat), q.covers); used >= q.Daily<<20 {
+				reset := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+				return &QuotaError{Key: key, Period: "daily", Used: used, Limit: q.Daily << 20, Reset: reset, Status: q.Status}
+			}
+		}
+		if q.Monthly > 0 {
+			if used := m.usage(key, now.Format(trafficMonthFormat), q.covers); used >= q.Monthly<<20 {
+				reset := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())
+				return &QuotaError{Key: key, Period: "monthly", Used: used, Limit: q.Monthly << 20, Reset: reset, Status: q.Status}
+			}
+		}
+	}
+
+	return nil
+}
+
+// countTraffic counts the bytes of e since the last count to the user, or
+// the client ip, and the RoundTripFilter of it, the requests served by none,
+// e.g. the tunnels of stripssl whose requests are counted on their own, are
+// not counted. A tunnel over quota is closed.
+func (fc *FilterChain) countTraffic(e *connEntry) {
+	info := e.info()
+	if info.Filter == "" {
+		return
+	}
+
+	e.mu.Lock()
+	in, out := info.BytesIn-e.countedIn, info.BytesOut-e.countedOut
+	e.countedIn, e.countedOut = info.BytesIn, info.BytesOut
+	e.mu.Unlock()
+
+	if in <= 0 && out <= 0 {
+		return
+	}
+
+	user := filters.User(e.ctx)
+	ip := clientIP(info.Client)
+	key := user
+	if key == "" {
+		key = ip
+	}
+
+	fc.TrafficMeter.Add(key, info.Filter, in, out)
+
+	if info.Tunnel {
+		if err := fc.checkQuota(user, ip, info.Filter); err != nil {
+			glog.Infof("GoProxy close tunnel %s of %s to %s: %v", info.RequestID, key, info.Target, err)
+			e.close()
+		}
+	}
+}
+
+// clientIP returns the ip of remoteAddr.
+func clientIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// trafficMetersOf returns the distinct meters of servers, sorted by filename.
+func trafficMetersOf(servers map[string]*Server) []*TrafficMeter {
+	seen := make(map[*TrafficMeter]struct{})
+	meters := make([]*TrafficMeter, 0)
+	for _, s := range servers {
+		fc := s.Handler.FilterChain()
+		if fc == nil || fc.TrafficMeter == nil {
+			continue
+		}
+		if _, ok := seen[fc.TrafficMeter]; !ok {
+			seen[fc.TrafficMeter] = struct{}{}
+			meters = append(meters, fc.TrafficMeter)
+		}
+	}
+	sort.Slice(meters, func(i, j int) bool { return meters[i].Filename < meters[j].Filename })
+	return meters
+}
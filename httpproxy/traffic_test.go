@@ -0,0 +1,403 @@
+package httpproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xuiv/goproxy/httpproxy/filters"
+)
+
+// memStore is a storage.Store in memory.
+type memStore struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	puts  int
+}
+
+func newMemStore() *memStore {
+	return &memStore{files: make(map[string][]byte)}
+}
+
+func (s *memStore) Get(name string) (*http.Response, error) {
+	s.mu.Lock()
+	data, ok := s.files[name]
+	s.mu.Unlock()
+
+	if !ok {
+		return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody}, nil
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (s *memStore) List(name string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (s *memStore) Put(name string, header http.Header, data io.ReadCloser) (*http.Response, error) {
+	defer data.Close()
+
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.files[name] = b
+	s.puts++
+	s.mu.Unlock()
+
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func (s *memStore) Copy(dest string, src string) (*http.Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.files[src]
+	if !ok {
+		return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody}, nil
+	}
+	s.files[dest] = data
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func (s *memStore) Head(name string) (*http.Response, error) {
+	s.mu.Lock()
+	_, ok := s.files[name]
+	s.mu.Unlock()
+
+	if !ok {
+		return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody}, nil
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func (s *memStore) Delete(name string) (*http.Response, error) {
+	s.mu.Lock()
+	delete(s.files, name)
+	s.mu.Unlock()
+
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func (s *memStore) UnmarshallJson(name string, config interface{}) error {
+	s.mu.Lock()
+	data, ok := s.files[name]
+	s.mu.Unlock()
+
+	if !ok {
+		return errors.New(name + " does not exist")
+	}
+	return json.Unmarshal(data, config)
+}
+
+// newTestChain returns a FilterChain of the quotas and a TrafficMeter of
+// store, without the loop of NewTrafficMeter.
+func newTestChain(t *testing.T, store *memStore, quotas ...QuotaConfig) *FilterChain {
+	m := &TrafficMeter{
+		Filename:      TrafficFilename,
+		Store:         store,
+		FlushInterval: time.Minute,
+		KeepDays:      31,
+		days:          make(map[string]map[string]map[string]*TrafficCount),
+		flushed:       time.Now(),
+		live:          make(map[uint64]func()),
+	}
+	if err := m.load(); err != nil {
+		t.Fatalf("TrafficMeter load error: %v", err)
+	}
+
+	fc := &FilterChain{TrafficMeter: m}
+	for _, config := range quotas {
+		q, err := NewQuota(config)
+		if err != nil {
+			t.Fatalf("NewQuota(%#v) error: %v", config, err)
+		}
+		fc.Quotas = append(fc.Quotas, q)
+	}
+	return fc
+}
+
+func TestTrafficConfigValidate(t *testing.T) {
+	for _, c := range []struct {
+		keepDays int
+		monthly  int64
+		ok       bool
+	}{
+		{0, 1024, true},
+		{31, 1024, true},
+		{62, 1024, true},
+		{30, 0, true},
+		{30, 1024, false},
+		{1, 1024, false},
+		{-1, 0, false},
+	} {
+		config := TrafficConfig{
+			Enabled:  true,
+			KeepDays: c.keepDays,
+			Quotas:   []QuotaConfig{{Users: []string{"*"}, Daily: 64}, {Users: []string{"*"}, Monthly: c.monthly}},
+		}
+		if errs := config.validate(); (len(errs) == 0) != c.ok {
+			t.Errorf("validate of KeepDays %d and Monthly %d = %v, want ok=%v", c.keepDays, c.monthly, errs, c.ok)
+		}
+	}
+}
+
+func TestTrafficMeterCount(t *testing.T) {
+	fc := newTestChain(t, newMemStore(), QuotaConfig{Users: []string{"alice"}, Filters: []string{"direct"}})
+	m, q := fc.TrafficMeter, fc.Quotas[0]
+
+	m.Add("alice", "direct", 100, 1000)
+	m.Add("alice", "direct", 10, 10)
+	m.Add("alice", "gae", 1, 2)
+	m.Add("192.0.2.1", "direct@corp", 5, 5)
+
+	today := time.Now().Format(trafficDayFormat)
+	counts := m.Counts(today)
+
+	if c := counts["alice"]["direct"]; c.BytesIn != 110 || c.BytesOut != 1010 {
+		t.Errorf("alice through direct = %+v, want 110 in and 1010 out", c)
+	}
+	if c := counts["alice"]["gae"]; c.BytesIn != 1 || c.BytesOut != 2 {
+		t.Errorf("alice through gae = %+v, want 1 in and 2 out", c)
+	}
+	if c := counts["192.0.2.1"]["direct@corp"]; c.BytesIn != 5 || c.BytesOut != 5 {
+		t.Errorf("192.0.2.1 through direct@corp = %+v, want 5 in and 5 out", c)
+	}
+
+	if n := m.usage("alice", today, q.covers); n != 1120 {
+		t.Errorf("usage of alice through direct = %d, want 1120", n)
+	}
+	if n := m.usage("alice", time.Now().Format(trafficMonthFormat), func(string) bool { return true }); n != 1123 {
+		t.Errorf("usage of alice this month = %d, want 1123", n)
+	}
+	if n := m.usage("bob", today, q.covers); n != 0 {
+		t.Errorf("usage of bob = %d, want 0", n)
+	}
+}
+
+func TestTrafficMeterFlush(t *testing.T) {
+	store := newMemStore()
+	m := newTestChain(t, store).TrafficMeter
+
+	// the meter is not saved until something is counted
+	if err := m.Flush(); err != nil {
+		t.Fatalf("Flush error: %v", err)
+	}
+	if store.puts != 0 {
+		t.Fatalf("Flush of no counts puts %d times, want 0", store.puts)
+	}
+
+	old := time.Now().AddDate(0, 0, -40).Format(trafficDayFormat)
+	m.days[old] = map[string]map[string]*TrafficCount{"alice": {"direct": {BytesIn: 1, BytesOut: 1}}}
+	m.Add("alice", "direct", 100, 200)
+	m.Add("192.0.2.1", "gae", 300, 400)
+
+	if err := m.Flush(); err != nil {
+		t.Fatalf("Flush error: %v", err)
+	}
+	if store.puts != 1 {
+		t.Fatalf("Flush puts %d times, want 1", store.puts)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("Flush error: %v", err)
+	}
+	if store.puts != 1 {
+		t.Errorf("Flush of unchanged counts puts %d times, want 1", store.puts)
+	}
+
+	// the counts survive a restart, the days older than KeepDays do not
+	m1 := newTestChain(t, store).TrafficMeter
+	if _, ok := m1.days[old]; ok {
+		t.Errorf("the day %s older than KeepDays is kept", old)
+	}
+
+	today := time.Now().Format(trafficDayFormat)
+	counts := m1.Counts(today)
+	if c := counts["alice"]["direct"]; c.BytesIn != 100 || c.BytesOut != 200 {
+		t.Errorf("the loaded alice through direct = %+v, want 100 in and 200 out", c)
+	}
+	if c := counts["192.0.2.1"]["gae"]; c.BytesIn != 300 || c.BytesOut != 400 {
+		t.Errorf("the loaded 192.0.2.1 through gae = %+v, want 300 in and 400 out", c)
+	}
+
+	m1.Add("alice", "direct", 1, 1)
+	if c := m1.Counts(today)["alice"]["direct"]; c.BytesIn != 101 || c.BytesOut != 201 {
+		t.Errorf("alice through direct after a restart = %+v, want 101 in and 201 out", c)
+	}
+}
+
+func TestTrafficMeterReload(t *testing.T) {
+	installTestFilter(t, &testRoundTripFilter{name: "test-one", body: []byte("one")})
+
+	p := NewProfiles("goproxy")
+	traffic := TrafficConfig{Enabled: true, Filename: "test-reload-traffic.json", FlushInterval: 60}
+	config := Config{Enabled: true, Address: freeAddr(t), ShutdownTimeout: 1, RoundTripFilters: []string{"test-one"}, Traffic: traffic}
+	if err := p.Start("default", config); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	m := p.Servers()["default"].Handler.FilterChain().TrafficMeter
+
+	config.Traffic.FlushInterval = 5
+	config.Traffic.KeepDays = 40
+	if err := reloadProfiles(t, p, map[string]Config{"default": config}); err != nil {
+		t.Fatalf("Reload error: %v", err)
+	}
+
+	m1 := p.Servers()["default"].Handler.FilterChain().TrafficMeter
+	if m1 != m {
+		t.Errorf("Reload replaces the meter of the same file")
+	}
+	m1.mu.Lock()
+	flushInterval, keepDays := m1.FlushInterval, m1.KeepDays
+	m1.mu.Unlock()
+	if flushInterval != 5*time.Second || keepDays != 40 {
+		t.Errorf("the meter after Reload has FlushInterval %v and KeepDays %d, want 5s and 40", flushInterval, keepDays)
+	}
+
+	// the loop stops once the last chain of the meter is closed
+	p.Shutdown()
+	select {
+	case <-m.done:
+	default:
+		t.Errorf("the meter is not closed after Shutdown")
+	}
+	trafficMu.Lock()
+	_, ok := trafficMeters[traffic.Filename]
+	trafficMu.Unlock()
+	if ok {
+		t.Errorf("the closed meter of %#v is still cached", traffic.Filename)
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	fc := newTestChain(t, newMemStore(),
+		QuotaConfig{Users: []string{"alice"}, Filters: []string{"direct"}, Daily: 1},
+		QuotaConfig{IPs: []string{"192.0.2.0/24"}, Monthly: 2, Status: http.StatusForbidden},
+	)
+	m := fc.TrafficMeter
+
+	now := time.Now()
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+	nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())
+
+	// daily
+	m.Add("alice", "direct", 1<<20-1, 0)
+	if err := fc.checkQuota("alice", "192.0.2.1", "direct"); err != nil {
+		t.Fatalf("checkQuota of alice under the daily quota error: %v", err)
+	}
+	m.Add("alice", "gae", 1<<20, 0)
+	if err := fc.checkQuota("alice", "192.0.2.1", "direct@corp"); err != nil {
+		t.Fatalf("checkQuota of alice counts gae for direct: %v", err)
+	}
+	m.Add("alice", "direct@corp", 0, 1)
+
+	err := fc.checkQuota("alice", "192.0.2.1", "direct")
+	var quotaErr *QuotaError
+	if !errors.As(err, &quotaErr) || !errors.Is(err, filters.ErrOverQuota) {
+		t.Fatalf("checkQuota of alice over the daily quota = %v, want a QuotaError", err)
+	}
+	if quotaErr.Period != "daily" || quotaErr.Key != "alice" || quotaErr.Used != 1<<20 || quotaErr.Limit != 1<<20 {
+		t.Errorf("QuotaError = %+v", quotaErr)
+	}
+	if quotaErr.Status != http.StatusTooManyRequests || !quotaErr.Reset.Equal(tomorrow) {
+		t.Errorf("QuotaError status %d and reset %s, want 429 and %s", quotaErr.Status, quotaErr.Reset, tomorrow)
+	}
+	if err := fc.checkQuota("alice", "192.0.2.1", "gae"); err != nil {
+		t.Errorf("checkQuota of alice through gae error: %v", err)
+	}
+
+	// monthly, by the client ip of the requests without a user, the days of
+	// the last month do not count
+	lastMonth := time.Date(now.Year(), now.Month(), 0, 0, 0, 0, 0, now.Location()).Format(trafficDayFormat)
+	firstDay := now.Format(trafficMonthFormat) + "-01"
+	m.mu.Lock()
+	m.days[lastMonth] = map[string]map[string]*TrafficCount{"192.0.2.1": {"gae": {BytesIn: 10 << 20}}}
+	if m.days[firstDay] == nil {
+		m.days[firstDay] = make(map[string]map[string]*TrafficCount)
+	}
+	m.days[firstDay]["192.0.2.1"] = map[string]*TrafficCount{"vps": {BytesIn: 1 << 20}}
+	m.mu.Unlock()
+
+	if err := fc.checkQuota("", "192.0.2.1", "gae"); err != nil {
+		t.Fatalf("checkQuota of 192.0.2.1 under the monthly quota error: %v", err)
+	}
+	if err := fc.checkQuota("", "198.51.100.1", "gae"); err != nil {
+		t.Fatalf("checkQuota of an ip out of the quota error: %v", err)
+	}
+
+	m.Add("192.0.2.1", "gae", 0, 1<<20)
+	err = fc.checkQuota("", "192.0.2.1", "gae")
+	if !errors.As(err, &quotaErr) {
+		t.Fatalf("checkQuota of 192.0.2.1 over the monthly quota = %v, want a QuotaError", err)
+	}
+	if quotaErr.Period != "monthly" || quotaErr.Key != "192.0.2.1" || quotaErr.Status != http.StatusForbidden || !quotaErr.Reset.Equal(nextMonth) {
+		t.Errorf("QuotaError = %+v", quotaErr)
+	}
+
+	// a user is never counted by the client ip
+	if err := fc.checkQuota("bob", "192.0.2.1", "gae"); err != nil {
+		t.Errorf("checkQuota of bob from 192.0.2.1 error: %v", err)
+	}
+}
+
+func TestQuotaResponse(t *testing.T) {
+	fc := newTestChain(t, newMemStore(), QuotaConfig{IPs: []string{"192.0.2.0/24"}, Daily: 1})
+	fc.RoundTripFilters = []filters.RoundTripFilter{&testRoundTripFilter{name: "direct", body: make([]byte, 1<<20)}}
+	m := fc.TrafficMeter
+	// the error pages show the address of the listener
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %v", err)
+	}
+	defer ln.Close()
+	h := NewHandler(ln, fc, "goproxy")
+
+	serve := func() *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		h.ServeHTTP(rw, req)
+		return rw
+	}
+
+	if rw := serve(); rw.Code != http.StatusOK || rw.Body.Len() != 1<<20 {
+		t.Fatalf("the 1st request = %d with %d bytes, want 200 with 1 MiB", rw.Code, rw.Body.Len())
+	}
+
+	today := time.Now().Format(trafficDayFormat)
+	if c := m.Counts(today)["192.0.2.1"]["direct"]; c.BytesOut < 1<<20 {
+		t.Fatalf("the 1st request is counted as %+v, want at least 1 MiB out", c)
+	}
+
+	rw := serve()
+	if rw.Code != http.StatusTooManyRequests {
+		t.Fatalf("the request over the quota = %d, want 429", rw.Code)
+	}
+	retry, err := strconv.Atoi(rw.Header().Get("Retry-After"))
+	if err != nil || retry <= 0 || retry > 25*60*60 {
+		t.Errorf("Retry-After = %#v, want the seconds until tomorrow", rw.Header().Get("Retry-After"))
+	}
+
+	// the refused request is not counted
+	if c := m.Counts(today)["192.0.2.1"]["direct"]; c.BytesOut >= 2<<20 {
+		t.Errorf("the refused request is counted, %+v", c)
+	}
+}
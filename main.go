@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/phuslu/glog"
@@ -24,6 +27,9 @@ import (
 
 var (
 	version = "r9999"
+
+	check          = flag.Bool("check", false, "check httpproxy.json and the configs of the enabled filters, then exit")
+	reloadInterval = flag.Duration("reload_interval", 0, "interval to check httpproxy.json and filter configs for changes, 0 to reload on SIGHUP only")
 )
 
 func init() {
@@ -64,11 +70,28 @@ func main() {
 
 	config := make(map[string]httpproxy.Config)
 	filename := "httpproxy.json"
-	err := storage.LookupStoreByFilterName("httpproxy").UnmarshallJson(filename, &config)
+	store := storage.LookupStoreByFilterName("httpproxy")
+
+	if *check {
+		errs := httpproxy.CheckConfig(store, filename)
+		for _, err := range errs {
+			fmt.Println(err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("OK")
+		return
+	}
+
+	err := store.UnmarshallJson(filename, &config)
 	if err != nil {
 		fmt.Printf("storage.LookupStoreByFilterName(%#v) failed: %s\n", filename, err)
 		return
 	}
+	digest, _ := storage.JsonConfigDigest(store, filename)
+
+	profiles := httpproxy.NewProfiles("goproxy " + version)
 
 	fmt.Fprintf(os.Stderr, `------------------------------------------------------
 GoProxy Version    : %s (go/%s %s/%s)`,
@@ -102,7 +125,7 @@ Enabled Filters    : %v`,
 				glog.Fatalf("filters.GetFilter(%#v) error: %+v", fn, err)
 			}
 
-			switch fn {
+			switch name, _ := filters.SplitName(fn); name {
 			case "autoproxy":
 				fmt.Fprintf(os.Stderr, `
 Pac Server         : http://%s/proxy.pac`, addr)
@@ -133,7 +156,24 @@ GAE Mode           : TLS`)
 PHP Servers         : %s`, strings.Join(urls, "|"))
 			}
 		}
-		go httpproxy.ServeProfile(config, "goproxy "+version)
+		if err := profiles.Start(profile, config); err != nil {
+			glog.Fatalf("httpproxy.NewServer(%#v) error: %+v", profile, err)
+		}
+	}
+
+	var adminConfig httpproxy.AdminConfig
+	if err := storage.LookupStoreByFilterName("admin").UnmarshallJson("admin.json", &adminConfig); err == nil && adminConfig.Enabled {
+		admin, err := httpproxy.NewAdmin(adminConfig, profiles)
+		if err != nil {
+			glog.Fatalf("httpproxy.NewAdmin(%#v) error: %+v", adminConfig.Address, err)
+		}
+		fmt.Fprintf(os.Stderr, `
+Admin Address      : http://%s/`, adminConfig.Address)
+		go func() {
+			if err := admin.Serve(); err != nil && err != http.ErrServerClosed {
+				glog.Errorf("GoProxy Admin Serve error: %+v", err)
+			}
+		}()
 	}
 	fmt.Fprintf(os.Stderr, "\n------------------------------------------------------\n")
 
@@ -144,5 +184,82 @@ PHP Servers         : %s`, strings.Join(urls, "|"))
 		}
 	}
 
-	select {}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if *reloadInterval > 0 {
+		ticker := time.NewTicker(*reloadInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var sig os.Signal
+	for sig == nil {
+		select {
+		case s := <-sigs:
+			if s != syscall.SIGHUP {
+				sig = s
+				break
+			}
+			glog.Infof("GoProxy received %v, reloading %#v", s, filename)
+			digest, _ = storage.JsonConfigDigest(store, filename)
+			reload(profiles, store, filename)
+		case <-tick:
+			d, _ := storage.JsonConfigDigest(store, filename)
+			if d == digest && len(filters.Stale()) == 0 {
+				continue
+			}
+			glog.Infof("GoProxy config changed, reloading %#v", filename)
+			digest = d
+			reload(profiles, store, filename)
+		}
+	}
+
+	glog.Infof("GoProxy received %v, draining connections, send it again to exit immediately", sig)
+
+	go func() {
+		var s os.Signal
+		for s = range sigs {
+			if s != syscall.SIGHUP {
+				break
+			}
+		}
+		glog.Warningf("GoProxy received %v again, exit", s)
+		glog.Flush()
+		os.Exit(1)
+	}()
+
+	profiles.Shutdown()
+	filters.CloseAll()
+
+	glog.Infof("GoProxy exited")
+	glog.Flush()
+}
+
+// reload re-reads filename, rebuilds the filters whose configs are changed
+// and applies both to the running profiles. On error the running profiles
+// are left as they are.
+func reload(profiles *httpproxy.Profiles, store storage.Store, filename string) {
+	config := make(map[string]httpproxy.Config)
+	if err := store.UnmarshallJson(filename, &config); err != nil {
+		glog.Errorf("GoProxy reload %#v error: %+v", filename, err)
+		return
+	}
+
+	staged, err := filters.Stage()
+	if err != nil {
+		glog.Errorf("GoProxy reload filters error: %+v", err)
+		return
+	}
+
+	if err := profiles.Reload(config, staged); err != nil {
+		glog.Errorf("GoProxy reload profiles error: %+v", err)
+		return
+	}
+	if len(staged.Names) > 0 {
+		glog.Infof("GoProxy reloaded filters %v", staged.Names)
+	}
+
+	glog.Infof("GoProxy reloaded %#v", filename)
 }